@@ -1,17 +1,62 @@
+CREATE TABLE IF NOT EXISTS users
+(
+    id            SERIAL PRIMARY KEY,
+    email         TEXT NOT NULL UNIQUE,
+    name          TEXT NOT NULL,
+    password_hash TEXT NOT NULL,
+    -- admin, editor or viewer
+    role          TEXT NOT NULL DEFAULT 'viewer',
+    -- values the row rules of datasets are filled with, e.g. {"regions": ["EMEA"]}
+    attributes    JSONB NOT NULL DEFAULT '{}',
+    created_at    TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+    -- sha256 of the session token, the token itself is only known to the client
+    token_hash TEXT PRIMARY KEY,
+    user_id    INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id           SERIAL PRIMARY KEY,
+    user_id      INT  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL,
+    key_hash     TEXT NOT NULL UNIQUE,
+    last_used_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+
 CREATE TABLE IF NOT EXISTS sources
 (
-    id     SERIAL PRIMARY KEY,
-    name   TEXT,
-    type   TEXT,
-    config JSONB
+    id         SERIAL PRIMARY KEY,
+    name       TEXT,
+    type       TEXT,
+    config     JSONB,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    updated_by INT REFERENCES users (id) ON DELETE SET NULL,
+    deleted_at TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS datasets
 (
-    id        SERIAL PRIMARY KEY,
-    source_id INT NOT NULL REFERENCES sources (id),
-    name      TEXT,
-    config    JSONB
+    id         SERIAL PRIMARY KEY,
+    source_id  INT NOT NULL REFERENCES sources (id),
+    name       TEXT,
+    config     JSONB,
+    version    INT NOT NULL DEFAULT 1,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    updated_by INT REFERENCES users (id) ON DELETE SET NULL,
+    deleted_at TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS charts
@@ -20,16 +65,245 @@ CREATE TABLE IF NOT EXISTS charts
     dataset_id INT REFERENCES datasets (id),
     name       TEXT,
     type       TEXT,
-    config     JSONB
+    config     JSONB,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    updated_by INT REFERENCES users (id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT NOW(),
+    deleted_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS chart_revisions
+(
+    id         SERIAL PRIMARY KEY,
+    chart_id   INT NOT NULL REFERENCES charts (id) ON DELETE CASCADE,
+    version    INT NOT NULL,
+    dataset_id INT,
+    name       TEXT,
+    type       TEXT,
+    config     JSONB,
+    author_id  INT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMP,
+    UNIQUE (chart_id, version)
 );
 
 CREATE TABLE IF NOT EXISTS dashboards
 (
-    id   SERIAL PRIMARY KEY,
-    name TEXT,
-    grid JSONB
+    id         SERIAL PRIMARY KEY,
+    name       TEXT,
+    grid       JSONB,
+    filters    JSONB DEFAULT '[]',
+    version    INT NOT NULL DEFAULT 1,
+    -- seconds between automatic refreshes of live viewers, 0 disables them
+    refresh_interval INT NOT NULL DEFAULT 0,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    updated_by INT REFERENCES users (id) ON DELETE SET NULL,
+    deleted_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS queries
+(
+    id          SERIAL PRIMARY KEY,
+    chart_id    INT,
+    dataset_id  INT,
+    source_id   INT,
+    sql         TEXT,
+    duration_ms DOUBLE PRECISION,
+    row_count   INT,
+    cache_hit   BOOLEAN   DEFAULT FALSE,
+    error       TEXT,
+    created_at  TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS queries_created_at_idx ON queries (created_at);
+CREATE INDEX IF NOT EXISTS queries_chart_id_idx ON queries (chart_id);
+
+CREATE TABLE IF NOT EXISTS schedules
+(
+    id          SERIAL PRIMARY KEY,
+    name        TEXT NOT NULL,
+    kind        TEXT NOT NULL,
+    target_id   INT  NOT NULL,
+    cron        TEXT NOT NULL,
+    timezone    TEXT NOT NULL DEFAULT 'UTC',
+    format      TEXT NOT NULL,
+    recipients  TEXT[] NOT NULL,
+    enabled     BOOLEAN NOT NULL DEFAULT TRUE,
+    next_run_at TIMESTAMPTZ,
+    created_at  TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS schedules_next_run_at_idx ON schedules (next_run_at) WHERE enabled;
+
+CREATE TABLE IF NOT EXISTS deliveries
+(
+    id              SERIAL PRIMARY KEY,
+    schedule_id     INT NOT NULL REFERENCES schedules (id) ON DELETE CASCADE,
+    scheduled_for   TIMESTAMPTZ NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT  NOT NULL DEFAULT 0,
+    error           TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS deliveries_schedule_id_idx ON deliveries (schedule_id);
+CREATE INDEX IF NOT EXISTS deliveries_due_idx ON deliveries (next_attempt_at) WHERE status IN ('pending', 'retrying');
+
+CREATE TABLE IF NOT EXISTS alerts
+(
+    id             SERIAL PRIMARY KEY,
+    name           TEXT NOT NULL,
+    chart_id       INT  NOT NULL REFERENCES charts (id) ON DELETE CASCADE,
+    metric         TEXT NOT NULL,
+    condition_type TEXT NOT NULL,
+    operator       TEXT NOT NULL,
+    threshold      DOUBLE PRECISION NOT NULL,
+    skip_partial   BOOLEAN NOT NULL DEFAULT FALSE,
+    -- seconds between evaluations
+    check_interval INT NOT NULL,
+    emails         TEXT[] NOT NULL DEFAULT '{}',
+    webhooks       TEXT[] NOT NULL DEFAULT '{}',
+    enabled        BOOLEAN NOT NULL DEFAULT TRUE,
+    state          TEXT NOT NULL DEFAULT 'ok',
+    last_value     DOUBLE PRECISION,
+    last_error     TEXT,
+    evaluated_at   TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS alerts_chart_id_idx ON alerts (chart_id);
+
+CREATE TABLE IF NOT EXISTS alert_events
+(
+    id           SERIAL PRIMARY KEY,
+    alert_id     INT NOT NULL REFERENCES alerts (id) ON DELETE CASCADE,
+    state        TEXT NOT NULL,
+    period       TEXT,
+    value        DOUBLE PRECISION NOT NULL,
+    previous     DOUBLE PRECISION,
+    observed     DOUBLE PRECISION NOT NULL,
+    message      TEXT NOT NULL,
+    notify_error TEXT,
+    created_at   TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS alert_events_alert_id_idx ON alert_events (alert_id, created_at);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL,
+    -- event filters, e.g. chart.created or chart.*; empty means every event
+    events     TEXT[] NOT NULL DEFAULT '{}',
+    enabled    BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              SERIAL PRIMARY KEY,
+    webhook_id      INT  NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id        TEXT NOT NULL,
+    event           TEXT NOT NULL,
+    payload         JSONB NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT  NOT NULL DEFAULT 0,
+    response_status INT,
+    error           TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status IN ('pending', 'retrying');
+CREATE INDEX IF NOT EXISTS webhook_deliveries_failed_idx ON webhook_deliveries (id) WHERE status = 'failed';
+
+CREATE TABLE IF NOT EXISTS shares
+(
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    kind       TEXT NOT NULL,
+    target_id  INT  NOT NULL,
+    -- dashboard filter values viewers can't widen, keyed by filter name
+    locked     JSONB NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+CREATE INDEX IF NOT EXISTS shares_target_idx ON shares (kind, target_id);
+
+CREATE TABLE IF NOT EXISTS groups
+(
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS group_members
+(
+    group_id INT NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    user_id  INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members (user_id);
+
+-- entities with grants are restricted to the granted groups, no cascade from
+-- groups so deleting one can't open an entity up to everyone
+CREATE TABLE IF NOT EXISTS grants
+(
+    id         SERIAL PRIMARY KEY,
+    kind       TEXT NOT NULL,
+    target_id  INT  NOT NULL,
+    group_id   INT  NOT NULL REFERENCES groups (id),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (kind, target_id, group_id)
+);
+
+-- databases created before user accounts lack the columns tracking who
+-- changed what. Authors used to be free text, those columns are kept under
+-- a new name, as the names don't map to user ids.
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS updated_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE datasets ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE datasets ADD COLUMN IF NOT EXISTS updated_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE dashboards ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE dashboards ADD COLUMN IF NOT EXISTS updated_by INT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE charts ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users (id) ON DELETE SET NULL;
+
+DO
+$$
+    BEGIN
+        IF EXISTS (SELECT 1
+                   FROM information_schema.columns
+                   WHERE table_schema = 'public'
+                     AND table_name = 'charts'
+                     AND column_name = 'updated_by'
+                     AND data_type = 'text') THEN
+            ALTER TABLE charts RENAME COLUMN updated_by TO updated_by_name;
+            ALTER TABLE charts ADD COLUMN updated_by INT REFERENCES users (id) ON DELETE SET NULL;
+        END IF;
+
+        IF EXISTS (SELECT 1
+                   FROM information_schema.columns
+                   WHERE table_schema = 'public'
+                     AND table_name = 'chart_revisions'
+                     AND column_name = 'author') THEN
+            ALTER TABLE chart_revisions RENAME COLUMN author TO author_name;
+        END IF;
+    END
+$$;
+
+ALTER TABLE chart_revisions ADD COLUMN IF NOT EXISTS author_id INT REFERENCES users (id) ON DELETE SET NULL;
+
+-- queries are logged with their values inlined, there are no parameters
+ALTER TABLE queries DROP COLUMN IF EXISTS params;
+
 -- sample schema
 CREATE SCHEMA IF NOT EXISTS samples AUTHORIZATION admin;
 
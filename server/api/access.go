@@ -0,0 +1,231 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type GroupRsp struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Members   []int     `json:"members"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func toGroupRsp(group model.Group) GroupRsp {
+	return GroupRsp(group)
+}
+
+type GroupReq struct {
+	Name string `json:"name"`
+}
+
+type GrantRsp struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	TargetID  int       `json:"targetId"`
+	GroupID   int       `json:"groupId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func toGrantRsp(grant model.Grant) GrantRsp {
+	return GrantRsp{
+		ID:        grant.ID,
+		Kind:      string(grant.Kind),
+		TargetID:  grant.TargetID,
+		GroupID:   grant.GroupID,
+		CreatedAt: grant.CreatedAt,
+	}
+}
+
+type GrantReq struct {
+	Kind     string `json:"kind"`
+	TargetID int    `json:"targetId"`
+	GroupID  int    `json:"groupId"`
+}
+
+func (h *Handler) GroupAll(c *fiber.Ctx) error {
+	groups, err := h.Access.Groups(c.Context())
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	result := make([]GroupRsp, len(groups))
+	for idx, group := range groups {
+		result[idx] = toGroupRsp(group)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) GroupCreate(c *fiber.Ctx) error {
+	var req GroupReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	group, err := h.Access.CreateGroup(c.Context(), req.Name)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toGroupRsp(group))
+}
+
+func (h *Handler) GroupDelete(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid group id",
+		})
+	}
+
+	if err = h.Access.DeleteGroup(c.Context(), id); err != nil {
+		return accessError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) GroupMemberAdd(c *fiber.Ctx) error {
+	id, userID, ok := memberParams(c)
+	if !ok {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid group or user id",
+		})
+	}
+
+	if err := h.Access.AddMember(c.Context(), id, userID); err != nil {
+		return accessError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) GroupMemberRemove(c *fiber.Ctx) error {
+	id, userID, ok := memberParams(c)
+	if !ok {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid group or user id",
+		})
+	}
+
+	if err := h.Access.RemoveMember(c.Context(), id, userID); err != nil {
+		return accessError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func memberParams(c *fiber.Ctx) (int, int, bool) {
+	id, err := c.ParamsInt("id")
+	userID, userErr := c.ParamsInt("userId")
+
+	return id, userID, err == nil && userErr == nil && id > 0 && userID > 0
+}
+
+// GrantAll lists the groups granted access to the entity, none means the
+// entity is open to every user.
+func (h *Handler) GrantAll(c *fiber.Ctx) error {
+	kind := model.EntityKind(c.Params("kind"))
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 || !slices.Contains(model.SupportedEntityKinds, kind) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid entity kind or id",
+		})
+	}
+
+	grants, err := h.Access.Grants(c.Context(), kind, id)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	result := make([]GrantRsp, len(grants))
+	for idx, grant := range grants {
+		result[idx] = toGrantRsp(grant)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) GrantCreate(c *fiber.Ctx) error {
+	var req GrantReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	grant, err := h.Access.Grant(c.Context(), service.GrantReq{
+		Kind:     model.EntityKind(req.Kind),
+		TargetID: req.TargetID,
+		GroupID:  req.GroupID,
+	})
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toGrantRsp(grant))
+}
+
+func (h *Handler) GrantRevoke(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid grant id",
+		})
+	}
+
+	if err = h.Access.Revoke(c.Context(), id); err != nil {
+		return accessError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func accessError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrGroupNotFound) || errors.Is(err, service.ErrGrantNotFound) ||
+		errors.Is(err, service.ErrUserNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrGroupNameTaken) {
+		return c.Status(http.StatusConflict).JSON(Error{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Code:    "group_name_taken",
+		})
+	}
+
+	if errors.Is(err, service.ErrInvalidAccess) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
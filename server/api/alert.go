@@ -0,0 +1,286 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	alertHistory         = 100
+	defaultAlertInterval = 5 * time.Minute
+)
+
+type AlertCondition struct {
+	Type     string  `json:"type"`
+	Operator string  `json:"operator"`
+	Value    float64 `json:"value"`
+}
+
+type AlertRsp struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	ChartID     int            `json:"chartId"`
+	Metric      string         `json:"metric"`
+	Condition   AlertCondition `json:"condition"`
+	SkipPartial bool           `json:"skipPartial"`
+	IntervalSec int            `json:"intervalSec"`
+	Emails      []string       `json:"emails"`
+	Webhooks    []string       `json:"webhooks"`
+	Enabled     bool           `json:"enabled"`
+	State       string         `json:"state"`
+	LastValue   *float64       `json:"lastValue,omitempty"`
+	LastError   string         `json:"lastError,omitempty"`
+	EvaluatedAt *time.Time     `json:"evaluatedAt,omitempty"`
+}
+
+func toAlertRsp(alert model.Alert) AlertRsp {
+	return AlertRsp{
+		ID:      alert.ID,
+		Name:    alert.Name,
+		ChartID: alert.ChartID,
+		Metric:  alert.Metric,
+		Condition: AlertCondition{
+			Type:     alert.Condition.Type,
+			Operator: alert.Condition.Operator,
+			Value:    alert.Condition.Value,
+		},
+		SkipPartial: alert.SkipPartial,
+		IntervalSec: int(alert.Interval.Seconds()),
+		Emails:      alert.Emails,
+		Webhooks:    alert.Webhooks,
+		Enabled:     alert.Enabled,
+		State:       string(alert.State),
+		LastValue:   alert.LastValue,
+		LastError:   alert.LastError,
+		EvaluatedAt: alert.EvaluatedAt,
+	}
+}
+
+type AlertReq struct {
+	Name        string         `json:"name"`
+	ChartID     int            `json:"chartId"`
+	Metric      string         `json:"metric"`
+	Condition   AlertCondition `json:"condition"`
+	SkipPartial bool           `json:"skipPartial"`
+	IntervalSec int            `json:"intervalSec"`
+	Emails      []string       `json:"emails"`
+	Webhooks    []string       `json:"webhooks"`
+	Enabled     *bool          `json:"enabled"`
+}
+
+// toServiceReq defaults to an enabled alert evaluated every five minutes.
+func (req AlertReq) toServiceReq(id int) service.AlertReq {
+	interval := time.Duration(req.IntervalSec) * time.Second
+	if req.IntervalSec == 0 {
+		interval = defaultAlertInterval
+	}
+
+	return service.AlertReq{
+		ID:      id,
+		Name:    req.Name,
+		ChartID: req.ChartID,
+		Metric:  req.Metric,
+		Condition: model.AlertCondition{
+			Type:     req.Condition.Type,
+			Operator: req.Condition.Operator,
+			Value:    req.Condition.Value,
+		},
+		SkipPartial: req.SkipPartial,
+		Interval:    interval,
+		Emails:      req.Emails,
+		Webhooks:    req.Webhooks,
+		Enabled:     req.Enabled == nil || *req.Enabled,
+	}
+}
+
+type AlertEventRsp struct {
+	ID          int       `json:"id"`
+	State       string    `json:"state"`
+	Period      string    `json:"period,omitempty"`
+	Value       float64   `json:"value"`
+	Previous    *float64  `json:"previous,omitempty"`
+	Observed    float64   `json:"observed"`
+	Message     string    `json:"message"`
+	NotifyError string    `json:"notifyError,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (h *Handler) AlertAll(c *fiber.Ctx) error {
+	alerts, err := h.Alerts.All(c.Context())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make([]AlertRsp, len(alerts))
+	for idx, alert := range alerts {
+		result[idx] = toAlertRsp(alert)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) AlertGet(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid alert id",
+		})
+	}
+
+	alert, err := h.Alerts.Get(c.Context(), id)
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	return c.JSON(toAlertRsp(alert))
+}
+
+func (h *Handler) AlertCreate(c *fiber.Ctx) error {
+	var req AlertReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	id, err := h.Alerts.Create(c.Context(), req.toServiceReq(0))
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	alert, err := h.Alerts.Get(c.Context(), id)
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toAlertRsp(alert))
+}
+
+func (h *Handler) AlertUpdate(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid alert id",
+		})
+	}
+
+	var req AlertReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Alerts.Update(c.Context(), req.toServiceReq(id)); err != nil {
+		return alertError(c, err)
+	}
+
+	alert, err := h.Alerts.Get(c.Context(), id)
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	return c.JSON(toAlertRsp(alert))
+}
+
+func (h *Handler) AlertDelete(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid alert id",
+		})
+	}
+
+	if err = h.Alerts.Delete(c.Context(), id); err != nil {
+		return alertError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// AlertEvaluate checks the alert right away, e.g. to try out its condition.
+// Failing to run its chart is reported as the last error of the alert.
+func (h *Handler) AlertEvaluate(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid alert id",
+		})
+	}
+
+	alert, err := h.Alerts.Evaluate(c.Context(), id)
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	return c.JSON(toAlertRsp(alert))
+}
+
+func (h *Handler) AlertHistory(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid alert id",
+		})
+	}
+
+	events, err := h.Alerts.History(c.Context(), id, alertHistory)
+	if err != nil {
+		return alertError(c, err)
+	}
+
+	result := make([]AlertEventRsp, len(events))
+	for idx, e := range events {
+		result[idx] = AlertEventRsp{
+			ID:          e.ID,
+			State:       string(e.State),
+			Period:      e.Period,
+			Value:       e.Value,
+			Previous:    e.Previous,
+			Observed:    e.Observed,
+			Message:     e.Message,
+			NotifyError: e.NotifyError,
+			CreatedAt:   e.CreatedAt,
+		}
+	}
+
+	return c.JSON(result)
+}
+
+func alertError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrAlertNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrInvalidAlert) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"errors"
 	"log"
+	"net/http"
 
 	"github.com/amukoski/aaa/service"
 	"github.com/gofiber/fiber/v2"
@@ -13,18 +15,66 @@ type Handler struct {
 	Datasets  *service.DatasetService
 	Charts    *service.ChartService
 	Dashboard *service.DashboardService
+	Jobs      *service.JobService
+	Queries   *service.QueryService
+	Trash     *service.TrashService
+	Live      *service.LiveService
+	Schedules *service.ScheduleService
+	Alerts    *service.AlertService
+	Webhooks  *service.WebhookService
+	Shares    *service.ShareService
+	Users     *service.UserService
+	Access    *service.AccessService
+
+	// SecureCookies marks session cookies to be sent over HTTPS only
+	SecureCookies bool
 }
 
 func (h *Handler) RegisterRoutes(router fiber.Router) {
+	// login is the only route open to anonymous requests, every route
+	// registered after authenticate requires a signed in user
+	router.Post("/auth/login", h.Login)
+	router.Use(h.authenticate)
+	router.Post("/auth/logout", h.Logout)
+
+	router.Get("/me", h.Me)
+	router.Put("/me/password", h.MePassword)
+	router.Get("/me/api-keys", h.APIKeyAll)
+	router.Post("/me/api-keys", h.APIKeyCreate)
+	router.Delete("/me/api-keys/:id", h.APIKeyRevoke)
+
+	router.Get("/users", h.UserAll)
+	router.Get("/users/:id", h.UserGet)
+	router.Post("/users", h.UserCreate)
+	router.Put("/users/:id/role", h.UserRole)
+	router.Put("/users/:id/attributes", h.UserAttributes)
+	router.Delete("/users/:id", h.UserDelete)
+
+	router.Get("/groups", h.GroupAll)
+	router.Post("/groups", h.GroupCreate)
+	router.Delete("/groups/:id", h.GroupDelete)
+	router.Put("/groups/:id/members/:userId", h.GroupMemberAdd)
+	router.Delete("/groups/:id/members/:userId", h.GroupMemberRemove)
+
+	router.Get("/grants/:kind/:id", h.GrantAll)
+	router.Post("/grants", h.GrantCreate)
+	router.Delete("/grants/:id", h.GrantRevoke)
+
 	router.Get("/sources", h.SourceAll)
 	router.Get("/sources/:id", h.SourceGet)
 	router.Post("/sources", h.SourceCreate)
 	router.Post("/sources/discovery", h.SourceDiscovery)
+	router.Put("/sources/:id/guardrails", h.SourceGuardrails)
+	router.Get("/sources/:id/dependents", h.SourceDependents)
 	router.Delete("/sources/:id", h.SourceDelete)
 
 	router.Get("/datasets", h.DatasetAll)
 	router.Get("/datasets/:id", h.DatasetGet)
+	router.Get("/datasets/:id/preview", h.DatasetPreview)
+	router.Get("/datasets/:id/profile", h.DatasetProfile)
 	router.Post("/datasets", h.DatasetCreate)
+	router.Put("/datasets/:id", h.DatasetUpdate)
+	router.Get("/datasets/:id/dependents", h.DatasetDependents)
 	router.Delete("/datasets/:id", h.DatasetDelete)
 
 	router.Get("/chart-types", h.ChartTypesAll)
@@ -35,15 +85,130 @@ func (h *Handler) RegisterRoutes(router fiber.Router) {
 	router.Post("/charts", h.ChartCreate)
 	router.Post("/charts/validate", h.ChartValidate)
 	router.Post("/charts/:id/data", h.ChartRun)
+	router.Put("/charts/:id", h.ChartUpdate)
+	router.Get("/charts/:id/dependents", h.ChartDependents)
 	router.Delete("/charts/:id", h.ChartDelete)
+	router.Get("/charts/:id/revisions", h.ChartRevisions)
+	router.Get("/charts/:id/revisions/diff", h.ChartDiff)
+	router.Post("/charts/:id/revisions/:version/revert", h.ChartRevert)
+	router.Post("/charts/:id/jobs", h.ChartJobCreate)
+
+	router.Get("/jobs/:id", h.JobGet)
+	router.Get("/jobs/:id/result", h.JobResult)
+	router.Delete("/jobs/:id", h.JobCancel)
+
+	router.Get("/queries", h.QueryAll)
+	router.Get("/queries/insights", h.QueryInsights)
 
 	router.Get("/dashboards", h.DashboardAll)
 	router.Get("/dashboards/:id", h.DashboardGet)
 	router.Post("/dashboards", h.DashboardCreate)
+	router.Put("/dashboards/:id", h.DashboardUpdate)
+	router.Post("/dashboards/:id/data", h.DashboardData)
+	router.Post("/dashboards/:id/select", h.DashboardSelect)
+	router.Post("/dashboards/:id/run", h.DashboardRun)
+	router.Get("/dashboards/:id/live", h.DashboardLive)
 	router.Delete("/dashboards/:id", h.DashboardDelete)
+
+	router.Get("/schedules", h.ScheduleAll)
+	router.Get("/schedules/:id", h.ScheduleGet)
+	router.Post("/schedules", h.ScheduleCreate)
+	router.Put("/schedules/:id", h.ScheduleUpdate)
+	router.Delete("/schedules/:id", h.ScheduleDelete)
+	router.Post("/schedules/:id/run", h.ScheduleRun)
+	router.Get("/schedules/:id/deliveries", h.ScheduleDeliveries)
+
+	router.Get("/alerts", h.AlertAll)
+	router.Get("/alerts/:id", h.AlertGet)
+	router.Post("/alerts", h.AlertCreate)
+	router.Put("/alerts/:id", h.AlertUpdate)
+	router.Delete("/alerts/:id", h.AlertDelete)
+	router.Post("/alerts/:id/evaluate", h.AlertEvaluate)
+	router.Get("/alerts/:id/history", h.AlertHistory)
+
+	router.Get("/webhooks", h.WebhookAll)
+	router.Get("/webhooks/events", h.WebhookEvents)
+	router.Get("/webhooks/dead-letters", h.WebhookDeadLetters)
+	router.Post("/webhooks/deliveries/:id/retry", h.WebhookRedeliver)
+	router.Get("/webhooks/:id", h.WebhookGet)
+	router.Post("/webhooks", h.WebhookCreate)
+	router.Put("/webhooks/:id", h.WebhookUpdate)
+	router.Delete("/webhooks/:id", h.WebhookDelete)
+	router.Get("/webhooks/:id/deliveries", h.WebhookDeliveries)
+
+	router.Get("/shares", h.ShareAll)
+	router.Get("/shares/:id", h.ShareGet)
+	router.Post("/shares", h.ShareCreate)
+	router.Delete("/shares/:id", h.ShareRevoke)
+
+	router.Get("/trash", h.TrashAll)
+	router.Post("/trash/:kind/:id/restore", h.TrashRestore)
+	router.Delete("/trash/:kind/:id", h.TrashPurge)
 }
 
 type Error struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// ConflictError carries the current state of an entity that was modified
+// since the client read it, so the client can merge and retry.
+type ConflictError struct {
+	Error
+	Current any `json:"current,omitempty"`
+}
+
+func versionConflict(c *fiber.Ctx, err error, current any) error {
+	return c.Status(http.StatusConflict).JSON(ConflictError{
+		Error: Error{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Code:    "version_conflict",
+		},
+		Current: current,
+	})
+}
+
+// forbidden responds to a user whose role or grants don't allow the request.
+func forbidden(c *fiber.Ctx, err error) error {
+	return c.Status(http.StatusForbidden).JSON(Error{
+		Status:  http.StatusForbidden,
+		Message: err.Error(),
+		Code:    "forbidden",
+	})
+}
+
+// queryError responds with the error class of a query against source data,
+// so clients can tell aborted queries apart from other failures.
+func queryError(c *fiber.Ctx, err error) error {
+	status, code := queryStatus(err)
+
+	return c.Status(status).JSON(Error{
+		Status:  status,
+		Message: err.Error(),
+		Code:    code,
+	})
+}
+
+// queryStatus maps a query error to its HTTP status and error code.
+func queryStatus(err error) (int, string) {
+	status, code := http.StatusInternalServerError, ""
+
+	switch {
+	case errors.Is(err, service.ErrGuardrail):
+		status, code = http.StatusUnprocessableEntity, "guardrail"
+	case errors.Is(err, service.ErrQueryTimeout):
+		status, code = http.StatusGatewayTimeout, "statement_timeout"
+	case errors.Is(err, service.ErrLockTimeout):
+		status, code = http.StatusGatewayTimeout, "lock_timeout"
+	case errors.Is(err, service.ErrQueryCanceled):
+		status, code = http.StatusRequestTimeout, "query_canceled"
+	case errors.Is(err, service.ErrReadOnly):
+		status, code = http.StatusForbidden, "read_only"
+	case errors.Is(err, service.ErrForbidden):
+		status, code = http.StatusForbidden, "forbidden"
+	}
+
+	return status, code
 }
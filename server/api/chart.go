@@ -1,20 +1,127 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/amukoski/aaa/model"
 	"github.com/amukoski/aaa/service"
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4"
 )
 
 type ChartRsp struct {
-	ID         int      `json:"id,omitempty"`
-	DatasetID  int      `json:"datasetId,omitempty"`
-	Name       string   `json:"name,omitempty"`
-	Type       string   `json:"type,omitempty"`
-	Dimensions []string `json:"dimensions,omitempty"`
-	Metrics    []string `json:"metrics,omitempty"`
-	Filters    []string `json:"filters,omitempty"`
+	ID         int            `json:"id,omitempty"`
+	DatasetID  int            `json:"datasetId,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Type       string         `json:"type,omitempty"`
+	Dimensions []string       `json:"dimensions,omitempty"`
+	Metrics    []string       `json:"metrics,omitempty"`
+	Filters    []string       `json:"filters,omitempty"`
+	Sort       *ChartSort     `json:"sort,omitempty"`
+	Limit      int            `json:"limit,omitempty"`
+	TopN       int            `json:"topN,omitempty"`
+	Having     []Having       `json:"having,omitempty"`
+	GapFill    string         `json:"gapFill,omitempty"`
+	Calendar   *ChartCalendar `json:"calendar,omitempty"`
+	Transforms []Transform    `json:"transforms,omitempty"`
+	DrillPath  []string       `json:"drillPath,omitempty"`
+	CreatedBy  *int           `json:"createdBy,omitempty"`
+	UpdatedBy  *int           `json:"updatedBy,omitempty"`
+}
+
+type Transform struct {
+	Metric  string `json:"metric"`
+	Type    string `json:"type"`
+	Window  int    `json:"window,omitempty"`
+	Compare string `json:"compare,omitempty"`
+}
+
+func toTransforms(list []model.Transform) []Transform {
+	result := make([]Transform, len(list))
+	for idx, t := range list {
+		result[idx] = Transform(t)
+	}
+
+	return result
+}
+
+func fromTransforms(list []Transform) []model.Transform {
+	result := make([]model.Transform, len(list))
+	for idx, t := range list {
+		result[idx] = model.Transform(t)
+	}
+
+	return result
+}
+
+type ChartCalendar struct {
+	WeekStart       string `json:"weekStart,omitempty"`
+	FiscalYearStart int    `json:"fiscalYearStart,omitempty"`
+	TimeZone        string `json:"timeZone,omitempty"`
+}
+
+func toChartCalendar(cal *model.ChartCalendar) *ChartCalendar {
+	if cal == nil {
+		return nil
+	}
+
+	result := ChartCalendar(*cal)
+	return &result
+}
+
+func fromChartCalendar(cal *ChartCalendar) *model.ChartCalendar {
+	if cal == nil {
+		return nil
+	}
+
+	result := model.ChartCalendar(*cal)
+	return &result
+}
+
+type Having struct {
+	Metric   string  `json:"metric"`
+	Operator string  `json:"operator"`
+	Value    float64 `json:"value"`
+}
+
+func toHaving(having []model.Having) []Having {
+	result := make([]Having, len(having))
+	for idx, cond := range having {
+		result[idx] = Having(cond)
+	}
+
+	return result
+}
+
+func fromHaving(having []Having) []model.Having {
+	result := make([]model.Having, len(having))
+	for idx, cond := range having {
+		result[idx] = model.Having(cond)
+	}
+
+	return result
+}
+
+type ChartSort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+func toChartSort(sort *model.ChartSort) *ChartSort {
+	if sort == nil {
+		return nil
+	}
+
+	return &ChartSort{Field: sort.Field, Direction: sort.Direction}
+}
+
+func fromChartSort(sort *ChartSort) *model.ChartSort {
+	if sort == nil {
+		return nil
+	}
+
+	return &model.ChartSort{Field: sort.Field, Direction: sort.Direction}
 }
 
 type ChartAllRsp []ChartRsp
@@ -54,6 +161,10 @@ func (h *Handler) ChartGet(c *fiber.Ctx) error {
 	}
 
 	chart, err := h.Charts.Get(c.Context(), id)
+	if errors.Is(err, service.ErrChartNotFound) || errors.Is(err, pgx.ErrNoRows) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
 	if err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
@@ -61,7 +172,11 @@ func (h *Handler) ChartGet(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(ChartRsp{
+	return c.JSON(toChartRsp(chart))
+}
+
+func toChartRsp(chart model.Chart) ChartRsp {
+	return ChartRsp{
 		ID:         chart.ID,
 		DatasetID:  chart.DatasetID,
 		Name:       chart.Name,
@@ -69,16 +184,34 @@ func (h *Handler) ChartGet(c *fiber.Ctx) error {
 		Dimensions: chart.Config.Dimensions,
 		Metrics:    chart.Config.Metrics,
 		Filters:    chart.Config.Filters,
-	})
+		Sort:       toChartSort(chart.Config.Sort),
+		Limit:      chart.Config.Limit,
+		TopN:       chart.Config.TopN,
+		Having:     toHaving(chart.Config.Having),
+		GapFill:    chart.Config.GapFill,
+		Calendar:   toChartCalendar(chart.Config.Calendar),
+		Transforms: toTransforms(chart.Config.Transforms),
+		DrillPath:  chart.Config.DrillPath,
+		CreatedBy:  chart.CreatedBy,
+		UpdatedBy:  chart.UpdatedBy,
+	}
 }
 
 type CreateChartReq struct {
-	DatasetID  int      `json:"datasetId"`
-	Name       string   `json:"name"`
-	Type       string   `json:"type"`
-	Dimensions []string `json:"dimensions"`
-	Metrics    []string `json:"metrics"`
-	Filters    []string `json:"filters"`
+	DatasetID  int            `json:"datasetId"`
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Dimensions []string       `json:"dimensions"`
+	Metrics    []string       `json:"metrics"`
+	Filters    []string       `json:"filters"`
+	Sort       *ChartSort     `json:"sort"`
+	Limit      int            `json:"limit"`
+	TopN       int            `json:"topN"`
+	Having     []Having       `json:"having"`
+	GapFill    string         `json:"gapFill"`
+	Calendar   *ChartCalendar `json:"calendar"`
+	Transforms []Transform    `json:"transforms"`
+	DrillPath  []string       `json:"drillPath"`
 }
 
 func (h *Handler) ChartCreate(c *fiber.Ctx) error {
@@ -97,8 +230,20 @@ func (h *Handler) ChartCreate(c *fiber.Ctx) error {
 		Dimensions: req.Dimensions,
 		Metrics:    req.Metrics,
 		Filters:    req.Filters,
+		Sort:       fromChartSort(req.Sort),
+		Limit:      req.Limit,
+		TopN:       req.TopN,
+		Having:     fromHaving(req.Having),
+		GapFill:    req.GapFill,
+		Calendar:   fromChartCalendar(req.Calendar),
+		Transforms: fromTransforms(req.Transforms),
+		DrillPath:  req.DrillPath,
 	})
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
@@ -108,17 +253,52 @@ func (h *Handler) ChartCreate(c *fiber.Ctx) error {
 	return c.JSON(ChartRsp{ID: id})
 }
 
-func (h *Handler) ChartDelete(c *fiber.Ctx) error {
+func (h *Handler) ChartUpdate(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid chart id",
+		})
+	}
+
+	var req CreateChartReq
+	if err := c.BodyParser(&req); err != nil {
 		return c.Status(http.StatusBadRequest).JSON(Error{
 			Status:  http.StatusBadRequest,
 			Message: "invalid request",
 		})
 	}
 
-	err = h.Charts.Delete(c.Context(), id)
+	err = h.Charts.Update(c.Context(), service.UpdateChartReq{
+		ID:         id,
+		DatasetID:  req.DatasetID,
+		Name:       req.Name,
+		Type:       req.Type,
+		Dimensions: req.Dimensions,
+		Metrics:    req.Metrics,
+		Filters:    req.Filters,
+		Sort:       fromChartSort(req.Sort),
+		Limit:      req.Limit,
+		TopN:       req.TopN,
+		Having:     fromHaving(req.Having),
+		GapFill:    req.GapFill,
+		Calendar:   fromChartCalendar(req.Calendar),
+		Transforms: fromTransforms(req.Transforms),
+		DrillPath:  req.DrillPath,
+	})
+	if errors.Is(err, service.ErrChartNotFound) {
+		return c.Status(http.StatusNotFound).JSON(Error{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+		})
+	}
+
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
@@ -128,18 +308,31 @@ func (h *Handler) ChartDelete(c *fiber.Ctx) error {
 	return c.SendStatus(http.StatusNoContent)
 }
 
+func (h *Handler) ChartDelete(c *fiber.Ctx) error {
+	return remove(c, h.Charts.Delete, h.Charts.Dependents)
+}
+
 type ValidateChartReq struct {
-	DatasetID  int      `json:"datasetId"`
-	Name       string   `json:"name"`
-	Type       string   `json:"type"`
-	Dimensions []string `json:"dimensions"`
-	Metrics    []string `json:"metrics"`
-	Filters    []string `json:"filters"`
+	DatasetID  int            `json:"datasetId"`
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Dimensions []string       `json:"dimensions"`
+	Metrics    []string       `json:"metrics"`
+	Filters    []string       `json:"filters"`
+	Sort       *ChartSort     `json:"sort"`
+	Limit      int            `json:"limit"`
+	TopN       int            `json:"topN"`
+	Having     []Having       `json:"having"`
+	GapFill    string         `json:"gapFill"`
+	Calendar   *ChartCalendar `json:"calendar"`
+	Transforms []Transform    `json:"transforms"`
+	DrillPath  []string       `json:"drillPath"`
 }
 
 type ValidateChartRsp struct {
-	Valid   bool `json:"valid,omitempty"`
-	Options any  `json:"options,omitempty"`
+	Valid     bool `json:"valid,omitempty"`
+	Options   any  `json:"options,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 func (h *Handler) ChartValidate(c *fiber.Ctx) error {
@@ -151,22 +344,70 @@ func (h *Handler) ChartValidate(c *fiber.Ctx) error {
 		})
 	}
 
-	result, err := h.Charts.Validate(c.Context(), service.ValidateChartReq{
+	chartReq := service.ValidateChartReq{
 		DatasetID:  req.DatasetID,
 		Name:       req.Name,
 		Type:       req.Type,
 		Dimensions: req.Dimensions,
 		Metrics:    req.Metrics,
 		Filters:    req.Filters,
+		Sort:       fromChartSort(req.Sort),
+		Limit:      req.Limit,
+		TopN:       req.TopN,
+		Having:     fromHaving(req.Having),
+		GapFill:    req.GapFill,
+		Calendar:   fromChartCalendar(req.Calendar),
+		Transforms: fromTransforms(req.Transforms),
+		DrillPath:  req.DrillPath,
+	}
+
+	if c.QueryBool("explain") {
+		return h.chartExplain(c, chartReq)
+	}
+
+	result, err := h.Charts.Validate(c.Context(), chartReq)
+	if err != nil {
+		return queryError(c, err)
+	}
+
+	return c.JSON(ValidateChartRsp{
+		Valid:     true,
+		Options:   result.Options,
+		Truncated: result.Truncated,
 	})
+}
+
+type ExplainChartRsp struct {
+	Plan          any       `json:"plan"`
+	EstimatedRows float64   `json:"estimatedRows"`
+	EstimatedCost float64   `json:"estimatedCost"`
+	SeqScans      []SeqScan `json:"seqScans,omitempty"`
+	Violations    []string  `json:"violations,omitempty"`
+}
+
+type SeqScan struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+func (h *Handler) chartExplain(c *fiber.Ctx, req service.ValidateChartReq) error {
+	plan, err := h.Charts.Explain(c.Context(), req)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(Error{
-			Status:  http.StatusInternalServerError,
-			Message: err.Error(),
-		})
+		return queryError(c, err)
+	}
+
+	result := ExplainChartRsp{
+		Plan:          plan.Plan,
+		EstimatedRows: plan.EstimatedRows,
+		EstimatedCost: plan.EstimatedCost,
+		Violations:    plan.Violations,
+	}
+
+	for _, scan := range plan.SeqScans {
+		result.SeqScans = append(result.SeqScans, SeqScan(scan))
 	}
 
-	return c.JSON(ValidateChartRsp{Valid: true, Options: result})
+	return c.JSON(result)
 }
 
 func (h *Handler) ChartRun(c *fiber.Ctx) error {
@@ -180,13 +421,14 @@ func (h *Handler) ChartRun(c *fiber.Ctx) error {
 
 	result, err := h.Charts.Run(c.Context(), id)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(Error{
-			Status:  http.StatusInternalServerError,
-			Message: err.Error(),
-		})
+		return queryError(c, err)
 	}
 
-	return c.JSON(ValidateChartRsp{Valid: true, Options: result})
+	return c.JSON(ValidateChartRsp{
+		Valid:     true,
+		Options:   result.Options,
+		Truncated: result.Truncated,
+	})
 }
 
 type ChartTypesAll []string
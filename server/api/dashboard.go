@@ -1,16 +1,56 @@
 package api
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/amukoski/aaa/model"
 	"github.com/amukoski/aaa/service"
 	"github.com/gofiber/fiber/v2"
 )
 
+const liveHeartbeat = 15 * time.Second
+
 type DashboardRsp struct {
-	ID   int              `json:"id,omitempty"`
-	Name string           `json:"name,omitempty"`
-	Grid []map[string]any `json:"grid,omitempty"`
+	ID                 int               `json:"id,omitempty"`
+	Name               string            `json:"name,omitempty"`
+	Grid               []map[string]any  `json:"grid,omitempty"`
+	Filters            []DashboardFilter `json:"filters,omitempty"`
+	Version            int               `json:"version,omitempty"`
+	RefreshIntervalSec int               `json:"refreshIntervalSec,omitempty"`
+	CreatedBy          *int              `json:"createdBy,omitempty"`
+	UpdatedBy          *int              `json:"updatedBy,omitempty"`
+}
+
+type DashboardFilter struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Column  string         `json:"column"`
+	Mapping map[int]string `json:"mapping,omitempty"`
+}
+
+func toDashboardFilters(filters []model.DashboardFilter) []DashboardFilter {
+	result := make([]DashboardFilter, len(filters))
+	for idx, filter := range filters {
+		result[idx] = DashboardFilter(filter)
+	}
+
+	return result
+}
+
+func fromDashboardFilters(filters []DashboardFilter) []model.DashboardFilter {
+	result := make([]model.DashboardFilter, len(filters))
+	for idx, filter := range filters {
+		result[idx] = model.DashboardFilter(filter)
+	}
+
+	return result
 }
 
 type DashboardAllRsp []DashboardRsp
@@ -26,11 +66,7 @@ func (h *Handler) DashboardAll(c *fiber.Ctx) error {
 
 	result := make([]DashboardRsp, len(dashboards))
 	for idx, dashboard := range dashboards {
-		result[idx] = DashboardRsp{
-			ID:   dashboard.ID,
-			Name: dashboard.Name,
-			Grid: dashboard.Grid,
-		}
+		result[idx] = toDashboardRsp(dashboard)
 	}
 
 	return c.JSON(result)
@@ -50,16 +86,27 @@ func (h *Handler) DashboardGet(c *fiber.Ctx) error {
 		return c.SendStatus(http.StatusNotFound)
 	}
 
-	return c.JSON(DashboardRsp{
-		ID:   dashboard.ID,
-		Name: dashboard.Name,
-		Grid: dashboard.Grid,
-	})
+	return c.JSON(toDashboardRsp(dashboard))
+}
+
+func toDashboardRsp(dashboard model.Dashboard) DashboardRsp {
+	return DashboardRsp{
+		ID:                 dashboard.ID,
+		Name:               dashboard.Name,
+		Grid:               dashboard.Grid,
+		Filters:            toDashboardFilters(dashboard.Filters),
+		Version:            dashboard.Version,
+		RefreshIntervalSec: int(dashboard.RefreshInterval / time.Second),
+		CreatedBy:          dashboard.CreatedBy,
+		UpdatedBy:          dashboard.UpdatedBy,
+	}
 }
 
 type DashboardCreateReq struct {
-	Name string           `json:"name"`
-	Grid []map[string]any `json:"grid"`
+	Name               string            `json:"name"`
+	Grid               []map[string]any  `json:"grid"`
+	Filters            []DashboardFilter `json:"filters"`
+	RefreshIntervalSec int               `json:"refreshIntervalSec"`
 }
 
 func (h *Handler) DashboardCreate(c *fiber.Ctx) error {
@@ -72,35 +119,346 @@ func (h *Handler) DashboardCreate(c *fiber.Ctx) error {
 	}
 
 	id, err := h.Dashboard.Create(c.Context(), service.CreateDashboardReq{
-		Name: req.Name,
-		Grid: req.Grid,
+		Name:            req.Name,
+		Grid:            req.Grid,
+		Filters:         fromDashboardFilters(req.Filters),
+		RefreshInterval: time.Duration(req.RefreshIntervalSec) * time.Second,
 	})
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
 		})
 	}
 
-	return c.JSON(DashboardRsp{ID: id})
+	return c.JSON(DashboardRsp{ID: id, Version: 1})
 }
 
-func (h *Handler) DashboardDelete(c *fiber.Ctx) error {
+type DashboardUpdateReq struct {
+	Version            int               `json:"version"`
+	Name               string            `json:"name"`
+	Grid               []map[string]any  `json:"grid"`
+	Filters            []DashboardFilter `json:"filters"`
+	RefreshIntervalSec int               `json:"refreshIntervalSec"`
+}
+
+func (h *Handler) DashboardUpdate(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil || id <= 0 {
 		return c.Status(http.StatusBadRequest).JSON(Error{
 			Status:  http.StatusBadRequest,
-			Message: "invalid id param",
+			Message: "invalid dashboard id",
 		})
 	}
 
-	err = h.Dashboard.Delete(c.Context(), id)
+	var req DashboardUpdateReq
+	if err := c.BodyParser(&req); err != nil || req.Version <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	version, err := h.Dashboard.Update(c.Context(), service.UpdateDashboardReq{
+		ID:              id,
+		Version:         req.Version,
+		Name:            req.Name,
+		Grid:            req.Grid,
+		Filters:         fromDashboardFilters(req.Filters),
+		RefreshInterval: time.Duration(req.RefreshIntervalSec) * time.Second,
+	})
+	if errors.Is(err, service.ErrDashboardNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrVersionConflict) {
+		current, err := h.Dashboard.Get(c.Context(), id)
+		if err != nil {
+			return c.SendStatus(http.StatusNotFound)
+		}
+
+		return versionConflict(c, service.ErrVersionConflict, toDashboardRsp(current))
+	}
+
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
 		})
 	}
 
-	return c.SendStatus(http.StatusNoContent)
+	return c.JSON(DashboardRsp{ID: id, Version: version})
+}
+
+func (h *Handler) DashboardDelete(c *fiber.Ctx) error {
+	return remove(c, h.Dashboard.Delete, nil)
+}
+
+type FilterValue struct {
+	From   string   `json:"from,omitempty"`
+	To     string   `json:"to,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+type DashboardDataReq struct {
+	Filters map[string]FilterValue `json:"filters"`
+}
+
+type DashboardTileRsp struct {
+	ChartID    int      `json:"chartId"`
+	Dimensions []string `json:"dimensions,omitempty"`
+	Options    any      `json:"options,omitempty"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	Applied    []string `json:"applied,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type DashboardDataRsp struct {
+	Tiles []DashboardTileRsp `json:"tiles"`
+}
+
+func (h *Handler) DashboardData(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dashboard id",
+		})
+	}
+
+	var req DashboardDataReq
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(Error{
+				Status:  http.StatusBadRequest,
+				Message: "invalid request body",
+			})
+		}
+	}
+
+	tiles, err := h.Dashboard.Data(c.Context(), id, toFilterValues(req.Filters))
+	return dashboardTiles(c, tiles, err)
+}
+
+// DashboardRun runs all tiles of the dashboard and streams each one back as
+// soon as it finishes: as server-sent events when the client accepts them,
+// otherwise as newline-delimited JSON.
+func (h *Handler) DashboardRun(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dashboard id",
+		})
+	}
+
+	var req DashboardDataReq
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(Error{
+				Status:  http.StatusBadRequest,
+				Message: "invalid request body",
+			})
+		}
+	}
+
+	run, err := h.Dashboard.Prepare(c.Context(), id, toFilterValues(req.Filters))
+	if errors.Is(err, service.ErrDashboardNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	sse := strings.Contains(c.Get(fiber.HeaderAccept), "text/event-stream")
+	if sse {
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+
+	// the stream is written after the handler returns, when c is no longer valid
+	reqCtx := c.Context()
+	reqCtx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(reqCtx)
+		defer cancel()
+
+		run.Stream(ctx, func(tile model.DashboardTile) {
+			if sse {
+				_, _ = fmt.Fprintf(w, "event: tile\ndata: %s\n\n", tileJSON(tile))
+			} else {
+				_, _ = w.Write(append(tileJSON(tile), '\n'))
+			}
+
+			// the client went away, stop the queries still running
+			if err := w.Flush(); err != nil {
+				cancel()
+			}
+		})
+
+		if sse {
+			_, _ = fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			_ = w.Flush()
+		}
+	})
+
+	return nil
+}
+
+// DashboardLive streams the tiles of a self-refreshing dashboard as
+// server-sent events: first all of them, then each tile whose data changed
+// on a refresh. Active filters are passed as JSON in the filters query param.
+func (h *Handler) DashboardLive(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dashboard id",
+		})
+	}
+
+	var filters map[string]FilterValue
+	if raw := c.Query("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(Error{
+				Status:  http.StatusBadRequest,
+				Message: "invalid filters param",
+			})
+		}
+	}
+
+	tiles, unsubscribe, err := h.Live.Subscribe(c.Context(), id, toFilterValues(filters))
+	if errors.Is(err, service.ErrDashboardNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// a failing write is the only sign that the viewer left
+		heartbeat := time.NewTicker(liveHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case tile, ok := <-tiles:
+				if !ok {
+					_, _ = fmt.Fprint(w, "event: close\ndata: {}\n\n")
+					_ = w.Flush()
+					return
+				}
+
+				_, _ = fmt.Fprintf(w, "event: tile\ndata: %s\n\n", tileJSON(tile))
+			case <-heartbeat.C:
+				_, _ = fmt.Fprint(w, ": ping\n\n")
+			}
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func tileJSON(tile model.DashboardTile) []byte {
+	line, err := json.Marshal(DashboardTileRsp(tile))
+	if err != nil {
+		line, _ = json.Marshal(DashboardTileRsp{ChartID: tile.ChartID, Error: err.Error()})
+	}
+
+	return line
+}
+
+type SelectionReq struct {
+	ChartID   int    `json:"chartId"`
+	Dimension string `json:"dimension"`
+	Value     string `json:"value"`
+}
+
+type DashboardSelectReq struct {
+	Filters    map[string]FilterValue `json:"filters"`
+	Selections []SelectionReq         `json:"selections"`
+	Drill      bool                   `json:"drill"`
+}
+
+// DashboardSelect cross-filters the dashboard by the clicked tile elements and
+// returns the tiles that were re-queried.
+func (h *Handler) DashboardSelect(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dashboard id",
+		})
+	}
+
+	var req DashboardSelectReq
+	if err := c.BodyParser(&req); err != nil || len(req.Selections) == 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	selections := make([]model.Selection, len(req.Selections))
+	for idx, selection := range req.Selections {
+		selections[idx] = model.Selection(selection)
+	}
+
+	tiles, err := h.Dashboard.Select(c.Context(), id, toFilterValues(req.Filters), selections, req.Drill)
+	return dashboardTiles(c, tiles, err)
+}
+
+func toFilterValues(filters map[string]FilterValue) map[string]model.FilterValue {
+	active := make(map[string]model.FilterValue, len(filters))
+	for name, value := range filters {
+		active[name] = model.FilterValue(value)
+	}
+
+	return active
+}
+
+func dashboardTiles(c *fiber.Ctx, tiles []model.DashboardTile, err error) error {
+	if errors.Is(err, service.ErrDashboardNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	result := DashboardDataRsp{Tiles: make([]DashboardTileRsp, len(tiles))}
+	for idx, tile := range tiles {
+		result.Tiles[idx] = DashboardTileRsp(tile)
+	}
+
+	return c.JSON(result)
 }
@@ -1,21 +1,120 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/amukoski/aaa/model"
 	"github.com/amukoski/aaa/service"
 	"github.com/gofiber/fiber/v2"
 )
 
 type DatasetRsp struct {
-	ID         int      `json:"id,omitempty"`
-	SourceID   int      `json:"sourceId,omitempty"`
-	Name       string   `json:"name,omitempty"`
-	Schema     string   `json:"schema,omitempty"`
-	Table      string   `json:"table,omitempty"`
-	Columns    []string `json:"columns,omitempty"`
-	Dimensions []string `json:"dimensions,omitempty"`
-	Metrics    []string `json:"metrics,omitempty"`
+	ID           int                       `json:"id,omitempty"`
+	SourceID     int                       `json:"sourceId,omitempty"`
+	Name         string                    `json:"name,omitempty"`
+	Schema       string                    `json:"schema,omitempty"`
+	Table        string                    `json:"table,omitempty"`
+	Columns      []string                  `json:"columns,omitempty"`
+	Dimensions   []string                  `json:"dimensions,omitempty"`
+	Metrics      []string                  `json:"metrics,omitempty"`
+	Metadata     map[string]ColumnMetadata `json:"metadata,omitempty"`
+	SavedMetrics []SavedMetric             `json:"savedMetrics,omitempty"`
+	Rules        []RowRule                 `json:"rules,omitempty"`
+	Version      int                       `json:"version,omitempty"`
+	CreatedBy    *int                      `json:"createdBy,omitempty"`
+	UpdatedBy    *int                      `json:"updatedBy,omitempty"`
+}
+
+type SavedMetric struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	Format     string `json:"format,omitempty"`
+	Unit       string `json:"unit,omitempty"`
+}
+
+// RowRule limits the rows users see, e.g. Region IN {{user.regions}}.
+type RowRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+type ColumnMetadata struct {
+	Label              string `json:"label,omitempty"`
+	Description        string `json:"description,omitempty"`
+	Hidden             bool   `json:"hidden,omitempty"`
+	Format             string `json:"format,omitempty"`
+	Unit               string `json:"unit,omitempty"`
+	DefaultAggregation string `json:"defaultAggregation,omitempty"`
+}
+
+func toColumnMetadata(metadata map[string]model.ColumnMetadata) map[string]ColumnMetadata {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	result := make(map[string]ColumnMetadata, len(metadata))
+	for column, meta := range metadata {
+		result[column] = ColumnMetadata(meta)
+	}
+
+	return result
+}
+
+func toSavedMetrics(metrics []model.SavedMetric) []SavedMetric {
+	result := make([]SavedMetric, len(metrics))
+	for idx, metric := range metrics {
+		result[idx] = SavedMetric(metric)
+	}
+
+	return result
+}
+
+func fromSavedMetrics(metrics []SavedMetric) []model.SavedMetric {
+	result := make([]model.SavedMetric, len(metrics))
+	for idx, metric := range metrics {
+		result[idx] = model.SavedMetric(metric)
+	}
+
+	return result
+}
+
+func toRowRules(rules []model.RowRule) []RowRule {
+	result := make([]RowRule, len(rules))
+	for idx, rule := range rules {
+		result[idx] = RowRule(rule)
+	}
+
+	return result
+}
+
+// fromRowRules keeps a missing list nil, which leaves the rules of the
+// dataset unchanged on update.
+func fromRowRules(rules []RowRule) []model.RowRule {
+	if rules == nil {
+		return nil
+	}
+
+	result := make([]model.RowRule, len(rules))
+	for idx, rule := range rules {
+		result[idx] = model.RowRule(rule)
+	}
+
+	return result
+}
+
+func fromColumnMetadata(metadata map[string]ColumnMetadata) map[string]model.ColumnMetadata {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	result := make(map[string]model.ColumnMetadata, len(metadata))
+	for column, meta := range metadata {
+		result[column] = model.ColumnMetadata(meta)
+	}
+
+	return result
 }
 
 type DatasetAllRsp []DatasetRsp
@@ -37,6 +136,7 @@ func (h *Handler) DatasetAll(c *fiber.Ctx) error {
 			Name:     dataset.Name,
 			Schema:   dataset.Config.Schema,
 			Table:    dataset.Config.Table,
+			Version:  dataset.Version,
 		}
 	}
 
@@ -57,23 +157,36 @@ func (h *Handler) DatasetGet(c *fiber.Ctx) error {
 		return c.SendStatus(http.StatusNotFound)
 	}
 
-	return c.JSON(DatasetRsp{
-		ID:         dataset.ID,
-		SourceID:   dataset.SourceID,
-		Name:       dataset.Name,
-		Schema:     dataset.Config.Schema,
-		Table:      dataset.Config.Table,
-		Columns:    dataset.Config.Columns,
-		Dimensions: dataset.Config.Dimensions(),
-		Metrics:    dataset.Config.Metrics(),
-	})
+	return c.JSON(toDatasetRsp(dataset))
+}
+
+func toDatasetRsp(dataset model.Dataset) DatasetRsp {
+	return DatasetRsp{
+		ID:           dataset.ID,
+		SourceID:     dataset.SourceID,
+		Name:         dataset.Name,
+		Schema:       dataset.Config.Schema,
+		Table:        dataset.Config.Table,
+		Columns:      dataset.Config.Columns,
+		Dimensions:   dataset.Config.Dimensions(),
+		Metrics:      dataset.Config.Metrics(),
+		Metadata:     toColumnMetadata(dataset.Config.Metadata),
+		SavedMetrics: toSavedMetrics(dataset.Config.SavedMetrics),
+		Rules:        toRowRules(dataset.Config.Rules),
+		Version:      dataset.Version,
+		CreatedBy:    dataset.CreatedBy,
+		UpdatedBy:    dataset.UpdatedBy,
+	}
 }
 
 type DatasetCreateReq struct {
-	Name         string `json:"name"`
-	SourceID     int    `json:"sourceId"`
-	SourceTable  string `json:"sourceTable"`
-	SourceSchema string `json:"sourceSchema"`
+	Name         string                    `json:"name"`
+	SourceID     int                       `json:"sourceId"`
+	SourceTable  string                    `json:"sourceTable"`
+	SourceSchema string                    `json:"sourceSchema"`
+	Metadata     map[string]ColumnMetadata `json:"metadata"`
+	SavedMetrics []SavedMetric             `json:"savedMetrics"`
+	Rules        []RowRule                 `json:"rules"`
 }
 
 func (h *Handler) DatasetCreate(c *fiber.Ctx) error {
@@ -90,33 +203,198 @@ func (h *Handler) DatasetCreate(c *fiber.Ctx) error {
 		SourceID:       req.SourceID,
 		DatabaseSchema: req.SourceSchema,
 		DatabaseTable:  req.SourceTable,
+		Metadata:       fromColumnMetadata(req.Metadata),
+		SavedMetrics:   fromSavedMetrics(req.SavedMetrics),
+		Rules:          fromRowRules(req.Rules),
 	})
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
 		})
 	}
 
-	return c.JSON(DatasetRsp{ID: id})
+	return c.JSON(DatasetRsp{ID: id, Version: 1})
 }
 
-func (h *Handler) DatasetDelete(c *fiber.Ctx) error {
+type DatasetUpdateReq struct {
+	Version      int                       `json:"version"`
+	Name         string                    `json:"name"`
+	Columns      []string                  `json:"columns"`
+	Metadata     map[string]ColumnMetadata `json:"metadata"`
+	SavedMetrics []SavedMetric             `json:"savedMetrics"`
+	Rules        []RowRule                 `json:"rules"`
+}
+
+func (h *Handler) DatasetUpdate(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil || id <= 0 {
 		return c.Status(http.StatusBadRequest).JSON(Error{
 			Status:  http.StatusBadRequest,
-			Message: "invalid id param",
+			Message: "invalid dataset id",
+		})
+	}
+
+	var req DatasetUpdateReq
+	if err := c.BodyParser(&req); err != nil || req.Version <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
 		})
 	}
 
-	err = h.Datasets.Delete(c.Context(), id)
+	version, err := h.Datasets.Update(c.Context(), service.UpdateDatasetReq{
+		ID:           id,
+		Version:      req.Version,
+		Name:         req.Name,
+		Columns:      req.Columns,
+		Metadata:     fromColumnMetadata(req.Metadata),
+		SavedMetrics: fromSavedMetrics(req.SavedMetrics),
+		Rules:        fromRowRules(req.Rules),
+	})
+	if errors.Is(err, service.ErrDatasetNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrVersionConflict) {
+		current, err := h.Datasets.Get(c.Context(), id)
+		if err != nil {
+			return c.SendStatus(http.StatusNotFound)
+		}
+
+		return versionConflict(c, service.ErrVersionConflict, toDatasetRsp(current))
+	}
+
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
 		})
 	}
 
-	return c.SendStatus(http.StatusNoContent)
+	return c.JSON(DatasetRsp{ID: id, Version: version})
+}
+
+func (h *Handler) DatasetDelete(c *fiber.Ctx) error {
+	return remove(c, h.Datasets.Delete, h.Datasets.Dependents)
+}
+
+type DatasetPreviewRsp struct {
+	Page    int      `json:"page"`
+	Size    int      `json:"size"`
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	HasMore bool     `json:"hasMore"`
+}
+
+func (h *Handler) DatasetPreview(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dataset id",
+		})
+	}
+
+	preview, err := h.Datasets.Preview(c.Context(), id, c.QueryInt("page", 1), c.QueryInt("size"))
+	if err != nil {
+		return queryError(c, err)
+	}
+
+	return c.JSON(DatasetPreviewRsp{
+		Page:    preview.Page,
+		Size:    preview.Size,
+		Columns: preview.Columns,
+		Rows:    preview.Rows,
+		HasMore: preview.HasMore,
+	})
+}
+
+type DatasetProfileRsp struct {
+	DatasetID  int                `json:"datasetId"`
+	Rows       int64              `json:"rows"`
+	Sampled    bool               `json:"sampled"`
+	Columns    []ColumnProfileRsp `json:"columns"`
+	ComputedAt time.Time          `json:"computedAt"`
+}
+
+type ColumnProfileRsp struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	NullRatio float64           `json:"nullRatio"`
+	Distinct  int64             `json:"distinct"`
+	Min       *string           `json:"min"`
+	Max       *string           `json:"max"`
+	TopValues []ValueCountRsp   `json:"topValues"`
+	Histogram []HistogramBinRsp `json:"histogram,omitempty"`
+}
+
+type ValueCountRsp struct {
+	Value *string `json:"value"`
+	Count int64   `json:"count"`
+}
+
+type HistogramBinRsp struct {
+	Lower any   `json:"lower"`
+	Upper any   `json:"upper"`
+	Count int64 `json:"count"`
+}
+
+func (h *Handler) DatasetProfile(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid dataset id",
+		})
+	}
+
+	profile, err := h.Datasets.Profile(c.Context(), id)
+	if err != nil {
+		return queryError(c, err)
+	}
+
+	result := DatasetProfileRsp{
+		DatasetID:  profile.DatasetID,
+		Rows:       profile.Rows,
+		Sampled:    profile.Sampled,
+		Columns:    make([]ColumnProfileRsp, len(profile.Columns)),
+		ComputedAt: profile.ComputedAt,
+	}
+
+	for idx, col := range profile.Columns {
+		item := ColumnProfileRsp{
+			Name:      col.Name,
+			Type:      col.Type,
+			NullRatio: col.NullRatio,
+			Distinct:  col.Distinct,
+			Min:       col.Min,
+			Max:       col.Max,
+			TopValues: make([]ValueCountRsp, len(col.TopValues)),
+		}
+
+		for i, top := range col.TopValues {
+			item.TopValues[i] = ValueCountRsp{Value: top.Value, Count: top.Count}
+		}
+
+		for _, bin := range col.Histogram {
+			item.Histogram = append(item.Histogram, HistogramBinRsp{
+				Lower: bin.Lower,
+				Upper: bin.Upper,
+				Count: bin.Count,
+			})
+		}
+
+		result.Columns[idx] = item
+	}
+
+	return c.JSON(result)
 }
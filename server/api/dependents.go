@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+type EntityRefRsp struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type DependentsRsp struct {
+	Datasets   []EntityRefRsp `json:"datasets"`
+	Charts     []EntityRefRsp `json:"charts"`
+	Dashboards []EntityRefRsp `json:"dashboards"`
+}
+
+// DependentsError is returned when a delete is refused, listing what still
+// depends on the entity.
+type DependentsError struct {
+	Error
+	Dependents DependentsRsp `json:"dependents"`
+}
+
+func toEntityRefs(refs []model.EntityRef) []EntityRefRsp {
+	result := make([]EntityRefRsp, len(refs))
+	for idx, ref := range refs {
+		result[idx] = EntityRefRsp(ref)
+	}
+
+	return result
+}
+
+func toDependentsRsp(deps model.Dependents) DependentsRsp {
+	return DependentsRsp{
+		Datasets:   toEntityRefs(deps.Datasets),
+		Charts:     toEntityRefs(deps.Charts),
+		Dashboards: toEntityRefs(deps.Dashboards),
+	}
+}
+
+type dependentsFunc func(ctx context.Context, id int) (model.Dependents, error)
+
+type deleteFunc func(ctx context.Context, id int, mode model.DeleteMode) error
+
+func (h *Handler) SourceDependents(c *fiber.Ctx) error {
+	return dependents(c, h.Sources.Dependents)
+}
+
+func (h *Handler) DatasetDependents(c *fiber.Ctx) error {
+	return dependents(c, h.Datasets.Dependents)
+}
+
+func (h *Handler) ChartDependents(c *fiber.Ctx) error {
+	return dependents(c, h.Charts.Dependents)
+}
+
+func dependents(c *fiber.Ctx, find dependentsFunc) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid id param",
+		})
+	}
+
+	deps, err := find(c.Context(), id)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.JSON(toDependentsRsp(deps))
+}
+
+// remove deletes the entity with the mode given by the mode query parameter.
+// Without one, the entity and its dependents are moved to the trash. find may
+// be nil for entities nothing depends on.
+func remove(c *fiber.Ctx, del deleteFunc, find dependentsFunc) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid id param",
+		})
+	}
+
+	mode := model.DeleteMode(c.Query("mode", string(model.SOFT)))
+	if !slices.Contains(model.SupportedDeleteModes, mode) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid delete mode",
+		})
+	}
+
+	err = del(c.Context(), id, mode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrHasDependents) && find != nil {
+		deps, findErr := find(c.Context(), id)
+		if findErr != nil {
+			return c.Status(http.StatusInternalServerError).JSON(Error{
+				Status:  http.StatusInternalServerError,
+				Message: findErr.Error(),
+			})
+		}
+
+		return c.Status(http.StatusConflict).JSON(DependentsError{
+			Error: Error{
+				Status:  http.StatusConflict,
+				Message: err.Error(),
+				Code:    "has_dependents",
+			},
+			Dependents: toDependentsRsp(deps),
+		})
+	}
+
+	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type JobRsp struct {
+	ID         string     `json:"id,omitempty"`
+	ChartID    int        `json:"chartId,omitempty"`
+	Status     string     `json:"status,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	QueuedAt   time.Time  `json:"queuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func toJobRsp(job model.Job) JobRsp {
+	return JobRsp{
+		ID:         job.ID,
+		ChartID:    job.ChartID,
+		Status:     string(job.Status),
+		Error:      job.Error,
+		QueuedAt:   job.QueuedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+}
+
+func (h *Handler) ChartJobCreate(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid chart id",
+		})
+	}
+
+	job, err := h.Jobs.Submit(c.Context(), id)
+	if errors.Is(err, service.ErrChartNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrQueueFull) {
+		return c.Status(http.StatusServiceUnavailable).JSON(Error{
+			Status:  http.StatusServiceUnavailable,
+			Message: err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusAccepted).JSON(toJobRsp(job))
+}
+
+func (h *Handler) JobGet(c *fiber.Ctx) error {
+	job, err := h.Jobs.Get(c.Params("id"))
+	if err != nil {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	return c.JSON(toJobRsp(job))
+}
+
+func (h *Handler) JobResult(c *fiber.Ctx) error {
+	job, result, err := h.Jobs.Result(c.Params("id"))
+	if errors.Is(err, service.ErrJobNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrJobNotDone) {
+		return c.Status(http.StatusConflict).JSON(Error{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+		})
+	}
+
+	if job.Status != model.SUCCEEDED {
+		return c.Status(http.StatusConflict).JSON(Error{
+			Status:  http.StatusConflict,
+			Message: job.Error,
+		})
+	}
+
+	return c.JSON(ValidateChartRsp{
+		Valid:     true,
+		Options:   result.Options,
+		Truncated: result.Truncated,
+	})
+}
+
+func (h *Handler) JobCancel(c *fiber.Ctx) error {
+	job, err := h.Jobs.Cancel(c.Params("id"))
+	if err != nil {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	return c.JSON(toJobRsp(job))
+}
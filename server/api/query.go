@@ -0,0 +1,162 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type QueryRsp struct {
+	ID         int       `json:"id"`
+	ChartID    *int      `json:"chartId,omitempty"`
+	DatasetID  int       `json:"datasetId"`
+	SourceID   int       `json:"sourceId"`
+	SQL        string    `json:"sql"`
+	DurationMs float64   `json:"durationMs"`
+	Rows       int       `json:"rows"`
+	CacheHit   bool      `json:"cacheHit"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type QueryAllRsp []QueryRsp
+
+type QueryStatsRsp struct {
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	Queries         int     `json:"queries"`
+	Failures        int     `json:"failures"`
+	CacheHits       int     `json:"cacheHits"`
+	AvgDurationMs   float64 `json:"avgDurationMs"`
+	P95DurationMs   float64 `json:"p95DurationMs"`
+	MaxDurationMs   float64 `json:"maxDurationMs"`
+	TotalDurationMs float64 `json:"totalDurationMs"`
+	AvgRows         float64 `json:"avgRows"`
+}
+
+type QueryInsightsRsp struct {
+	SlowestCharts     []QueryStatsRsp `json:"slowestCharts"`
+	ExpensiveDatasets []QueryStatsRsp `json:"expensiveDatasets"`
+}
+
+func parseQueryFilter(c *fiber.Ctx) (model.QueryFilter, error) {
+	filter := model.QueryFilter{
+		ChartID:     c.QueryInt("chartId"),
+		DatasetID:   c.QueryInt("datasetId"),
+		SourceID:    c.QueryInt("sourceId"),
+		Failed:      c.QueryBool("failed"),
+		MinDuration: time.Duration(c.QueryFloat("minDurationMs") * float64(time.Millisecond)),
+		Limit:       c.QueryInt("limit"),
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func toMilliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (h *Handler) QueryAll(c *fiber.Ctx) error {
+	filter, err := parseQueryFilter(c)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid time range",
+		})
+	}
+
+	queries, err := h.Queries.All(c.Context(), filter)
+	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make(QueryAllRsp, len(queries))
+	for idx, query := range queries {
+		result[idx] = QueryRsp{
+			ID:         query.ID,
+			ChartID:    query.ChartID,
+			DatasetID:  query.DatasetID,
+			SourceID:   query.SourceID,
+			SQL:        query.SQL,
+			DurationMs: toMilliseconds(query.Duration),
+			Rows:       query.Rows,
+			CacheHit:   query.CacheHit,
+			Error:      query.Error,
+			CreatedAt:  query.CreatedAt,
+		}
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) QueryInsights(c *fiber.Ctx) error {
+	filter, err := parseQueryFilter(c)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid time range",
+		})
+	}
+
+	insights, err := h.Queries.Insights(c.Context(), filter)
+	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.JSON(QueryInsightsRsp{
+		SlowestCharts:     toQueryStats(insights.SlowestCharts),
+		ExpensiveDatasets: toQueryStats(insights.ExpensiveDatasets),
+	})
+}
+
+func toQueryStats(stats []model.QueryStats) []QueryStatsRsp {
+	result := make([]QueryStatsRsp, len(stats))
+	for idx, item := range stats {
+		result[idx] = QueryStatsRsp{
+			ID:              item.ID,
+			Name:            item.Name,
+			Queries:         item.Queries,
+			Failures:        item.Failures,
+			CacheHits:       item.CacheHits,
+			AvgDurationMs:   toMilliseconds(item.AvgDuration),
+			P95DurationMs:   toMilliseconds(item.P95Duration),
+			MaxDurationMs:   toMilliseconds(item.MaxDuration),
+			TotalDurationMs: toMilliseconds(item.TotalDuration),
+			AvgRows:         item.AvgRows,
+		}
+	}
+
+	return result
+}
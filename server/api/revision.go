@@ -0,0 +1,144 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ChartRevisionRsp struct {
+	ChartRsp
+	Version   int       `json:"version"`
+	AuthorID  *int      `json:"authorId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ChartChangeRsp struct {
+	Field  string `json:"field"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+type ChartDiffRsp struct {
+	From    int              `json:"from"`
+	To      int              `json:"to"`
+	Changes []ChartChangeRsp `json:"changes"`
+}
+
+func (h *Handler) ChartRevisions(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid chart id",
+		})
+	}
+
+	revisions, err := h.Charts.Revisions(c.Context(), id)
+	if errors.Is(err, service.ErrChartNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make([]ChartRevisionRsp, len(revisions))
+	for idx, revision := range revisions {
+		result[idx] = ChartRevisionRsp{
+			ChartRsp:  toChartRsp(revision.Chart),
+			Version:   revision.Version,
+			AuthorID:  revision.AuthorID,
+			CreatedAt: revision.CreatedAt,
+		}
+	}
+
+	return c.JSON(result)
+}
+
+// ChartDiff compares two revisions given by the from and to query
+// parameters. A missing or zero version stands for the current chart.
+func (h *Handler) ChartDiff(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid chart id",
+		})
+	}
+
+	from, to := c.QueryInt("from"), c.QueryInt("to")
+	if from < 0 || to < 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid revision version",
+		})
+	}
+
+	changes, err := h.Charts.Diff(c.Context(), id, from, to)
+	if errors.Is(err, service.ErrChartNotFound) || errors.Is(err, service.ErrRevisionNotFound) {
+		return c.Status(http.StatusNotFound).JSON(Error{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := ChartDiffRsp{From: from, To: to, Changes: make([]ChartChangeRsp, len(changes))}
+	for idx, change := range changes {
+		result.Changes[idx] = ChartChangeRsp(change)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) ChartRevert(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid chart id",
+		})
+	}
+
+	version, err := c.ParamsInt("version")
+	if err != nil || version <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid revision version",
+		})
+	}
+
+	err = h.Charts.Revert(c.Context(), id, version)
+	if errors.Is(err, service.ErrChartNotFound) || errors.Is(err, service.ErrRevisionNotFound) {
+		return c.Status(http.StatusNotFound).JSON(Error{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+		})
+	}
+
+	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const deliveryHistory = 100
+
+type ScheduleRsp struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"`
+	TargetID   int        `json:"targetId"`
+	Cron       string     `json:"cron"`
+	Timezone   string     `json:"timezone"`
+	Format     string     `json:"format"`
+	Recipients []string   `json:"recipients"`
+	Enabled    bool       `json:"enabled"`
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+}
+
+func toScheduleRsp(schedule model.Schedule) ScheduleRsp {
+	return ScheduleRsp{
+		ID:         schedule.ID,
+		Name:       schedule.Name,
+		Kind:       string(schedule.Kind),
+		TargetID:   schedule.TargetID,
+		Cron:       schedule.Cron,
+		Timezone:   schedule.Timezone,
+		Format:     string(schedule.Format),
+		Recipients: schedule.Recipients,
+		Enabled:    schedule.Enabled,
+		NextRunAt:  schedule.NextRunAt,
+	}
+}
+
+type ScheduleReq struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"`
+	TargetID   int      `json:"targetId"`
+	Cron       string   `json:"cron"`
+	Timezone   string   `json:"timezone"`
+	Format     string   `json:"format"`
+	Recipients []string `json:"recipients"`
+	Enabled    *bool    `json:"enabled"`
+}
+
+// toServiceReq defaults to an enabled schedule in UTC.
+func (req ScheduleReq) toServiceReq(id int) service.ScheduleReq {
+	timezone := req.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	return service.ScheduleReq{
+		ID:         id,
+		Name:       req.Name,
+		Kind:       model.EntityKind(req.Kind),
+		TargetID:   req.TargetID,
+		Cron:       req.Cron,
+		Timezone:   timezone,
+		Format:     model.ReportFormat(req.Format),
+		Recipients: req.Recipients,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+	}
+}
+
+type DeliveryRsp struct {
+	ID           int        `json:"id"`
+	ScheduledFor time.Time  `json:"scheduledFor"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	Error        string     `json:"error,omitempty"`
+	DeliveredAt  *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+func (h *Handler) ScheduleAll(c *fiber.Ctx) error {
+	schedules, err := h.Schedules.All(c.Context())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make([]ScheduleRsp, len(schedules))
+	for idx, schedule := range schedules {
+		result[idx] = toScheduleRsp(schedule)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) ScheduleGet(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid schedule id",
+		})
+	}
+
+	schedule, err := h.Schedules.Get(c.Context(), id)
+	if err != nil {
+		return scheduleError(c, err)
+	}
+
+	return c.JSON(toScheduleRsp(schedule))
+}
+
+func (h *Handler) ScheduleCreate(c *fiber.Ctx) error {
+	var req ScheduleReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	id, err := h.Schedules.Create(c.Context(), req.toServiceReq(0))
+	if err != nil {
+		return scheduleError(c, err)
+	}
+
+	schedule, err := h.Schedules.Get(c.Context(), id)
+	if err != nil {
+		return scheduleError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toScheduleRsp(schedule))
+}
+
+func (h *Handler) ScheduleUpdate(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid schedule id",
+		})
+	}
+
+	var req ScheduleReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Schedules.Update(c.Context(), req.toServiceReq(id)); err != nil {
+		return scheduleError(c, err)
+	}
+
+	schedule, err := h.Schedules.Get(c.Context(), id)
+	if err != nil {
+		return scheduleError(c, err)
+	}
+
+	return c.JSON(toScheduleRsp(schedule))
+}
+
+func (h *Handler) ScheduleDelete(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid schedule id",
+		})
+	}
+
+	if err = h.Schedules.Delete(c.Context(), id); err != nil {
+		return scheduleError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// ScheduleRun queues a delivery right away, e.g. to try out a schedule.
+func (h *Handler) ScheduleRun(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid schedule id",
+		})
+	}
+
+	if err = h.Schedules.RunNow(c.Context(), id); err != nil {
+		return scheduleError(c, err)
+	}
+
+	return c.SendStatus(http.StatusAccepted)
+}
+
+func (h *Handler) ScheduleDeliveries(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid schedule id",
+		})
+	}
+
+	deliveries, err := h.Schedules.Deliveries(c.Context(), id, deliveryHistory)
+	if err != nil {
+		return scheduleError(c, err)
+	}
+
+	result := make([]DeliveryRsp, len(deliveries))
+	for idx, d := range deliveries {
+		result[idx] = DeliveryRsp{
+			ID:           d.ID,
+			ScheduledFor: d.ScheduledFor,
+			Status:       string(d.Status),
+			Attempts:     d.Attempts,
+			Error:        d.Error,
+			DeliveredAt:  d.DeliveredAt,
+			CreatedAt:    d.CreatedAt,
+		}
+	}
+
+	return c.JSON(result)
+}
+
+func scheduleError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrScheduleNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrInvalidSchedule) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
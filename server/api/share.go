@@ -0,0 +1,325 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ShareRsp struct {
+	ID        int                    `json:"id"`
+	Name      string                 `json:"name"`
+	Kind      string                 `json:"kind"`
+	TargetID  int                    `json:"targetId"`
+	Locked    map[string]FilterValue `json:"locked,omitempty"`
+	Token     string                 `json:"token,omitempty"`
+	ExpiresAt *time.Time             `json:"expiresAt,omitempty"`
+	RevokedAt *time.Time             `json:"revokedAt,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// toShareRsp leaves out the token of revoked shares, it grants nothing anymore.
+func (h *Handler) toShareRsp(share model.Share) ShareRsp {
+	locked := make(map[string]FilterValue, len(share.Locked))
+	for name, value := range share.Locked {
+		locked[name] = FilterValue(value)
+	}
+
+	rsp := ShareRsp{
+		ID:        share.ID,
+		Name:      share.Name,
+		Kind:      string(share.Kind),
+		TargetID:  share.TargetID,
+		Locked:    locked,
+		ExpiresAt: share.ExpiresAt,
+		RevokedAt: share.RevokedAt,
+		CreatedAt: share.CreatedAt,
+	}
+
+	if share.RevokedAt == nil {
+		rsp.Token = h.Shares.Token(share)
+	}
+
+	return rsp
+}
+
+type ShareReq struct {
+	Name      string                 `json:"name"`
+	Kind      string                 `json:"kind"`
+	TargetID  int                    `json:"targetId"`
+	Locked    map[string]FilterValue `json:"locked"`
+	ExpiresAt *time.Time             `json:"expiresAt"`
+}
+
+func (h *Handler) ShareAll(c *fiber.Ctx) error {
+	shares, err := h.Shares.All(c.Context())
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	result := make([]ShareRsp, len(shares))
+	for idx, share := range shares {
+		result[idx] = h.toShareRsp(share)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) ShareGet(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid share id",
+		})
+	}
+
+	share, err := h.Shares.Get(c.Context(), id)
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	return c.JSON(h.toShareRsp(share))
+}
+
+func (h *Handler) ShareCreate(c *fiber.Ctx) error {
+	var req ShareReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	id, err := h.Shares.Create(c.Context(), service.ShareReq{
+		Name:      req.Name,
+		Kind:      model.EntityKind(req.Kind),
+		TargetID:  req.TargetID,
+		Locked:    toFilterValues(req.Locked),
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	share, err := h.Shares.Get(c.Context(), id)
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(h.toShareRsp(share))
+}
+
+// ShareRevoke invalidates the token of the share. The share itself is kept
+// so it still shows who had access.
+func (h *Handler) ShareRevoke(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid share id",
+		})
+	}
+
+	if err = h.Shares.Revoke(c.Context(), id); err != nil {
+		return shareError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func shareError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrShareNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrInvalidShare) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
+
+// RegisterPublicRoutes serves shared dashboards and charts read-only to
+// anyone holding a valid share token.
+func (h *Handler) RegisterPublicRoutes(router fiber.Router) {
+	router.Get("/:token/dashboard", h.shareToken, h.PublicDashboard)
+	router.Post("/:token/dashboard/data", h.shareToken, h.PublicDashboardData)
+	router.Get("/:token/chart", h.shareToken, h.PublicChart)
+	router.Post("/:token/chart/data", h.shareToken, h.PublicChartData)
+}
+
+const (
+	shareLocal = "share"
+	// publicTileError replaces the errors of failed tiles for share viewers
+	publicTileError = "the chart could not be loaded"
+)
+
+// shareToken resolves the share token of the request for the handlers after
+// it.
+func (h *Handler) shareToken(c *fiber.Ctx) error {
+	share, err := h.Shares.Resolve(c.Context(), c.Params("token"))
+	if err == nil {
+		c.Locals(shareLocal, share)
+		return c.Next()
+	}
+
+	code := ""
+	switch {
+	case errors.Is(err, service.ErrInvalidShareToken):
+		code = "invalid_token"
+	case errors.Is(err, service.ErrShareExpired):
+		code = "share_expired"
+	case errors.Is(err, service.ErrShareRevoked):
+		code = "share_revoked"
+	default:
+		return h.publicError(c, http.StatusInternalServerError, "", err)
+	}
+
+	return c.Status(http.StatusUnauthorized).JSON(Error{
+		Status:  http.StatusUnauthorized,
+		Message: err.Error(),
+		Code:    code,
+	})
+}
+
+func sharedBy(c *fiber.Ctx) model.Share {
+	return c.Locals(shareLocal).(model.Share)
+}
+
+// PublicFilter describes a dashboard filter to viewers of a share, without
+// the columns it maps to.
+type PublicFilter struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Locked *FilterValue `json:"locked,omitempty"`
+}
+
+type PublicDashboardRsp struct {
+	Name    string           `json:"name"`
+	Grid    []map[string]any `json:"grid,omitempty"`
+	Filters []PublicFilter   `json:"filters,omitempty"`
+}
+
+func (h *Handler) PublicDashboard(c *fiber.Ctx) error {
+	share := sharedBy(c)
+
+	dashboard, err := h.Shares.Dashboard(c.Context(), share)
+	if errors.Is(err, service.ErrDashboardNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return h.publicError(c, http.StatusInternalServerError, "", err)
+	}
+
+	filters := make([]PublicFilter, len(dashboard.Filters))
+	for idx, filter := range dashboard.Filters {
+		filters[idx] = PublicFilter{Name: filter.Name, Type: filter.Type}
+		if lock, found := share.Locked[filter.Name]; found {
+			value := FilterValue(lock)
+			filters[idx].Locked = &value
+		}
+	}
+
+	return c.JSON(PublicDashboardRsp{
+		Name:    dashboard.Name,
+		Grid:    dashboard.Grid,
+		Filters: filters,
+	})
+}
+
+func (h *Handler) PublicDashboardData(c *fiber.Ctx) error {
+	var req DashboardDataReq
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(Error{
+				Status:  http.StatusBadRequest,
+				Message: "invalid request body",
+			})
+		}
+	}
+
+	tiles, err := h.Shares.DashboardData(c.Context(), sharedBy(c), toFilterValues(req.Filters))
+	if errors.Is(err, service.ErrLockedFilter) {
+		return c.Status(http.StatusForbidden).JSON(Error{
+			Status:  http.StatusForbidden,
+			Message: err.Error(),
+			Code:    "locked_filter",
+		})
+	}
+
+	// tile errors can carry SQL and database messages, which stay with us
+	for idx, tile := range tiles {
+		if tile.Error != "" {
+			h.Logger.Printf("share %d: chart %d failed: %s", sharedBy(c).ID, tile.ChartID, tile.Error)
+			tiles[idx].Error = publicTileError
+		}
+	}
+
+	return dashboardTiles(c, tiles, err)
+}
+
+type PublicChartRsp struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (h *Handler) PublicChart(c *fiber.Ctx) error {
+	chart, err := h.Shares.Chart(c.Context(), sharedBy(c))
+	if errors.Is(err, service.ErrChartNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return h.publicError(c, http.StatusInternalServerError, "", err)
+	}
+
+	return c.JSON(PublicChartRsp{Name: chart.Name, Type: string(chart.Type)})
+}
+
+func (h *Handler) PublicChartData(c *fiber.Ctx) error {
+	result, err := h.Shares.ChartData(c.Context(), sharedBy(c))
+	if errors.Is(err, service.ErrChartNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if err != nil {
+		status, code := queryStatus(err)
+		return h.publicError(c, status, code, err)
+	}
+
+	return c.JSON(ValidateChartRsp{
+		Valid:     true,
+		Options:   result.Options,
+		Truncated: result.Truncated,
+	})
+}
+
+// publicError answers share viewers with the status and code of the error
+// only, as its message may reveal queries and internals. The error is logged
+// instead.
+func (h *Handler) publicError(c *fiber.Ctx, status int, code string, err error) error {
+	h.Logger.Printf("share request failed: %v", err)
+
+	return c.Status(status).JSON(Error{
+		Status:  status,
+		Message: http.StatusText(status),
+		Code:    code,
+	})
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/amukoski/aaa/model"
 	"github.com/amukoski/aaa/service"
@@ -12,10 +13,46 @@ import (
 )
 
 type SourceRsp struct {
-	ID       int          `json:"id,omitempty"`
-	Name     string       `json:"name,omitempty"`
-	Type     string       `json:"type,omitempty"`
-	Datasets []DatasetRsp `json:"datasets,omitempty"`
+	ID         int          `json:"id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	Type       string       `json:"type,omitempty"`
+	Datasets   []DatasetRsp `json:"datasets,omitempty"`
+	Guardrails *Guardrails  `json:"guardrails,omitempty"`
+	CreatedBy  *int         `json:"createdBy,omitempty"`
+	UpdatedBy  *int         `json:"updatedBy,omitempty"`
+}
+
+type Guardrails struct {
+	MaxCost            float64 `json:"maxCost,omitempty"`
+	MaxSeqScanRows     int64   `json:"maxSeqScanRows,omitempty"`
+	StatementTimeoutMs int64   `json:"statementTimeoutMs,omitempty"`
+	LockTimeoutMs      int64   `json:"lockTimeoutMs,omitempty"`
+}
+
+func toGuardrails(guardrails *model.Guardrails) *Guardrails {
+	if guardrails == nil {
+		return nil
+	}
+
+	return &Guardrails{
+		MaxCost:            guardrails.MaxCost,
+		MaxSeqScanRows:     guardrails.MaxSeqScanRows,
+		StatementTimeoutMs: guardrails.StatementTimeout.Milliseconds(),
+		LockTimeoutMs:      guardrails.LockTimeout.Milliseconds(),
+	}
+}
+
+func fromGuardrails(guardrails *Guardrails) *model.Guardrails {
+	if guardrails == nil {
+		return nil
+	}
+
+	return &model.Guardrails{
+		MaxCost:          guardrails.MaxCost,
+		MaxSeqScanRows:   guardrails.MaxSeqScanRows,
+		StatementTimeout: time.Duration(guardrails.StatementTimeoutMs) * time.Millisecond,
+		LockTimeout:      time.Duration(guardrails.LockTimeoutMs) * time.Millisecond,
+	}
 }
 
 type SourceAllRsp []SourceRsp
@@ -63,10 +100,13 @@ func (h *Handler) SourceGet(c *fiber.Ctx) error {
 	}
 
 	result := SourceRsp{
-		ID:       source.ID,
-		Name:     source.Name,
-		Type:     string(source.Type),
-		Datasets: make([]DatasetRsp, len(datasets)),
+		ID:         source.ID,
+		Name:       source.Name,
+		Type:       string(source.Type),
+		Datasets:   make([]DatasetRsp, len(datasets)),
+		Guardrails: toGuardrails(source.Config.Guardrails),
+		CreatedBy:  source.CreatedBy,
+		UpdatedBy:  source.UpdatedBy,
 	}
 
 	for idx, ds := range datasets {
@@ -111,10 +151,7 @@ func (h *Handler) SourceDiscovery(c *fiber.Ctx) error {
 func (h *Handler) SourcePostgresConnect(c *fiber.Ctx, uri string) error {
 	datasets, err := h.Sources.DiscoverDB(c.Context(), uri)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(Error{
-			Status:  http.StatusInternalServerError,
-			Message: err.Error(),
-		})
+		return queryError(c, err)
 	}
 
 	items := make([]DatasetRsp, len(datasets))
@@ -150,6 +187,10 @@ func (h *Handler) SourceCSVUpload(c *fiber.Ctx) error {
 
 	datasets, err := h.Sources.Upload(c.Context(), files)
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
@@ -171,9 +212,10 @@ func (h *Handler) SourceCSVUpload(c *fiber.Ctx) error {
 }
 
 type SourceCreateReq struct {
-	Name     string `json:"name"`
-	Type     string `json:"type"`
-	Resource string `json:"resource"`
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Resource   string      `json:"resource"`
+	Guardrails *Guardrails `json:"guardrails"`
 }
 
 func (h *Handler) SourceCreate(c *fiber.Ctx) error {
@@ -186,11 +228,16 @@ func (h *Handler) SourceCreate(c *fiber.Ctx) error {
 	}
 
 	id, err := h.Sources.Create(c.Context(), service.CreateSourceReq{
-		Name:     req.Name,
-		Type:     req.Type,
-		Resource: req.Resource,
+		Name:       req.Name,
+		Type:       req.Type,
+		Resource:   req.Resource,
+		Guardrails: fromGuardrails(req.Guardrails),
 	})
 	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
@@ -200,17 +247,32 @@ func (h *Handler) SourceCreate(c *fiber.Ctx) error {
 	return c.JSON(SourceRsp{ID: id})
 }
 
-func (h *Handler) SourceDelete(c *fiber.Ctx) error {
+func (h *Handler) SourceGuardrails(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil || id <= 0 {
 		return c.Status(http.StatusBadRequest).JSON(Error{
 			Status:  http.StatusBadRequest,
-			Message: "invalid id param",
+			Message: "invalid source id",
 		})
 	}
 
-	err = h.Sources.Delete(c.Context(), id)
-	if err != nil {
+	var req *Guardrails
+	if err = c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Sources.UpdateGuardrails(c.Context(), id, fromGuardrails(req)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.SendStatus(http.StatusNotFound)
+		}
+
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
 		return c.Status(http.StatusInternalServerError).JSON(Error{
 			Status:  http.StatusInternalServerError,
 			Message: err.Error(),
@@ -219,3 +281,7 @@ func (h *Handler) SourceDelete(c *fiber.Ctx) error {
 
 	return c.SendStatus(http.StatusNoContent)
 }
+
+func (h *Handler) SourceDelete(c *fiber.Ctx) error {
+	return remove(c, h.Sources.Delete, h.Sources.Dependents)
+}
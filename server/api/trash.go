@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type TrashItemRsp struct {
+	Kind      string    `json:"kind"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+func (h *Handler) TrashAll(c *fiber.Ctx) error {
+	items, err := h.Trash.All(c.Context())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make([]TrashItemRsp, len(items))
+	for idx, item := range items {
+		result[idx] = TrashItemRsp{
+			Kind:      string(item.Kind),
+			ID:        item.ID,
+			Name:      item.Name,
+			DeletedAt: item.DeletedAt,
+			PurgeAt:   item.PurgeAt,
+		}
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) TrashRestore(c *fiber.Ctx) error {
+	kind, id, ok := trashParams(c)
+	if !ok {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid entity kind or id",
+		})
+	}
+
+	err := h.Trash.Restore(c.Context(), kind, id)
+	return trashResponse(c, err)
+}
+
+func (h *Handler) TrashPurge(c *fiber.Ctx) error {
+	kind, id, ok := trashParams(c)
+	if !ok {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid entity kind or id",
+		})
+	}
+
+	err := h.Trash.Purge(c.Context(), kind, id)
+	return trashResponse(c, err)
+}
+
+func trashParams(c *fiber.Ctx) (model.EntityKind, int, bool) {
+	kind := model.EntityKind(c.Params("kind"))
+	id, err := c.ParamsInt("id")
+
+	return kind, id, err == nil && id > 0 && slices.Contains(model.SupportedEntityKinds, kind)
+}
+
+func trashResponse(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrNotInTrash) {
+		return c.Status(http.StatusNotFound).JSON(Error{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+		})
+	}
+
+	if errors.Is(err, service.ErrParentDeleted) {
+		return c.Status(http.StatusConflict).JSON(Error{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Code:    "parent_deleted",
+		})
+	}
+
+	if err != nil {
+		if errors.Is(err, service.ErrForbidden) {
+			return forbidden(c, err)
+		}
+
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
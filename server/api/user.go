@@ -0,0 +1,425 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const sessionCookie = "session"
+
+type UserRsp struct {
+	ID         int                 `json:"id"`
+	Email      string              `json:"email"`
+	Name       string              `json:"name"`
+	Role       string              `json:"role"`
+	Attributes map[string][]string `json:"attributes"`
+	CreatedAt  time.Time           `json:"createdAt"`
+}
+
+func toUserRsp(user model.User) UserRsp {
+	return UserRsp{
+		ID:         user.ID,
+		Email:      user.Email,
+		Name:       user.Name,
+		Role:       string(user.Role),
+		Attributes: user.Attributes,
+		CreatedAt:  user.CreatedAt,
+	}
+}
+
+type UserReq struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type RoleReq struct {
+	Role string `json:"role"`
+}
+
+// AttributesReq sets the values the row rules of datasets are filled with,
+// e.g. {"regions": ["EMEA", "APAC"]} for Region IN {{user.regions}}.
+type AttributesReq struct {
+	Attributes map[string][]string `json:"attributes"`
+}
+
+type LoginReq struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type PasswordReq struct {
+	Password string `json:"password"`
+}
+
+type APIKeyRsp struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func toAPIKeyRsp(key model.APIKey) APIKeyRsp {
+	return APIKeyRsp{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		LastUsedAt: key.LastUsedAt,
+		ExpiresAt:  key.ExpiresAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// APIKeySecretRsp is only returned when the key is created, the key can't be
+// read back afterwards.
+type APIKeySecretRsp struct {
+	APIKeyRsp
+	Key string `json:"key"`
+}
+
+type APIKeyReq struct {
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// authenticate signs the request in with an API key sent as a bearer token,
+// or else the session cookie, and attaches the user to the request context.
+func (h *Handler) authenticate(c *fiber.Ctx) error {
+	var user model.User
+	var err error
+
+	if key, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); found {
+		user, err = h.Users.APIKey(c.Context(), key)
+	} else if token := c.Cookies(sessionCookie); token != "" {
+		user, err = h.Users.Session(c.Context(), token)
+	} else {
+		err = service.ErrUnauthenticated
+	}
+
+	if errors.Is(err, service.ErrUnauthenticated) {
+		return c.Status(http.StatusUnauthorized).JSON(Error{
+			Status:  http.StatusUnauthorized,
+			Message: err.Error(),
+			Code:    "unauthenticated",
+		})
+	}
+
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	c.Locals(service.UserKey, user)
+	return c.Next()
+}
+
+// currentUser returns the user signed in by authenticate.
+func currentUser(c *fiber.Ctx) model.User {
+	user, _ := service.CurrentUser(c.Context())
+	return user
+}
+
+func (h *Handler) Login(c *fiber.Ctx) error {
+	var req LoginReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	token, expires, err := h.Users.Login(c.Context(), req.Email, req.Password)
+	if errors.Is(err, service.ErrInvalidCredentials) {
+		return c.Status(http.StatusUnauthorized).JSON(Error{
+			Status:  http.StatusUnauthorized,
+			Message: err.Error(),
+			Code:    "invalid_credentials",
+		})
+	}
+
+	if err != nil {
+		return userError(c, err)
+	}
+
+	user, err := h.Users.Session(c.Context(), token)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   h.SecureCookies,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.JSON(toUserRsp(user))
+}
+
+func (h *Handler) Logout(c *fiber.Ctx) error {
+	if token := c.Cookies(sessionCookie); token != "" {
+		if err := h.Users.Logout(c.Context(), token); err != nil {
+			return userError(c, err)
+		}
+	}
+
+	c.ClearCookie(sessionCookie)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) Me(c *fiber.Ctx) error {
+	return c.JSON(toUserRsp(currentUser(c)))
+}
+
+// MePassword changes the password of the signed in user, which signs them
+// out of every session.
+func (h *Handler) MePassword(c *fiber.Ctx) error {
+	var req PasswordReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err := h.Users.SetPassword(c.Context(), currentUser(c).ID, req.Password); err != nil {
+		return userError(c, err)
+	}
+
+	c.ClearCookie(sessionCookie)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) APIKeyAll(c *fiber.Ctx) error {
+	keys, err := h.Users.APIKeys(c.Context(), currentUser(c).ID)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	result := make([]APIKeyRsp, len(keys))
+	for idx, key := range keys {
+		result[idx] = toAPIKeyRsp(key)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) APIKeyCreate(c *fiber.Ctx) error {
+	var req APIKeyReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	key, secret, err := h.Users.CreateAPIKey(c.Context(), currentUser(c).ID, req.Name, req.ExpiresAt)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(APIKeySecretRsp{
+		APIKeyRsp: toAPIKeyRsp(key),
+		Key:       secret,
+	})
+}
+
+func (h *Handler) APIKeyRevoke(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid api key id",
+		})
+	}
+
+	if err = h.Users.RevokeAPIKey(c.Context(), currentUser(c).ID, id); err != nil {
+		return userError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) UserAll(c *fiber.Ctx) error {
+	users, err := h.Users.All(c.Context())
+	if err != nil {
+		return userError(c, err)
+	}
+
+	result := make([]UserRsp, len(users))
+	for idx, user := range users {
+		result[idx] = toUserRsp(user)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) UserGet(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid user id",
+		})
+	}
+
+	user, err := h.Users.Get(c.Context(), id)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	return c.JSON(toUserRsp(user))
+}
+
+func (h *Handler) UserCreate(c *fiber.Ctx) error {
+	var req UserReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	id, err := h.Users.Create(c.Context(), service.UserReq{
+		Email:    req.Email,
+		Name:     req.Name,
+		Password: req.Password,
+		Role:     model.Role(req.Role),
+	})
+	if err != nil {
+		return userError(c, err)
+	}
+
+	user, err := h.Users.Get(c.Context(), id)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toUserRsp(user))
+}
+
+func (h *Handler) UserRole(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid user id",
+		})
+	}
+
+	var req RoleReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Users.SetRole(c.Context(), id, model.Role(req.Role)); err != nil {
+		return userError(c, err)
+	}
+
+	user, err := h.Users.Get(c.Context(), id)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	return c.JSON(toUserRsp(user))
+}
+
+func (h *Handler) UserAttributes(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid user id",
+		})
+	}
+
+	var req AttributesReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Users.SetAttributes(c.Context(), id, req.Attributes); err != nil {
+		return userError(c, err)
+	}
+
+	user, err := h.Users.Get(c.Context(), id)
+	if err != nil {
+		return userError(c, err)
+	}
+
+	return c.JSON(toUserRsp(user))
+}
+
+func (h *Handler) UserDelete(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid user id",
+		})
+	}
+
+	if id == currentUser(c).ID {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "users can't delete themselves",
+		})
+	}
+
+	if err = h.Users.Delete(c.Context(), id); err != nil {
+		return userError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func userError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrUserNotFound) || errors.Is(err, service.ErrAPIKeyNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrEmailTaken) {
+		return c.Status(http.StatusConflict).JSON(Error{
+			Status:  http.StatusConflict,
+			Message: err.Error(),
+			Code:    "email_taken",
+		})
+	}
+
+	if errors.Is(err, service.ErrInvalidUser) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const webhookHistory = 100
+
+type WebhookRsp struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookSecretRsp is only returned when the webhook is created, the secret
+// can't be read back afterwards.
+type WebhookSecretRsp struct {
+	WebhookRsp
+	Secret string `json:"secret"`
+}
+
+func toWebhookRsp(webhook model.Webhook) WebhookRsp {
+	return WebhookRsp{
+		ID:        webhook.ID,
+		Name:      webhook.Name,
+		URL:       webhook.URL,
+		Events:    webhook.Events,
+		Enabled:   webhook.Enabled,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
+
+type WebhookReq struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled"`
+}
+
+func (req WebhookReq) toServiceReq(id int) service.WebhookReq {
+	return service.WebhookReq{
+		ID:      id,
+		Name:    req.Name,
+		URL:     req.URL,
+		Events:  req.Events,
+		Enabled: req.Enabled == nil || *req.Enabled,
+	}
+}
+
+type WebhookDeliveryRsp struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhookId"`
+	EventID        string          `json:"eventId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"responseStatus,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+}
+
+func toWebhookDeliveries(deliveries []model.WebhookDelivery) []WebhookDeliveryRsp {
+	result := make([]WebhookDeliveryRsp, len(deliveries))
+	for idx, d := range deliveries {
+		result[idx] = WebhookDeliveryRsp{
+			ID:             d.ID,
+			WebhookID:      d.WebhookID,
+			EventID:        d.EventID,
+			Event:          string(d.Event),
+			Payload:        d.Payload,
+			Status:         string(d.Status),
+			Attempts:       d.Attempts,
+			ResponseStatus: d.ResponseStatus,
+			Error:          d.Error,
+			DeliveredAt:    d.DeliveredAt,
+			CreatedAt:      d.CreatedAt,
+		}
+	}
+
+	return result
+}
+
+// WebhookEvents lists the event types webhooks can subscribe to.
+func (h *Handler) WebhookEvents(c *fiber.Ctx) error {
+	return c.JSON(model.SupportedEventTypes())
+}
+
+func (h *Handler) WebhookAll(c *fiber.Ctx) error {
+	webhooks, err := h.Webhooks.All(c.Context())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	result := make([]WebhookRsp, len(webhooks))
+	for idx, webhook := range webhooks {
+		result[idx] = toWebhookRsp(webhook)
+	}
+
+	return c.JSON(result)
+}
+
+func (h *Handler) WebhookGet(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid webhook id",
+		})
+	}
+
+	webhook, err := h.Webhooks.Get(c.Context(), id)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.JSON(toWebhookRsp(webhook))
+}
+
+func (h *Handler) WebhookCreate(c *fiber.Ctx) error {
+	var req WebhookReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	id, err := h.Webhooks.Create(c.Context(), req.toServiceReq(0))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	webhook, err := h.Webhooks.Get(c.Context(), id)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(WebhookSecretRsp{
+		WebhookRsp: toWebhookRsp(webhook),
+		Secret:     webhook.Secret,
+	})
+}
+
+func (h *Handler) WebhookUpdate(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid webhook id",
+		})
+	}
+
+	var req WebhookReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+		})
+	}
+
+	if err = h.Webhooks.Update(c.Context(), req.toServiceReq(id)); err != nil {
+		return webhookError(c, err)
+	}
+
+	webhook, err := h.Webhooks.Get(c.Context(), id)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.JSON(toWebhookRsp(webhook))
+}
+
+func (h *Handler) WebhookDelete(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid webhook id",
+		})
+	}
+
+	if err = h.Webhooks.Delete(c.Context(), id); err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *Handler) WebhookDeliveries(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid webhook id",
+		})
+	}
+
+	deliveries, err := h.Webhooks.Deliveries(c.Context(), id, webhookHistory)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.JSON(toWebhookDeliveries(deliveries))
+}
+
+// WebhookDeadLetters lists the deliveries that ran out of attempts.
+func (h *Handler) WebhookDeadLetters(c *fiber.Ctx) error {
+	deliveries, err := h.Webhooks.DeadLetters(c.Context(), webhookHistory)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.JSON(toWebhookDeliveries(deliveries))
+}
+
+// WebhookRedeliver queues a dead-lettered delivery again.
+func (h *Handler) WebhookRedeliver(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: "invalid delivery id",
+		})
+	}
+
+	if err = h.Webhooks.Redeliver(c.Context(), id); err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.SendStatus(http.StatusAccepted)
+}
+
+func webhookError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, service.ErrWebhookNotFound) || errors.Is(err, service.ErrDeliveryNotFound) {
+		return c.SendStatus(http.StatusNotFound)
+	}
+
+	if errors.Is(err, service.ErrForbidden) {
+		return forbidden(c, err)
+	}
+
+	if errors.Is(err, service.ErrInvalidWebhook) {
+		return c.Status(http.StatusBadRequest).JSON(Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusInternalServerError).JSON(Error{
+		Status:  http.StatusInternalServerError,
+		Message: err.Error(),
+	})
+}
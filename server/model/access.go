@@ -0,0 +1,43 @@
+package model
+
+import (
+	"slices"
+	"time"
+)
+
+type Role string
+
+const (
+	ADMIN  Role = "admin"
+	EDITOR Role = "editor"
+	VIEWER Role = "viewer"
+)
+
+// SupportedRoles lists the roles from least to most privileged.
+var SupportedRoles = []Role{VIEWER, EDITOR, ADMIN}
+
+// Includes tells whether the role grants everything the other one does.
+// Admins manage sources and access, editors build datasets, charts and
+// dashboards on top of them, viewers only look at the results.
+func (r Role) Includes(other Role) bool {
+	return slices.Index(SupportedRoles, r) >= slices.Index(SupportedRoles, other)
+}
+
+// Group bundles users to grant them access together, e.g. "finance".
+type Group struct {
+	ID        int
+	Name      string
+	Members   []int
+	CreatedAt time.Time
+}
+
+// Grant restricts a source, dataset, chart or dashboard to the groups granted
+// access. Entities without grants are open to every user, admins see
+// everything regardless.
+type Grant struct {
+	ID        int
+	Kind      EntityKind
+	TargetID  int
+	GroupID   int
+	CreatedAt time.Time
+}
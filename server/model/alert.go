@@ -0,0 +1,69 @@
+package model
+
+import "time"
+
+type AlertState string
+
+const (
+	OK       AlertState = "ok"
+	FIRING   AlertState = "firing"
+	RESOLVED AlertState = "resolved"
+)
+
+const (
+	// ValueCondition compares the metric of the latest period.
+	ValueCondition = "value"
+	// ChangeCondition compares the percent change versus the previous period.
+	ChangeCondition = "percent_change"
+	// AbsChangeCondition compares the size of the percent change, whichever
+	// way it goes.
+	AbsChangeCondition = "abs_percent_change"
+)
+
+var SupportedAlertConditions = []string{ValueCondition, ChangeCondition, AbsChangeCondition}
+
+// Alert watches a metric of a chart, e.g. SUM(revenue) of the latest month
+// dropping below a threshold, and notifies its channels when it starts and
+// stops firing.
+type Alert struct {
+	ID        int
+	Name      string
+	ChartID   int
+	Metric    string
+	Condition AlertCondition
+	// SkipPartial evaluates the last complete period instead of the one in
+	// progress.
+	SkipPartial bool
+	Interval    time.Duration
+	Emails      []string
+	Webhooks    []string
+	Enabled     bool
+	State       AlertState
+	LastValue   *float64
+	LastError   string
+	EvaluatedAt *time.Time
+}
+
+// AlertCondition holds when an alert fires, e.g. {percent_change, <, -20}
+// for a drop of more than 20% versus the previous period.
+type AlertCondition struct {
+	Type     string
+	Operator string
+	Value    float64
+}
+
+// AlertEvent records an alert starting or stopping to fire.
+type AlertEvent struct {
+	ID       int
+	AlertID  int
+	State    AlertState
+	Period   string
+	Value    float64
+	Previous *float64
+	// Observed is the number the condition was checked against, the value or
+	// its change.
+	Observed    float64
+	Message     string
+	NotifyError string
+	CreatedAt   time.Time
+}
@@ -1,5 +1,10 @@
 package model
 
+import (
+	"fmt"
+	"time"
+)
+
 type ChartType string
 
 const (
@@ -15,6 +20,11 @@ var (
 	SupportedChartTypes = []ChartType{BAR, PIE, LINE, SCATTER, HEATMAP, SANKEY}
 	SupportedPrecisions = []string{"year", "quarter", "month", "week", "day"}
 	SupportedFilters    = []string{"=", "!=", ">", "<", "LIKE", "IN"}
+	SupportedDirections = []string{"asc", "desc"}
+	SupportedConditions = []string{"=", "!=", ">", ">=", "<", "<="}
+	SupportedGapFills   = []string{"null", "zero", "previous"}
+	SupportedTransforms = []string{"cumulative", "moving_average", "percent_of_total", "rank", "difference", "percent_change"}
+	SupportedCompares   = []string{"previous", "last_year"}
 )
 
 type Chart struct {
@@ -23,12 +33,95 @@ type Chart struct {
 	Name      string      `json:"name"`
 	Type      ChartType   `json:"type"`
 	Config    ChartConfig `json:"config"`
+	CreatedBy *int        `json:"createdBy"`
+	UpdatedBy *int        `json:"updatedBy"`
+	UpdatedAt time.Time   `json:"updatedAt"`
 }
 
 type ChartConfig struct {
-	Dimensions []string `json:"dimensions"`
-	Metrics    []string `json:"metrics"`
-	Filters    []string `json:"filters"`
+	Dimensions []string       `json:"dimensions"`
+	Metrics    []string       `json:"metrics"`
+	Filters    []string       `json:"filters"`
+	Sort       *ChartSort     `json:"sort,omitempty"`
+	Limit      int            `json:"limit,omitempty"`
+	TopN       int            `json:"topN,omitempty"`
+	Having     []Having       `json:"having,omitempty"`
+	GapFill    string         `json:"gapFill,omitempty"`
+	Calendar   *ChartCalendar `json:"calendar,omitempty"`
+	Transforms []Transform    `json:"transforms,omitempty"`
+	DrillPath  []string       `json:"drillPath,omitempty"`
+}
+
+// NextPrecision returns the precision to drill into from a date bucket, or
+// an empty string at the finest level. Months drill into days, as weeks do
+// not nest within months.
+func NextPrecision(precision string) string {
+	switch precision {
+	case "year":
+		return "quarter"
+	case "quarter":
+		return "month"
+	case "month", "week":
+		return "day"
+	}
+
+	return ""
+}
+
+// Transform derives a chart metric from its grouped values, e.g. a running
+// total or the change versus the previous period.
+type Transform struct {
+	Metric  string `json:"metric"`
+	Type    string `json:"type"`
+	Window  int    `json:"window,omitempty"`
+	Compare string `json:"compare,omitempty"`
+}
+
+// Apply adjusts the display metadata of the transformed metric.
+func (t Transform) Apply(field FieldLabel) FieldLabel {
+	compare := "previous period"
+	if t.Compare == "last_year" {
+		compare = "last year"
+	}
+
+	switch t.Type {
+	case "cumulative":
+		field.Label += " (cumulative)"
+	case "moving_average":
+		field.Label += fmt.Sprintf(" (%d-period moving average)", t.Window)
+	case "percent_of_total":
+		field.Label += " (% of total)"
+		field.Format, field.Unit = "percent", ""
+	case "rank":
+		field.Label += " (rank)"
+		field.Format, field.Unit = "number", ""
+	case "difference":
+		field.Label += fmt.Sprintf(" (change vs %s)", compare)
+	case "percent_change":
+		field.Label += fmt.Sprintf(" (%% change vs %s)", compare)
+		field.Format, field.Unit = "percent", ""
+	}
+
+	return field
+}
+
+// ChartCalendar overrides how date dimensions are bucketed.
+type ChartCalendar struct {
+	WeekStart       string `json:"weekStart,omitempty"`
+	FiscalYearStart int    `json:"fiscalYearStart,omitempty"`
+	TimeZone        string `json:"timeZone,omitempty"`
+}
+
+// Having is a condition on an aggregated metric, applied after grouping.
+type Having struct {
+	Metric   string  `json:"metric"`
+	Operator string  `json:"operator"`
+	Value    float64 `json:"value"`
+}
+
+type ChartSort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
 }
 
 type ChartSchema struct {
@@ -48,3 +141,38 @@ type FieldRule struct {
 	Max    int      `json:"max"`
 	Values []string `json:"values"`
 }
+
+// ChartFields holds the display metadata of the dimensions and metrics of a
+// chart, in the order they are queried.
+type ChartFields struct {
+	Dimensions []FieldLabel
+	Metrics    []FieldLabel
+}
+
+type FieldLabel struct {
+	Label       string
+	Description string
+	Format      string
+	Unit        string
+}
+
+// Formatter returns an ECharts string template for values of the field.
+func (f FieldLabel) Formatter() string {
+	switch {
+	case f.Format == "percent":
+		return "{value}%"
+	case f.Unit != "":
+		return "{value} " + f.Unit
+	default:
+		return "{value}"
+	}
+}
+
+// Name returns the label suffixed with its unit, used for axis names.
+func (f FieldLabel) Name() string {
+	if f.Unit == "" {
+		return f.Label
+	}
+
+	return fmt.Sprintf("%s (%s)", f.Label, f.Unit)
+}
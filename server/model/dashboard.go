@@ -1,7 +1,71 @@
 package model
 
+import "time"
+
+const (
+	DateRangeFilter = "date_range"
+	ValuesFilter    = "values"
+)
+
+var SupportedDashboardFilters = []string{DateRangeFilter, ValuesFilter}
+
 type Dashboard struct {
-	ID   int              `json:"id"`
-	Name string           `json:"name"`
-	Grid []map[string]any `json:"grid"`
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Grid    []map[string]any  `json:"grid"`
+	Filters []DashboardFilter `json:"filters"`
+	// Version is bumped on every update and guards against lost updates.
+	Version int `json:"version"`
+	// RefreshInterval is how often live viewers get fresh tile data, zero
+	// when the dashboard doesn't refresh itself.
+	RefreshInterval time.Duration `json:"refreshInterval"`
+	CreatedBy       *int          `json:"createdBy"`
+	UpdatedBy       *int          `json:"updatedBy"`
+}
+
+// DashboardFilter is applied to every tile whose dataset has the column.
+// Mapping overrides the column per dataset ID, for datasets that name it
+// differently.
+type DashboardFilter struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Column  string         `json:"column"`
+	Mapping map[int]string `json:"mapping,omitempty"`
+}
+
+// ColumnFor returns the column the filter applies to in the dataset.
+func (f DashboardFilter) ColumnFor(datasetID int) string {
+	if column, found := f.Mapping[datasetID]; found {
+		return column
+	}
+
+	return f.Column
+}
+
+// FilterValue is the active value of a dashboard filter. A date range
+// includes From and excludes To, either of which may be left open.
+type FilterValue struct {
+	From   string   `json:"from,omitempty"`
+	To     string   `json:"to,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Selection is a click on a dashboard tile: the dimension of the clicked
+// element and its value.
+type Selection struct {
+	ChartID   int
+	Dimension string
+	Value     string
+}
+
+// DashboardTile is the rendered chart of a single grid entry. Applied lists
+// the dashboard filters that were injected into its query, Dimensions the
+// dimensions it was grouped by, which differ from the chart after a drill-down.
+type DashboardTile struct {
+	ChartID    int
+	Dimensions []string
+	Options    any
+	Truncated  bool
+	Applied    []string
+	Error      string
 }
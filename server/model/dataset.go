@@ -2,25 +2,81 @@ package model
 
 import (
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/amukoski/aaa/service/utils"
 )
 
 var (
 	SQLAggregationsGlobal = []string{"COUNT(*)"}
 	SQLAggregationsColumn = []string{"COUNT(%s)", "AVG(%s)", "SUM(%s)", "MIN(%s)", "MAX(%s)"}
+	SupportedAggregations = []string{"COUNT", "AVG", "SUM", "MIN", "MAX"}
+	SupportedFormats      = []string{"number", "currency", "percent"}
+)
+
+var (
+	metricPattern = regexp.MustCompile(`^(\w+)\((.+)\)$`)
+	metricLabels  = map[string]string{
+		"COUNT": "Count of %s",
+		"AVG":   "Average %s",
+		"SUM":   "Total %s",
+		"MIN":   "Minimum %s",
+		"MAX":   "Maximum %s",
+	}
 )
 
 type Dataset struct {
-	ID       int
-	SourceID int
-	Name     string
-	Config   DatasetConfig
+	ID        int
+	SourceID  int
+	Name      string
+	Config    DatasetConfig
+	Version   int
+	CreatedBy *int
+	UpdatedBy *int
 }
 
 type DatasetConfig struct {
-	Schema  string
-	Table   string
-	Columns []string
+	Schema       string
+	Table        string
+	Columns      []string
+	Metadata     map[string]ColumnMetadata
+	SavedMetrics []SavedMetric
+	Rules        []RowRule
+}
+
+// SavedMetric is a named aggregate expression defined once on the dataset
+// and referenced by name from charts.
+type SavedMetric struct {
+	Name       string
+	Expression string
+	Format     string
+	Unit       string
+}
+
+// RowRule restricts the rows of the dataset a user sees to the ones matching
+// the filter expression, such as Region IN {{user.regions}}. Placeholders
+// are filled from the attributes of the user running the query.
+type RowRule struct {
+	Name       string
+	Expression string
+}
+
+// ColumnMetadata holds the semantic description of a dataset column, keyed
+// by the column name in DatasetConfig.Metadata.
+type ColumnMetadata struct {
+	Label              string
+	Description        string
+	Hidden             bool
+	Format             string
+	Unit               string
+	DefaultAggregation string
+}
+
+func (ds DatasetConfig) TableName() string {
+	return fmt.Sprintf("%s.%s", ds.Schema, ds.Table)
 }
 
 func (ds DatasetConfig) Dimensions() []string {
@@ -28,6 +84,10 @@ func (ds DatasetConfig) Dimensions() []string {
 
 	for _, col := range ds.Columns {
 		column, dataType := utils.ParseColumn(col)
+		if ds.Metadata[column].Hidden {
+			continue
+		}
+
 		dimensions = append(dimensions, column)
 
 		if utils.IsColumnDateTime(dataType) {
@@ -49,18 +109,75 @@ func (ds DatasetConfig) Metrics() []string {
 
 	for _, col := range ds.Columns {
 		column, dataType := utils.ParseColumn(col)
-		if !utils.IsColumnNumeric(dataType) {
+		if !utils.IsColumnNumeric(dataType) || ds.Metadata[column].Hidden {
 			continue
 		}
 
-		for _, op := range SQLAggregationsColumn {
+		// the default aggregation of a column is offered first
+		operations := SQLAggregationsColumn
+		if agg := ds.Metadata[column].DefaultAggregation; agg != "" {
+			first := agg + "(%s)"
+			rest := slices.DeleteFunc(slices.Clone(operations), func(op string) bool { return op == first })
+			operations = append([]string{first}, rest...)
+		}
+
+		for _, op := range operations {
 			metrics = append(metrics, fmt.Sprintf(op, column))
 		}
 	}
 
+	for _, saved := range ds.SavedMetrics {
+		metrics = append(metrics, saved.Name)
+	}
+
 	return metrics
 }
 
+// IsColumnMetric reports whether the metric is a plain aggregation of a
+// column of the dataset, such as SUM(amount), or COUNT(*).
+func (ds DatasetConfig) IsColumnMetric(metric string) bool {
+	matches := metricPattern.FindStringSubmatch(metric)
+	if matches == nil || !slices.Contains(SupportedAggregations, strings.ToUpper(matches[1])) {
+		return false
+	}
+
+	if matches[2] == "*" {
+		return strings.EqualFold(matches[1], "COUNT")
+	}
+
+	return slices.Contains(utils.ColumnNames(ds.Columns), matches[2])
+}
+
+func (ds DatasetConfig) SavedMetric(name string) (SavedMetric, bool) {
+	idx := slices.IndexFunc(ds.SavedMetrics, func(saved SavedMetric) bool {
+		return saved.Name == name
+	})
+
+	if idx == -1 {
+		return SavedMetric{}, false
+	}
+
+	return ds.SavedMetrics[idx], true
+}
+
+// MetricExpression resolves saved metric names to their SQL expression.
+func (ds DatasetConfig) MetricExpression(metric string) string {
+	if saved, found := ds.SavedMetric(metric); found {
+		return saved.Expression
+	}
+
+	return metric
+}
+
+func (ds DatasetConfig) MetricExpressions(metrics []string) []string {
+	expressions := make([]string, len(metrics))
+	for idx, metric := range metrics {
+		expressions[idx] = ds.MetricExpression(metric)
+	}
+
+	return expressions
+}
+
 func (ds DatasetConfig) Precisions() []string {
 	precisions := make([]string, 0)
 
@@ -75,3 +192,112 @@ func (ds DatasetConfig) Precisions() []string {
 
 	return precisions
 }
+
+// DimensionLabel resolves the display metadata of a dimension, which is a
+// column optionally suffixed with a date precision.
+func (ds DatasetConfig) DimensionLabel(dimension string) FieldLabel {
+	column, precision := utils.ParseColumn(dimension)
+	meta := ds.Metadata[column]
+
+	label := FieldLabel{Label: meta.Label, Description: meta.Description, Format: meta.Format, Unit: meta.Unit}
+	if label.Label == "" {
+		label.Label = column
+	}
+
+	if precision != "" {
+		label.Label = fmt.Sprintf("%s (%s)", label.Label, precision)
+		label.Format, label.Unit = "", ""
+	}
+
+	return label
+}
+
+// MetricLabel resolves the display metadata of an aggregation such as
+// AVG(close). Metrics over unlabelled columns keep their SQL expression.
+func (ds DatasetConfig) MetricLabel(metric string) FieldLabel {
+	if saved, found := ds.SavedMetric(metric); found {
+		return FieldLabel{Label: saved.Name, Format: saved.Format, Unit: saved.Unit}
+	}
+
+	matches := metricPattern.FindStringSubmatch(metric)
+	if matches == nil {
+		return FieldLabel{Label: metric}
+	}
+
+	op, column := strings.ToUpper(matches[1]), matches[2]
+	meta, found := ds.Metadata[column]
+	if column == "*" {
+		return FieldLabel{Label: "Count", Format: "number"}
+	}
+
+	if !found || meta.Label == "" {
+		return FieldLabel{Label: metric, Description: meta.Description, Format: meta.Format, Unit: meta.Unit}
+	}
+
+	label := FieldLabel{Label: meta.Label, Description: meta.Description, Format: meta.Format, Unit: meta.Unit}
+	if format, ok := metricLabels[op]; ok {
+		label.Label = fmt.Sprintf(format, meta.Label)
+	}
+
+	if op == "COUNT" {
+		label.Format, label.Unit = "number", ""
+	}
+
+	return label
+}
+
+// ChartFields resolves the display metadata for the given chart fields.
+func (ds DatasetConfig) ChartFields(dimensions []string, metrics []string) ChartFields {
+	fields := ChartFields{
+		Dimensions: make([]FieldLabel, len(dimensions)),
+		Metrics:    make([]FieldLabel, len(metrics)),
+	}
+
+	for idx, dimension := range dimensions {
+		fields.Dimensions[idx] = ds.DimensionLabel(dimension)
+	}
+
+	for idx, metric := range metrics {
+		fields.Metrics[idx] = ds.MetricLabel(metric)
+	}
+
+	return fields
+}
+
+type DatasetPreview struct {
+	Page    int
+	Size    int
+	Columns []string
+	Rows    [][]any
+	HasMore bool
+}
+
+type DatasetProfile struct {
+	DatasetID  int
+	Rows       int64
+	Sampled    bool
+	Columns    []ColumnProfile
+	ComputedAt time.Time
+}
+
+type ColumnProfile struct {
+	Name      string
+	Type      string
+	NullRatio float64
+	Distinct  int64
+	Min       *string
+	Max       *string
+	TopValues []ValueCount
+	Histogram []HistogramBin
+}
+
+type ValueCount struct {
+	Value *string
+	Count int64
+}
+
+type HistogramBin struct {
+	Lower any
+	Upper any
+	Count int64
+}
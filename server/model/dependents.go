@@ -0,0 +1,58 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+type EntityKind string
+
+const (
+	SOURCE    EntityKind = "source"
+	DATASET   EntityKind = "dataset"
+	CHART     EntityKind = "chart"
+	DASHBOARD EntityKind = "dashboard"
+)
+
+var SupportedEntityKinds = []EntityKind{SOURCE, DATASET, CHART, DASHBOARD}
+
+type DeleteMode string
+
+const (
+	REFUSE  DeleteMode = "refuse"
+	CASCADE DeleteMode = "cascade"
+	SOFT    DeleteMode = "soft"
+)
+
+var SupportedDeleteModes = []DeleteMode{REFUSE, CASCADE, SOFT}
+
+// EntityRef names an entity that is affected by a change to another one.
+type EntityRef struct {
+	ID   int
+	Name string
+}
+
+// Dependents lists everything downstream of a source, dataset or chart.
+// Dashboards depend on a chart by referencing it in their grid.
+type Dependents struct {
+	Datasets   []EntityRef
+	Charts     []EntityRef
+	Dashboards []EntityRef
+}
+
+func (d Dependents) Empty() bool {
+	return len(d.Datasets) == 0 && len(d.Charts) == 0 && len(d.Dashboards) == 0
+}
+
+func (d Dependents) String() string {
+	parts := make([]string, 0, 3)
+	kinds := []string{"dataset(s)", "chart(s)", "dashboard(s)"}
+
+	for idx, refs := range [][]EntityRef{d.Datasets, d.Charts, d.Dashboards} {
+		if len(refs) > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", len(refs), kinds[idx]))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
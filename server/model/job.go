@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+type JobStatus string
+
+const (
+	QUEUED    JobStatus = "queued"
+	RUNNING   JobStatus = "running"
+	SUCCEEDED JobStatus = "succeeded"
+	FAILED    JobStatus = "failed"
+	CANCELLED JobStatus = "cancelled"
+)
+
+type Job struct {
+	ID         string
+	ChartID    int
+	SourceID   int
+	Status     JobStatus
+	Error      string
+	QueuedAt   time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+func (j Job) Done() bool {
+	return j.Status == SUCCEEDED || j.Status == FAILED || j.Status == CANCELLED
+}
@@ -0,0 +1,59 @@
+package model
+
+import "time"
+
+type QueryLog struct {
+	ID        int
+	ChartID   *int
+	DatasetID int
+	SourceID  int
+	SQL       string
+	Duration  time.Duration
+	Rows      int
+	CacheHit  bool
+	Error     string
+	CreatedAt time.Time
+}
+
+type QueryFilter struct {
+	ChartID     int
+	DatasetID   int
+	SourceID    int
+	Failed      bool
+	MinDuration time.Duration
+	Since       time.Time
+	Until       time.Time
+	Limit       int
+}
+
+// QueryStats aggregates the query log of a single chart or dataset.
+type QueryStats struct {
+	ID            int
+	Name          string
+	Queries       int
+	Failures      int
+	CacheHits     int
+	AvgDuration   time.Duration
+	P95Duration   time.Duration
+	MaxDuration   time.Duration
+	TotalDuration time.Duration
+	AvgRows       float64
+}
+
+type QueryInsights struct {
+	SlowestCharts     []QueryStats
+	ExpensiveDatasets []QueryStats
+}
+
+type QueryPlan struct {
+	Plan          any
+	EstimatedRows float64
+	EstimatedCost float64
+	SeqScans      []SeqScan
+	Violations    []string
+}
+
+type SeqScan struct {
+	Table string
+	Rows  int64
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// ChartRevision is a prior state of a chart. It is recorded every time the
+// chart is updated or reverted, along with who saved that state and when.
+type ChartRevision struct {
+	ChartID   int
+	Version   int
+	Chart     Chart
+	AuthorID  *int
+	CreatedAt time.Time
+}
+
+// ChartChange is a single chart field that differs between two revisions.
+type ChartChange struct {
+	Field  string
+	Before any
+	After  any
+}
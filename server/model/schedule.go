@@ -0,0 +1,70 @@
+package model
+
+import "time"
+
+type ReportFormat string
+
+const (
+	PDF ReportFormat = "pdf"
+	PNG ReportFormat = "png"
+)
+
+var SupportedReportFormats = []ReportFormat{PDF, PNG}
+
+type DeliveryStatus string
+
+const (
+	PENDING  DeliveryStatus = "pending"
+	RETRYING DeliveryStatus = "retrying"
+	SENT     DeliveryStatus = "sent"
+	// UNDELIVERED is final, once every attempt failed.
+	UNDELIVERED DeliveryStatus = "failed"
+)
+
+// Schedule emails a dashboard or chart, rendered as Format, to the recipients
+// whenever the cron expression fires in the time zone.
+type Schedule struct {
+	ID         int
+	Name       string
+	Kind       EntityKind
+	TargetID   int
+	Cron       string
+	Timezone   string
+	Format     ReportFormat
+	Recipients []string
+	Enabled    bool
+	NextRunAt  *time.Time
+}
+
+// Delivery is a single run of a schedule, retried until it is sent or runs
+// out of attempts.
+type Delivery struct {
+	ID           int
+	ScheduleID   int
+	ScheduledFor time.Time
+	Status       DeliveryStatus
+	Attempts     int
+	Error        string
+	DeliveredAt  *time.Time
+	CreatedAt    time.Time
+}
+
+// Report is a dashboard or chart snapshot with the data of every tile.
+type Report struct {
+	Title       string
+	GeneratedAt time.Time
+	Tables      []ChartTable
+}
+
+// ChartTable is the data of a chart as labelled rows, one group column per
+// dimension and one value column per metric. Error is set instead when the
+// chart failed to run.
+type ChartTable struct {
+	Name       string
+	Dimensions []string
+	Metrics    []string
+	Groups     [][]string
+	Values     [][]float64
+	Truncated  bool
+	Error      string
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// Share grants read-only access to a dashboard or chart to anyone holding its
+// token, until it expires or is revoked. Locked pins dashboard filters: a
+// values filter can only be narrowed to a subset of its locked values, a date
+// range can't be changed at all.
+type Share struct {
+	ID        int
+	Name      string
+	Kind      EntityKind
+	TargetID  int
+	Locked    map[string]FilterValue
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
@@ -1,5 +1,10 @@
 package model
 
+import (
+	"fmt"
+	"time"
+)
+
 type SourceType string
 
 const (
@@ -8,13 +13,52 @@ const (
 )
 
 type Source struct {
-	ID     int
-	Name   string
-	Type   SourceType
-	Config SourceConfig
+	ID        int
+	Name      string
+	Type      SourceType
+	Config    SourceConfig
+	CreatedBy *int
+	UpdatedBy *int
 }
 
 type SourceConfig struct {
 	DatabaseURI string
 	Datasets    []DatasetConfig
+	Guardrails  *Guardrails
+}
+
+// Guardrails reject chart queries whose estimated plan is too expensive for
+// the source. Zero values disable the respective check, except for the
+// timeouts which fall back to the server defaults.
+type Guardrails struct {
+	MaxCost          float64
+	MaxSeqScanRows   int64
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+}
+
+// NeedsPlan reports whether any guardrail requires an EXPLAIN of the query.
+func (g Guardrails) NeedsPlan() bool {
+	return g.MaxCost > 0 || g.MaxSeqScanRows > 0
+}
+
+// Check returns a readable description of every guardrail the plan violates.
+func (g Guardrails) Check(plan QueryPlan) []string {
+	violations := make([]string, 0)
+
+	if g.MaxCost > 0 && plan.EstimatedCost > g.MaxCost {
+		violations = append(violations, fmt.Sprintf("estimated cost %.0f exceeds the limit of %.0f",
+			plan.EstimatedCost, g.MaxCost))
+	}
+
+	if g.MaxSeqScanRows > 0 {
+		for _, scan := range plan.SeqScans {
+			if scan.Rows > g.MaxSeqScanRows {
+				violations = append(violations, fmt.Sprintf("sequential scan on %s (~%d rows) exceeds the limit of %d rows",
+					scan.Table, scan.Rows, g.MaxSeqScanRows))
+			}
+		}
+	}
+
+	return violations
 }
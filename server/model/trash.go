@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// TrashItem is a soft-deleted entity. It can be restored until PurgeAt, when
+// it is removed for good.
+type TrashItem struct {
+	Kind      EntityKind
+	ID        int
+	Name      string
+	DeletedAt time.Time
+	PurgeAt   time.Time
+}
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// User signs in with email and password for the UI, or with one of their API
+// keys from scripts. The role caps what they can do, grants further limit
+// which entities they see and row rules which rows, based on the attributes.
+type User struct {
+	ID         int
+	Email      string
+	Name       string
+	Role       Role
+	Attributes map[string][]string
+	CreatedAt  time.Time
+}
+
+// APIKey authenticates scripts as its user. Only a hash of the key is stored,
+// the prefix is kept to tell keys apart.
+type APIKey struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	CreatedAt  time.Time
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	ImportCompleted EventType = "import.completed"
+	ImportFailed    EventType = "import.failed"
+)
+
+type EventAction string
+
+const (
+	CREATED  EventAction = "created"
+	UPDATED  EventAction = "updated"
+	DELETED  EventAction = "deleted"
+	RESTORED EventAction = "restored"
+)
+
+var SupportedEventActions = []EventAction{CREATED, UPDATED, DELETED, RESTORED}
+
+// EntityEvent names a lifecycle event of an entity, e.g. "chart.updated".
+func EntityEvent(kind EntityKind, action EventAction) EventType {
+	return EventType(string(kind) + "." + string(action))
+}
+
+// SupportedEventTypes lists every event a webhook can subscribe to.
+func SupportedEventTypes() []EventType {
+	types := make([]EventType, 0, len(SupportedEntityKinds)*len(SupportedEventActions)+2)
+	for _, kind := range SupportedEntityKinds {
+		for _, action := range SupportedEventActions {
+			types = append(types, EntityEvent(kind, action))
+		}
+	}
+
+	return append(types, ImportCompleted, ImportFailed)
+}
+
+// Matches tells whether a webhook event filter selects the event. Filters are
+// event types, a prefix wildcard such as "chart.*", or "*" for everything.
+func (t EventType) Matches(filter string) bool {
+	if filter == "*" || filter == string(t) {
+		return true
+	}
+
+	prefix, found := strings.CutSuffix(filter, "*")
+	return found && strings.HasSuffix(prefix, ".") && strings.HasPrefix(string(t), prefix)
+}
+
+// Webhook subscribes a URL to events. Payloads are signed with the secret, so
+// the receiver can verify they came from us. No event filters means every
+// event.
+type Webhook struct {
+	ID        int
+	Name      string
+	URL       string
+	Secret    string
+	Events    []string
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is an event on its way to a webhook. It is retried until the
+// webhook accepts it or it runs out of attempts, after which it stays on the
+// dead-letter list until retried by hand.
+type WebhookDelivery struct {
+	ID             int
+	WebhookID      int
+	EventID        string
+	Event          EventType
+	Payload        []byte
+	Status         DeliveryStatus
+	Attempts       int
+	ResponseStatus *int
+	Error          string
+	DeliveredAt    *time.Time
+	CreatedAt      time.Time
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	ErrForbidden      = errors.New("forbidden")
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrGrantNotFound  = errors.New("grant not found")
+	ErrInvalidAccess  = errors.New("invalid access")
+	ErrGroupNameTaken = errors.New("group name already in use")
+)
+
+// authorize checks that the user the context acts as has at least the role.
+// Contexts without a user are the server's own work, such as scheduled
+// reports, alerts and shares, which aren't restricted.
+func authorize(ctx context.Context, role model.Role) error {
+	user, ok := CurrentUser(ctx)
+	if !ok || user.Role.Includes(role) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: requires the %s role", ErrForbidden, role)
+}
+
+// object is an entity access can be granted to.
+type object struct {
+	kind model.EntityKind
+	id   int
+}
+
+// hiddenQuery finds the objects that have grants, none of them to a group
+// of the user.
+const hiddenQuery = `
+	SELECT g.kind, g.target_id
+	FROM grants g
+	JOIN unnest($1::text[], $2::int[]) AS o(kind, id) ON o.kind = g.kind AND o.id = g.target_id
+	GROUP BY g.kind, g.target_id
+	HAVING NOT bool_or(g.group_id IN (SELECT group_id FROM group_members WHERE user_id = $3));
+`
+
+// AccessService manages the groups of users and the grants restricting
+// entities to them. Checks against the grants run in the services of the
+// entities, so they apply however an entity is reached.
+type AccessService struct {
+	db *pgxpool.Pool
+}
+
+func NewAccessService(db *pgxpool.Pool) *AccessService {
+	return &AccessService{db: db}
+}
+
+// hidden returns which of the objects the user the context acts as can't
+// see. Admins and the server itself see everything.
+func (s *AccessService) hidden(ctx context.Context, objects ...object) (map[object]bool, error) {
+	hidden := make(map[object]bool)
+
+	user, ok := CurrentUser(ctx)
+	if !ok || user.Role == model.ADMIN || len(objects) == 0 {
+		return hidden, nil
+	}
+
+	kinds, ids := make([]string, len(objects)), make([]int, len(objects))
+	for idx, o := range objects {
+		kinds[idx], ids[idx] = string(o.kind), o.id
+	}
+
+	rows, err := s.db.Query(ctx, hiddenQuery, kinds, ids, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check grants: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o object
+		if err = rows.Scan(&o.kind, &o.id); err != nil {
+			return nil, fmt.Errorf("failed to scan grant row: %w", err)
+		}
+		hidden[o] = true
+	}
+
+	return hidden, rows.Err()
+}
+
+// check fails with notFound unless the user can see all of the objects, so
+// restricted entities look the same as missing ones.
+func (s *AccessService) check(ctx context.Context, notFound error, objects ...object) error {
+	hidden, err := s.hidden(ctx, objects...)
+	if err != nil {
+		return err
+	}
+
+	if len(hidden) > 0 {
+		return notFound
+	}
+
+	return nil
+}
+
+// visible filters the items down to the ones the user can see, given the
+// objects each item is built on.
+func visible[T any](ctx context.Context, access *AccessService, items []T, objects func(T) []object) ([]T, error) {
+	all := make([]object, 0, len(items))
+	for _, item := range items {
+		all = append(all, objects(item)...)
+	}
+
+	hidden, err := access.hidden(ctx, all...)
+	if err != nil || len(hidden) == 0 {
+		return items, err
+	}
+
+	return slices.DeleteFunc(items, func(item T) bool {
+		return slices.ContainsFunc(objects(item), func(o object) bool { return hidden[o] })
+	}), nil
+}
+
+// Groups lists the groups along with their members, which takes the admin
+// role.
+func (s *AccessService) Groups(ctx context.Context) ([]model.Group, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT g.id, g.name,
+			COALESCE(array_agg(m.user_id ORDER BY m.user_id) FILTER (WHERE m.user_id IS NOT NULL), '{}'),
+			g.created_at
+		FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id
+		GROUP BY g.id
+		ORDER BY g.id;
+	`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := make([]model.Group, 0)
+	for rows.Next() {
+		var group model.Group
+		if err = rows.Scan(&group.ID, &group.Name, &group.Members, &group.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan group row: %w", err)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+func (s *AccessService) CreateGroup(ctx context.Context, name string) (model.Group, error) {
+	group := model.Group{Name: name, Members: []int{}}
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return group, err
+	}
+
+	if strings.TrimSpace(name) == "" {
+		return group, fmt.Errorf("%w: group name is required", ErrInvalidAccess)
+	}
+
+	query := `INSERT INTO groups (name) VALUES ($1) RETURNING id, created_at`
+	err := s.db.QueryRow(ctx, query, name).Scan(&group.ID, &group.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+		return group, ErrGroupNameTaken
+	}
+
+	if err != nil {
+		return group, fmt.Errorf("failed to insert group: %w", err)
+	}
+
+	return group, nil
+}
+
+// DeleteGroup removes the group. Groups with grants are kept, as dropping
+// the grants could open the entities to every user.
+func (s *AccessService) DeleteGroup(ctx context.Context, id int) error {
+	err := s.exec(ctx, ErrGroupNotFound, `DELETE FROM groups WHERE id = $1`, id)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return fmt.Errorf("%w: group %d still has grants", ErrInvalidAccess, id)
+	}
+
+	return err
+}
+
+func (s *AccessService) AddMember(ctx context.Context, groupID int, userID int) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO group_members (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := s.db.Exec(ctx, query, groupID, userID)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		if pgErr.ConstraintName == "group_members_group_id_fkey" {
+			return ErrGroupNotFound
+		}
+
+		return ErrUserNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+
+	return nil
+}
+
+func (s *AccessService) RemoveMember(ctx context.Context, groupID int, userID int) error {
+	query := `DELETE FROM group_members WHERE group_id = $1 AND user_id = $2`
+	return s.exec(ctx, ErrUserNotFound, query, groupID, userID)
+}
+
+// Grants lists the groups with access to the entity, which takes the admin
+// role. No grants means every user has access.
+func (s *AccessService) Grants(ctx context.Context, kind model.EntityKind, id int) ([]model.Grant, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, kind, target_id, group_id, created_at
+		FROM grants
+		WHERE kind = $1 AND target_id = $2
+		ORDER BY id;
+	`
+
+	rows, err := s.db.Query(ctx, query, kind, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := make([]model.Grant, 0)
+	for rows.Next() {
+		var grant model.Grant
+		if err = rows.Scan(&grant.ID, &grant.Kind, &grant.TargetID, &grant.GroupID, &grant.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan grant row: %w", err)
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+type GrantReq struct {
+	Kind     model.EntityKind
+	TargetID int
+	GroupID  int
+}
+
+// Grant gives the group access to the entity. The first grant of an entity
+// restricts it to the granted groups, granting the same group twice returns
+// the existing grant.
+func (s *AccessService) Grant(ctx context.Context, req GrantReq) (model.Grant, error) {
+	grant := model.Grant{Kind: req.Kind, TargetID: req.TargetID, GroupID: req.GroupID}
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return grant, err
+	}
+
+	if !slices.Contains(model.SupportedEntityKinds, req.Kind) {
+		return grant, fmt.Errorf("%w: unsupported kind %s", ErrInvalidAccess, req.Kind)
+	}
+
+	var exists bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1 AND deleted_at IS NULL)`, entityTables[req.Kind])
+	if err := s.db.QueryRow(ctx, query, req.TargetID).Scan(&exists); err != nil {
+		return grant, fmt.Errorf("failed to retrieve %s: %w", req.Kind, err)
+	}
+
+	if !exists {
+		return grant, fmt.Errorf("%w: %s %d not found", ErrInvalidAccess, req.Kind, req.TargetID)
+	}
+
+	query = `
+		INSERT INTO grants (kind, target_id, group_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (kind, target_id, group_id) DO UPDATE SET kind = EXCLUDED.kind
+		RETURNING id, created_at;
+	`
+
+	err := s.db.QueryRow(ctx, query, req.Kind, req.TargetID, req.GroupID).Scan(&grant.ID, &grant.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return grant, fmt.Errorf("%w: group %d not found", ErrInvalidAccess, req.GroupID)
+	}
+
+	if err != nil {
+		return grant, fmt.Errorf("failed to insert grant: %w", err)
+	}
+
+	return grant, nil
+}
+
+// Revoke removes the grant. Removing the last grant of an entity opens it to
+// every user again.
+func (s *AccessService) Revoke(ctx context.Context, id int) error {
+	return s.exec(ctx, ErrGrantNotFound, `DELETE FROM grants WHERE id = $1`, id)
+}
+
+// exec runs an admin statement that must affect a row, or fails with
+// notFound.
+func (s *AccessService) exec(ctx context.Context, notFound error, query string, args ...any) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update access: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return notFound
+	}
+
+	return nil
+}
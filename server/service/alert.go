@@ -0,0 +1,790 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service/utils"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	alertTick        = 30 * time.Second
+	minAlertInterval = time.Minute
+	alertBatch       = 10
+	webhookTimeout   = 10 * time.Second
+)
+
+var (
+	ErrAlertNotFound = errors.New("alert not found")
+	ErrInvalidAlert  = errors.New("invalid alert")
+)
+
+const alertColumns = `
+	id, name, chart_id, metric, condition_type, operator, threshold, skip_partial, check_interval, emails, webhooks,
+	enabled, state, last_value, COALESCE(last_error, ''), evaluated_at
+`
+
+// alertChart adds what the chart of an alert is built on, for access checks.
+const alertChart = `
+	LEFT JOIN LATERAL (
+		SELECT c.dataset_id, d.source_id
+		FROM charts c
+		JOIN datasets d ON d.id = c.dataset_id
+		WHERE c.id = alerts.chart_id
+	) t ON TRUE
+`
+
+// AlertService evaluates alerts on chart metrics in the background. An alert
+// notifies its channels once when it starts firing and once when it resolves,
+// and every such transition is kept as its history.
+type AlertService struct {
+	db     *pgxpool.Pool
+	access *AccessService
+	charts *ChartService
+	mailer *Mailer
+	client *http.Client
+	logger *log.Logger
+}
+
+func NewAlertService(db *pgxpool.Pool, access *AccessService, charts *ChartService, mailer *Mailer, logger *log.Logger) *AlertService {
+	return &AlertService{
+		db:     db,
+		access: access,
+		charts: charts,
+		mailer: mailer,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+}
+
+// Start runs the evaluator until ctx is done.
+func (s *AlertService) Start(ctx context.Context) {
+	go s.loop(ctx)
+}
+
+// All lists the alerts on the charts the user sees. An alert reveals the
+// values of its chart, so it is as restricted as the chart.
+func (s *AlertService) All(ctx context.Context) ([]model.Alert, error) {
+	query := `SELECT ` + alertColumns + `, COALESCE(t.dataset_id, 0), COALESCE(t.source_id, 0) FROM alerts` +
+		alertChart + `ORDER BY id`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve alerts: %w", err)
+	}
+	defer rows.Close()
+
+	alerts, objects := make([]model.Alert, 0), make(map[int][]object)
+	for rows.Next() {
+		var datasetID, sourceID int
+		alert, err := scanAlert(rows, &datasetID, &sourceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan alert row: %w", err)
+		}
+		alerts = append(alerts, alert)
+		objects[alert.ID] = chartObjects(model.Chart{ID: alert.ChartID, DatasetID: datasetID}, sourceID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return visible(ctx, s.access, alerts, func(alert model.Alert) []object {
+		return objects[alert.ID]
+	})
+}
+
+func (s *AlertService) Get(ctx context.Context, id int) (model.Alert, error) {
+	query := `SELECT ` + alertColumns + `, COALESCE(t.dataset_id, 0), COALESCE(t.source_id, 0) FROM alerts` +
+		alertChart + `WHERE id = $1`
+
+	var datasetID, sourceID int
+	alert, err := scanAlert(s.db.QueryRow(ctx, query, id), &datasetID, &sourceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return alert, ErrAlertNotFound
+	}
+
+	if err != nil {
+		return alert, fmt.Errorf("failed to retrieve alert: %w", err)
+	}
+
+	chart := model.Chart{ID: alert.ChartID, DatasetID: datasetID}
+	if err = s.access.check(ctx, ErrAlertNotFound, chartObjects(chart, sourceID)...); err != nil {
+		return alert, err
+	}
+
+	return alert, nil
+}
+
+// scanAlert scans the alert columns, followed by the extra destinations.
+func scanAlert(row pgx.Row, extra ...any) (model.Alert, error) {
+	var alert model.Alert
+	var interval int
+
+	dest := []any{&alert.ID, &alert.Name, &alert.ChartID, &alert.Metric, &alert.Condition.Type,
+		&alert.Condition.Operator, &alert.Condition.Value, &alert.SkipPartial, &interval, &alert.Emails,
+		&alert.Webhooks, &alert.Enabled, &alert.State, &alert.LastValue, &alert.LastError, &alert.EvaluatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	alert.Interval = time.Duration(interval) * time.Second
+
+	return alert, err
+}
+
+type AlertReq struct {
+	ID          int
+	Name        string
+	ChartID     int
+	Metric      string
+	Condition   model.AlertCondition
+	SkipPartial bool
+	Interval    time.Duration
+	Emails      []string
+	Webhooks    []string
+	Enabled     bool
+}
+
+// Create adds the alert in the ok state. It is first evaluated on the next
+// tick of the evaluator.
+func (s *AlertService) Create(ctx context.Context, req AlertReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	req, err := s.validate(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO alerts (name, chart_id, metric, condition_type, operator, threshold, skip_partial, check_interval,
+			emails, webhooks, enabled, state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id;
+	`
+
+	var id int
+	err = s.db.QueryRow(ctx, query, req.Name, req.ChartID, req.Metric, req.Condition.Type, req.Condition.Operator,
+		req.Condition.Value, req.SkipPartial, int(req.Interval.Seconds()), req.Emails, req.Webhooks, req.Enabled,
+		model.OK).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert alert: %w", err)
+	}
+
+	return id, nil
+}
+
+// Update replaces the alert. Its state is kept, so a firing alert whose
+// condition no longer holds resolves on its next evaluation.
+func (s *AlertService) Update(ctx context.Context, req AlertReq) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if _, err := s.Get(ctx, req.ID); err != nil {
+		return err
+	}
+
+	req, err := s.validate(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE alerts
+		SET name = $2, chart_id = $3, metric = $4, condition_type = $5, operator = $6, threshold = $7,
+			skip_partial = $8, check_interval = $9, emails = $10, webhooks = $11, enabled = $12
+		WHERE id = $1;
+	`
+
+	tag, err := s.db.Exec(ctx, query, req.ID, req.Name, req.ChartID, req.Metric, req.Condition.Type,
+		req.Condition.Operator, req.Condition.Value, req.SkipPartial, int(req.Interval.Seconds()), req.Emails,
+		req.Webhooks, req.Enabled)
+	if err != nil {
+		return fmt.Errorf("failed to update alert: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAlertNotFound
+	}
+
+	return nil
+}
+
+// Delete removes the alert along with its history.
+func (s *AlertService) Delete(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM alerts WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete alert: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAlertNotFound
+	}
+
+	return nil
+}
+
+// validate checks the alert against its chart and returns it with empty
+// channel lists in place of missing ones.
+func (s *AlertService) validate(ctx context.Context, req AlertReq) (AlertReq, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return req, fmt.Errorf("%w: name is required", ErrInvalidAlert)
+	}
+
+	if req.Interval < minAlertInterval {
+		return req, fmt.Errorf("%w: interval must be at least %s", ErrInvalidAlert, minAlertInterval)
+	}
+
+	if !slices.Contains(model.SupportedAlertConditions, req.Condition.Type) {
+		return req, fmt.Errorf("%w: unknown condition %s", ErrInvalidAlert, req.Condition.Type)
+	}
+
+	if !slices.Contains(model.SupportedConditions, req.Condition.Operator) {
+		return req, fmt.Errorf("%w: unknown operator %s", ErrInvalidAlert, req.Condition.Operator)
+	}
+
+	if len(req.Emails)+len(req.Webhooks) == 0 {
+		return req, fmt.Errorf("%w: at least one email or webhook is required", ErrInvalidAlert)
+	}
+
+	for _, email := range req.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return req, fmt.Errorf("%w: invalid email %s", ErrInvalidAlert, email)
+		}
+	}
+
+	for _, webhook := range req.Webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return req, fmt.Errorf("%w: invalid webhook %s", ErrInvalidAlert, webhook)
+		}
+	}
+
+	chart, err := s.charts.Get(ctx, req.ChartID)
+	if err != nil {
+		return req, fmt.Errorf("%w: chart %d not found", ErrInvalidAlert, req.ChartID)
+	}
+
+	if _, err = alertMetric(chart, model.Alert{Metric: req.Metric, Condition: req.Condition, SkipPartial: req.SkipPartial}); err != nil {
+		return req, fmt.Errorf("%w: %s", ErrInvalidAlert, err)
+	}
+
+	if req.Emails == nil {
+		req.Emails = []string{}
+	}
+
+	if req.Webhooks == nil {
+		req.Webhooks = []string{}
+	}
+
+	return req, nil
+}
+
+// alertMetric returns the index of the metric of the alert on the chart.
+// Only charts without dimensions, or with a single date dimension, have a
+// latest value to watch.
+func alertMetric(chart model.Chart, alert model.Alert) (int, error) {
+	idx := slices.Index(chart.Config.Metrics, alert.Metric)
+	if idx < 0 {
+		return 0, fmt.Errorf("metric %s is not on chart %d", alert.Metric, chart.ID)
+	}
+
+	if len(chart.Config.Dimensions) > 1 {
+		return 0, errors.New("alerts need a chart with at most one dimension")
+	}
+
+	dated := false
+	if len(chart.Config.Dimensions) == 1 {
+		if _, precision := utils.ParseColumn(chart.Config.Dimensions[0]); precision == "" {
+			return 0, errors.New("the dimension of the chart must be a date bucket")
+		}
+		dated = true
+	}
+
+	if !dated && (alert.Condition.Type != model.ValueCondition || alert.SkipPartial) {
+		return 0, errors.New("comparing periods needs a chart with a date dimension")
+	}
+
+	return idx, nil
+}
+
+// History returns the transitions of the alert, most recent first.
+func (s *AlertService) History(ctx context.Context, id int, limit int) ([]model.AlertEvent, error) {
+	query := `
+		SELECT id, alert_id, state, COALESCE(period, ''), value, previous, observed, message,
+			COALESCE(notify_error, ''), created_at
+		FROM alert_events
+		WHERE alert_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, query, id, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve alert history: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]model.AlertEvent, 0)
+	for rows.Next() {
+		var e model.AlertEvent
+		err = rows.Scan(&e.ID, &e.AlertID, &e.State, &e.Period, &e.Value, &e.Previous, &e.Observed, &e.Message,
+			&e.NotifyError, &e.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan alert event row: %w", err)
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Evaluate checks the alert right away, outside its interval, and returns
+// it with the outcome.
+func (s *AlertService) Evaluate(ctx context.Context, id int) (model.Alert, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return model.Alert{}, err
+	}
+
+	alert, err := s.Get(ctx, id)
+	if err != nil {
+		return alert, err
+	}
+
+	if err = s.evaluate(ctx, alert); err != nil {
+		return alert, err
+	}
+
+	return s.Get(ctx, id)
+}
+
+func (s *AlertService) loop(ctx context.Context) {
+	ticker := time.NewTicker(alertTick)
+	defer ticker.Stop()
+
+	for {
+		if err := s.evaluateDue(ctx); err != nil {
+			s.logger.Printf("alerts: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluateDue evaluates the enabled alerts whose interval passed. Claiming an
+// alert stamps its evaluation time, so other instances skip it until its next
+// interval.
+func (s *AlertService) evaluateDue(ctx context.Context) error {
+	query := `
+		UPDATE alerts
+		SET evaluated_at = NOW()
+		WHERE id IN (
+			SELECT id
+			FROM alerts
+			WHERE enabled AND (evaluated_at IS NULL OR evaluated_at <= NOW() - make_interval(secs => check_interval))
+			ORDER BY evaluated_at NULLS FIRST
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + alertColumns
+
+	rows, err := s.db.Query(ctx, query, alertBatch)
+	if err != nil {
+		return fmt.Errorf("failed to claim alerts: %w", err)
+	}
+
+	alerts := make([]model.Alert, 0)
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan alert row: %w", err)
+		}
+		alerts = append(alerts, alert)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to claim alerts: %w", err)
+	}
+
+	for _, alert := range alerts {
+		if err = s.evaluate(ctx, alert); err != nil {
+			s.logger.Printf("alert %d: %v", alert.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// observation is the latest period of the watched metric.
+type observation struct {
+	period   string
+	value    float64
+	previous *float64
+	observed float64
+}
+
+// evaluate runs the chart of the alert and moves it between states. Failing
+// to run the chart is kept as the last error and leaves the state alone.
+func (s *AlertService) evaluate(ctx context.Context, alert model.Alert) error {
+	obs, err := s.observe(ctx, alert)
+	if err != nil {
+		query := `UPDATE alerts SET last_error = $2, evaluated_at = NOW() WHERE id = $1`
+		if _, err = s.db.Exec(ctx, query, alert.ID, err.Error()); err != nil {
+			return fmt.Errorf("failed to update alert: %w", err)
+		}
+		return nil
+	}
+
+	state := alert.State
+	breached := compare(obs.observed, alert.Condition.Operator, alert.Condition.Value)
+	switch {
+	case breached && alert.State != model.FIRING:
+		state = model.FIRING
+	case !breached && alert.State == model.FIRING:
+		state = model.RESOLVED
+	}
+
+	if state == alert.State {
+		query := `UPDATE alerts SET last_value = $2, last_error = NULL, evaluated_at = NOW() WHERE id = $1`
+		if _, err = s.db.Exec(ctx, query, alert.ID, obs.value); err != nil {
+			return fmt.Errorf("failed to update alert: %w", err)
+		}
+		return nil
+	}
+
+	event, err := s.transition(ctx, alert, state, obs)
+	if err != nil || event.ID == 0 {
+		return err
+	}
+
+	if err = s.notify(ctx, alert, event); err != nil {
+		s.logger.Printf("alert %d, event %d: %v", alert.ID, event.ID, err)
+
+		query := `UPDATE alert_events SET notify_error = $2 WHERE id = $1`
+		if _, err = s.db.Exec(ctx, query, event.ID, err.Error()); err != nil {
+			return fmt.Errorf("failed to update alert event: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// transition moves the alert to the state and records the event. The move
+// only applies if the alert is still in the state it was read in, so an alert
+// evaluated twice at once notifies once; the event ID is zero otherwise.
+func (s *AlertService) transition(ctx context.Context, alert model.Alert, state model.AlertState, obs observation) (model.AlertEvent, error) {
+	event := model.AlertEvent{
+		AlertID:  alert.ID,
+		State:    state,
+		Period:   obs.period,
+		Value:    obs.value,
+		Previous: obs.previous,
+		Observed: obs.observed,
+		Message:  describe(alert, state, obs),
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return event, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	query := `
+		UPDATE alerts
+		SET state = $2, last_value = $3, last_error = NULL, evaluated_at = NOW()
+		WHERE id = $1 AND state = $4
+	`
+
+	tag, err := tx.Exec(ctx, query, alert.ID, state, obs.value, alert.State)
+	if err != nil {
+		return event, fmt.Errorf("failed to update alert: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return event, nil
+	}
+
+	query = `
+		INSERT INTO alert_events (alert_id, state, period, value, previous, observed, message)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7)
+		RETURNING id, created_at
+	`
+
+	err = tx.QueryRow(ctx, query, event.AlertID, event.State, event.Period, event.Value, event.Previous,
+		event.Observed, event.Message).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return event, fmt.Errorf("failed to insert alert event: %w", err)
+	}
+
+	return event, tx.Commit(ctx)
+}
+
+// observe runs the chart of the alert, without its shaping, and picks the
+// latest period of its metric, along with the period before it.
+func (s *AlertService) observe(ctx context.Context, alert model.Alert) (observation, error) {
+	chart, err := s.charts.Get(ctx, alert.ChartID)
+	if err != nil {
+		return observation{}, err
+	}
+
+	metric, err := alertMetric(chart, alert)
+	if err != nil {
+		return observation{}, err
+	}
+
+	table, err := s.charts.Table(ctx, unshaped(chart), nil)
+	if err != nil {
+		return observation{}, err
+	}
+
+	type point struct {
+		period string
+		value  float64
+	}
+
+	points := make([]point, 0)
+	for row, value := range table.Values[metric] {
+		var p point
+		p.value = value
+
+		// rows outside the top N, or without a date, belong to no period
+		if len(table.Groups) > 0 {
+			p.period = table.Groups[0][row]
+			if _, err := time.Parse(time.DateOnly, p.period); err != nil {
+				continue
+			}
+		}
+
+		points = append(points, p)
+	}
+
+	// date buckets sort by their labels, whatever the order of the chart
+	slices.SortStableFunc(points, func(a, b point) int { return strings.Compare(a.period, b.period) })
+
+	if alert.SkipPartial {
+		_, precision := utils.ParseColumn(chart.Config.Dimensions[0])
+
+		// the buckets end at midnight in the time zone they were built in
+		cal, err := calendar(chart.Config.Calendar)
+		if err != nil {
+			return observation{}, err
+		}
+
+		now := time.Now()
+		for len(points) > 0 {
+			_, end, err := utils.PeriodRange(points[len(points)-1].period, precision, cal)
+			if err != nil || !end.After(now) {
+				break
+			}
+			points = points[:len(points)-1]
+		}
+	}
+
+	if len(points) == 0 {
+		return observation{}, errors.New("the chart returned no rows")
+	}
+
+	latest := points[len(points)-1]
+	if math.IsNaN(latest.value) {
+		return observation{}, fmt.Errorf("no value for period %s", latest.period)
+	}
+
+	obs := observation{period: latest.period, value: latest.value, observed: latest.value}
+	if len(points) > 1 && !math.IsNaN(points[len(points)-2].value) {
+		obs.previous = &points[len(points)-2].value
+	}
+
+	if alert.Condition.Type == model.ValueCondition {
+		return obs, nil
+	}
+
+	if obs.previous == nil || *obs.previous == 0 {
+		return observation{}, fmt.Errorf("no previous value to compare period %s with", latest.period)
+	}
+
+	obs.observed = percentChange(obs.value, *obs.previous)
+	if alert.Condition.Type == model.AbsChangeCondition {
+		obs.observed = math.Abs(obs.observed)
+	}
+
+	return obs, nil
+}
+
+// unshaped drops what narrows the rows of the chart down, its sort, limit,
+// top N and having conditions, which may leave out the latest periods. The
+// date dimension is sorted newest first, so the row cap drops the oldest ones.
+func unshaped(chart model.Chart) model.Chart {
+	config := chart.Config
+	config.Sort, config.Limit, config.TopN, config.Having = nil, 0, 0, nil
+
+	if len(config.Dimensions) == 1 {
+		config.Sort = &model.ChartSort{Field: config.Dimensions[0], Direction: "desc"}
+	}
+
+	chart.Config = config
+	return chart
+}
+
+func compare(value float64, operator string, threshold float64) bool {
+	switch operator {
+	case "=":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	}
+
+	return false
+}
+
+// describe explains the event, e.g. "Revenue drop is firing: SUM(revenue)
+// changed -23.4% in 2024-05-01 (percent_change < -20)".
+func describe(alert model.Alert, state model.AlertState, obs observation) string {
+	var what string
+	switch alert.Condition.Type {
+	case model.ValueCondition:
+		what = fmt.Sprintf("%s is %s", alert.Metric, formatNumber(obs.value))
+	default:
+		what = fmt.Sprintf("%s changed %s%%", alert.Metric, formatNumber(percentChange(obs.value, *obs.previous)))
+	}
+
+	if obs.period != "" {
+		what += " in " + obs.period
+	}
+
+	condition := fmt.Sprintf("%s %s %s", alert.Condition.Type, alert.Condition.Operator, formatNumber(alert.Condition.Value))
+	return fmt.Sprintf("%s is %s: %s (%s)", alert.Name, state, what, condition)
+}
+
+func percentChange(value float64, previous float64) float64 {
+	return (value - previous) / math.Abs(previous) * 100
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
+
+// alertPayload is the body posted to the webhooks of an alert.
+type alertPayload struct {
+	AlertID   int                   `json:"alertId"`
+	Alert     string                `json:"alert"`
+	ChartID   int                   `json:"chartId"`
+	Metric    string                `json:"metric"`
+	State     string                `json:"state"`
+	Period    string                `json:"period,omitempty"`
+	Value     float64               `json:"value"`
+	Previous  *float64              `json:"previous,omitempty"`
+	Observed  float64               `json:"observed"`
+	Condition alertConditionPayload `json:"condition"`
+	Message   string                `json:"message"`
+	At        time.Time             `json:"at"`
+}
+
+type alertConditionPayload struct {
+	Type     string  `json:"type"`
+	Operator string  `json:"operator"`
+	Value    float64 `json:"value"`
+}
+
+// notify sends the event to every channel of the alert, returning the
+// failures of all of them.
+func (s *AlertService) notify(ctx context.Context, alert model.Alert, event model.AlertEvent) error {
+	var errs []error
+
+	if len(alert.Emails) > 0 {
+		subject := fmt.Sprintf("[%s] %s", strings.ToUpper(string(event.State)), alert.Name)
+		if err := s.mailer.Send(alert.Emails, subject, event.Message+"\r\n"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	body, err := json.Marshal(alertPayload{
+		AlertID:  alert.ID,
+		Alert:    alert.Name,
+		ChartID:  alert.ChartID,
+		Metric:   alert.Metric,
+		State:    string(event.State),
+		Period:   event.Period,
+		Value:    event.Value,
+		Previous: event.Previous,
+		Observed: event.Observed,
+		Condition: alertConditionPayload{
+			Type:     alert.Condition.Type,
+			Operator: alert.Condition.Operator,
+			Value:    alert.Condition.Value,
+		},
+		Message: event.Message,
+		At:      event.CreatedAt,
+	})
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for _, webhook := range alert.Webhooks {
+		if err = s.post(ctx, webhook, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *AlertService) post(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to call webhook %s: %w", target, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook %s: %w", target, err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook %s responded with %s", target, rsp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QueryCache keeps recent chart query results in memory, keyed by source and
+// SQL, so identical queries from dashboards and their live viewers hit the
+// source once per refresh.
+type QueryCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedResult
+}
+
+type cachedResult struct {
+	groups   [][]string
+	values   [][]float64
+	storedAt time.Time
+}
+
+// NewQueryCache creates a cache whose entries are dropped once older than
+// ttl. Callers may still ask for fresher results than that.
+func NewQueryCache(ttl time.Duration) *QueryCache {
+	return &QueryCache{ttl: ttl, entries: make(map[string]cachedResult)}
+}
+
+// Get returns the result of the query on the source if it was stored less
+// than maxAge ago.
+func (c *QueryCache) Get(sourceID int, query string, maxAge time.Duration) ([][]string, [][]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[cacheKey(sourceID, query)]
+	if !found || time.Since(entry.storedAt) >= min(maxAge, c.ttl) {
+		return nil, nil, false
+	}
+
+	return entry.groups, entry.values, true
+}
+
+// Put stores the result of the query on the source. The result is shared
+// between readers and must not be modified afterwards.
+func (c *QueryCache) Put(sourceID int, query string, groups [][]string, values [][]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.Sub(entry.storedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+
+	c.entries[cacheKey(sourceID, query)] = cachedResult{groups: groups, values: values, storedAt: now}
+}
+
+func cacheKey(sourceID int, query string) string {
+	return fmt.Sprintf("%d/%s", sourceID, query)
+}
@@ -2,26 +2,49 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/amukoski/aaa/model"
 	"github.com/amukoski/aaa/service/utils"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 type Chart interface {
 	Schema() model.ChartSchema
-	Render(name string, groups [][]string, values [][]float64) (any, error)
+	Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error)
+}
+
+var weekdays = []time.Weekday{
+	time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday,
 }
 
 type ChartService struct {
 	db       *pgxpool.Pool
+	access   *AccessService
 	sources  *SourceService
 	datasets *DatasetService
+	queries  *QueryService
+	cache    *QueryCache
+	events   *WebhookService
+	maxRows  int
 	registry map[model.ChartType]Chart
 }
 
-func NewChartService(db *pgxpool.Pool, src *SourceService, ds *DatasetService, charts ...Chart) *ChartService {
+// ChartResult holds the rendered chart options. Truncated is set when the
+// query returned more rows than the server-wide row cap.
+type ChartResult struct {
+	Options   any
+	Truncated bool
+}
+
+func NewChartService(db *pgxpool.Pool, access *AccessService, src *SourceService, ds *DatasetService, queries *QueryService, cache *QueryCache, events *WebhookService, maxRows int, charts ...Chart) *ChartService {
 	registry := make(map[model.ChartType]Chart)
 	for _, chart := range charts {
 		schema := chart.Schema()
@@ -30,29 +53,51 @@ func NewChartService(db *pgxpool.Pool, src *SourceService, ds *DatasetService, c
 
 	return &ChartService{
 		db:       db,
+		access:   access,
 		sources:  src,
 		datasets: ds,
+		queries:  queries,
+		cache:    cache,
+		events:   events,
+		maxRows:  maxRows,
 		registry: registry,
 	}
 }
 
 func (s *ChartService) All(ctx context.Context) ([]model.Chart, error) {
-	rows, err := s.db.Query(ctx, `SELECT id, name, dataset_id, type FROM charts`)
+	query := `
+		SELECT c.id, c.name, c.dataset_id, c.type, d.source_id
+		FROM charts c
+		JOIN datasets d ON d.id = c.dataset_id
+		WHERE c.deleted_at IS NULL
+	`
+
+	rows, err := s.db.Query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve charts: %w", err)
 	}
 	defer rows.Close()
 
-	charts := make([]model.Chart, 0)
+	charts, sources := make([]model.Chart, 0), make(map[int]int)
 	for rows.Next() {
 		var chart model.Chart
-		if err = rows.Scan(&chart.ID, &chart.Name, &chart.DatasetID, &chart.Type); err != nil {
+		var sourceID int
+		if err = rows.Scan(&chart.ID, &chart.Name, &chart.DatasetID, &chart.Type, &sourceID); err != nil {
 			return nil, fmt.Errorf("failed to scan chart row: %w", err)
 		}
 		charts = append(charts, chart)
+		sources[chart.DatasetID] = sourceID
 	}
 
-	return charts, nil
+	return visible(ctx, s.access, charts, func(chart model.Chart) []object {
+		return chartObjects(chart, sources[chart.DatasetID])
+	})
+}
+
+// chartObjects lists what a chart is built on, a chart is as restricted as
+// its dataset and source.
+func chartObjects(chart model.Chart, sourceID int) []object {
+	return []object{{model.CHART, chart.ID}, {model.DATASET, chart.DatasetID}, {model.SOURCE, sourceID}}
 }
 
 func (s *ChartService) AllTypes() []model.ChartType {
@@ -60,15 +105,26 @@ func (s *ChartService) AllTypes() []model.ChartType {
 }
 
 func (s *ChartService) Get(ctx context.Context, id int) (model.Chart, error) {
-	query := `SELECT id, name, dataset_id, type, config FROM charts WHERE id = $1`
+	query := `
+		SELECT c.id, c.name, c.dataset_id, c.type, c.config, c.created_by, c.updated_by, c.updated_at, d.source_id
+		FROM charts c
+		JOIN datasets d ON d.id = c.dataset_id
+		WHERE c.id = $1 AND c.deleted_at IS NULL
+	`
 
 	var chart model.Chart
+	var sourceID int
 	err := s.db.QueryRow(ctx, query, id).
-		Scan(&chart.ID, &chart.Name, &chart.DatasetID, &chart.Type, &chart.Config)
+		Scan(&chart.ID, &chart.Name, &chart.DatasetID, &chart.Type, &chart.Config, &chart.CreatedBy, &chart.UpdatedBy,
+			&chart.UpdatedAt, &sourceID)
 	if err != nil {
 		return chart, fmt.Errorf("failed to retrieve chart: %w", err)
 	}
 
+	if err = s.access.check(ctx, ErrChartNotFound, chartObjects(chart, sourceID)...); err != nil {
+		return chart, err
+	}
+
 	return chart, nil
 }
 
@@ -88,12 +144,24 @@ type CreateChartReq struct {
 	Dimensions []string
 	Metrics    []string
 	Filters    []string
+	Sort       *model.ChartSort
+	Limit      int
+	TopN       int
+	Having     []model.Having
+	GapFill    string
+	Calendar   *model.ChartCalendar
+	Transforms []model.Transform
+	DrillPath  []string
 }
 
 func (s *ChartService) Create(ctx context.Context, req CreateChartReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
 	query := `
-		INSERT INTO charts (dataset_id, name, type, config)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO charts (dataset_id, name, type, config, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $5)
 		RETURNING id;
 	`
 
@@ -101,73 +169,685 @@ func (s *ChartService) Create(ctx context.Context, req CreateChartReq) (int, err
 		Dimensions: req.Dimensions,
 		Metrics:    req.Metrics,
 		Filters:    req.Filters,
+		Sort:       req.Sort,
+		Limit:      req.Limit,
+		TopN:       req.TopN,
+		Having:     req.Having,
+		GapFill:    req.GapFill,
+		Calendar:   req.Calendar,
+		Transforms: req.Transforms,
+		DrillPath:  req.DrillPath,
+	}
+
+	dataset, err := s.datasets.Get(ctx, req.DatasetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve dataset: %w", err)
+	}
+
+	if err = validateConfig(config, dataset.Config); err != nil {
+		return 0, err
 	}
 
 	var id int
-	err := s.db.QueryRow(ctx, query, req.DatasetID, req.Name, req.Type, config).Scan(&id)
+	err = s.db.QueryRow(ctx, query, req.DatasetID, req.Name, req.Type, config, actor(ctx)).Scan(&id)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create chart: %w", err)
 	}
 
+	s.events.entityCreated(ctx, model.CHART, id, req.Name)
 	return id, nil
 }
 
-func (s *ChartService) Delete(ctx context.Context, id int) error {
-	query := `DELETE FROM charts WHERE id = $1;`
-	_, err := s.db.Exec(ctx, query, id)
-	return err
+// Dependents lists the dashboards showing the chart.
+func (s *ChartService) Dependents(ctx context.Context, id int) (model.Dependents, error) {
+	return findDependents(ctx, s.db, model.CHART, id, false)
+}
+
+func (s *ChartService) Delete(ctx context.Context, id int, mode model.DeleteMode) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if err := s.access.check(ctx, pgx.ErrNoRows, object{model.CHART, id}); err != nil {
+		return err
+	}
+
+	deps, err := deleteEntity(ctx, s.db, model.CHART, id, mode, nil)
+	if err != nil {
+		return err
+	}
+
+	s.events.entityDeleted(ctx, model.CHART, id, mode, deps)
+	return nil
 }
 
 type ValidateChartReq struct {
+	ChartID    int
 	DatasetID  int
 	Name       string
 	Type       string
 	Dimensions []string
 	Metrics    []string
 	Filters    []string
+	// Conditions are added by dashboards on top of the chart filters
+	Conditions []utils.Filter
+	Sort       *model.ChartSort
+	Limit      int
+	TopN       int
+	Having     []model.Having
+	GapFill    string
+	Calendar   *model.ChartCalendar
+	Transforms []model.Transform
+	DrillPath  []string
 }
 
-func (s *ChartService) Validate(ctx context.Context, req ValidateChartReq) (any, error) {
-	chart, found := s.registry[model.ChartType(req.Type)]
-	if !found {
-		return model.ChartSchema{}, fmt.Errorf("unknown chart type: %s", req.Type)
+func validateConfig(config model.ChartConfig, dataset model.DatasetConfig) error {
+	if config.Limit < 0 {
+		return fmt.Errorf("invalid limit: %d", config.Limit)
+	}
+
+	if config.TopN < 0 {
+		return fmt.Errorf("invalid top N: %d", config.TopN)
 	}
 
-	var result map[string]interface{}
+	if config.TopN > 0 && (len(config.Dimensions) == 0 || len(config.Metrics) == 0) {
+		return errors.New("top N requires at least one dimension and one metric")
+	}
+
+	for _, filter := range config.Filters {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid filter: %s", filter)
+		}
+
+		if !slices.Contains(model.SupportedFilters, parts[1]) {
+			return fmt.Errorf("unsupported filter operator: %s", parts[1])
+		}
+	}
+
+	for _, having := range config.Having {
+		_, saved := dataset.SavedMetric(having.Metric)
+		if !saved && !slices.Contains(config.Metrics, having.Metric) {
+			return fmt.Errorf("having metric is not a chart or saved metric: %s", having.Metric)
+		}
+
+		if !slices.Contains(model.SupportedConditions, having.Operator) {
+			return fmt.Errorf("unsupported having operator: %s", having.Operator)
+		}
+	}
+
+	if config.GapFill != "" {
+		if !slices.Contains(model.SupportedGapFills, config.GapFill) {
+			return fmt.Errorf("unsupported gap fill: %s", config.GapFill)
+		}
+
+		if len(config.Dimensions) == 0 {
+			return errors.New("gap fill requires a date dimension")
+		}
+
+		if _, precision := utils.ParseColumn(config.Dimensions[0]); precision == "" {
+			return errors.New("gap fill requires the first dimension to be a date with precision")
+		}
+	}
+
+	if _, err := calendar(config.Calendar); err != nil {
+		return err
+	}
+
+	if err := validateTransforms(config); err != nil {
+		return err
+	}
+
+	if err := validateDrillPath(config.DrillPath, dataset); err != nil {
+		return err
+	}
+
+	if len(dataset.Rules) > 0 {
+		if err := validateRuledFields(config, dataset); err != nil {
+			return err
+		}
+	}
+
+	if config.Sort == nil {
+		return nil
+	}
+
+	if utils.FieldAlias(config.Sort.Field, config.Dimensions, config.Metrics) == "" {
+		return fmt.Errorf("sort field is not a chart dimension or metric: %s", config.Sort.Field)
+	}
+
+	if !slices.Contains(model.SupportedDirections, strings.ToLower(config.Sort.Direction)) {
+		return fmt.Errorf("unsupported sort direction: %s", config.Sort.Direction)
+	}
+
+	return nil
+}
+
+// preparedQuery is a validated chart request compiled to SQL.
+type preparedQuery struct {
+	chart   Chart
+	config  model.ChartConfig
+	dataset model.Dataset
+	source  model.Source
+	query   string
+}
 
+func (s *ChartService) prepare(ctx context.Context, req ValidateChartReq) (preparedQuery, error) {
 	dataset, err := s.datasets.Get(ctx, req.DatasetID)
 	if err != nil {
-		return result, fmt.Errorf("failed to retrieve dataset: %w", err)
+		return preparedQuery{}, fmt.Errorf("failed to retrieve dataset: %w", err)
 	}
 
 	source, _, err := s.sources.Get(ctx, dataset.SourceID)
 	if err != nil {
-		return result, fmt.Errorf("failed to retrieve source: %w", err)
+		return preparedQuery{}, fmt.Errorf("failed to retrieve source: %w", err)
+	}
+
+	return s.compile(ctx, req, dataset, source)
+}
+
+// compile validates the chart against its dataset and builds its query,
+// held to the row rules of the user. Results are cached by the query, so
+// every rule set gets its own.
+func (s *ChartService) compile(ctx context.Context, req ValidateChartReq, dataset model.Dataset, source model.Source) (preparedQuery, error) {
+	var prepared preparedQuery
+
+	chart, found := s.registry[model.ChartType(req.Type)]
+	if !found {
+		return prepared, fmt.Errorf("unknown chart type: %s", req.Type)
+	}
+
+	config := model.ChartConfig{
+		Dimensions: req.Dimensions,
+		Metrics:    req.Metrics,
+		Filters:    req.Filters,
+		Sort:       req.Sort,
+		Limit:      req.Limit,
+		TopN:       req.TopN,
+		Having:     req.Having,
+		GapFill:    req.GapFill,
+		Calendar:   req.Calendar,
+		Transforms: req.Transforms,
+		DrillPath:  req.DrillPath,
+	}
+
+	if err := validateConfig(config, dataset.Config); err != nil {
+		return prepared, err
+	}
+
+	cal, _ := calendar(config.Calendar)
+
+	// ask for one row above the cap to find out whether the result is truncated
+	limit := s.maxRows + 1
+	if config.Limit > 0 && config.Limit <= s.maxRows {
+		limit = config.Limit
+	}
+
+	query := utils.BuildSQLQuery(utils.Query{
+		Table:      dataset.Config.TableName(),
+		Dimensions: config.Dimensions,
+		Metrics:    dataset.Config.MetricExpressions(config.Metrics),
+		Filters:    config.Filters,
+		Conditions: req.Conditions,
+		Columns:    dataset.Config.Columns,
+		SortField:  dataset.Config.MetricExpression(sortField(config.Sort)),
+		SortDesc:   config.Sort != nil && strings.EqualFold(config.Sort.Direction, "desc"),
+		Limit:      limit,
+		TopN:       config.TopN,
+		Having:     conditions(config.Having, dataset.Config),
+		Calendar:   cal,
+		Transforms: transforms(config.Transforms, config.Metrics),
+		Rules:      rowRules(ctx, dataset.Config),
+	})
+
+	return preparedQuery{chart: chart, config: config, dataset: dataset, source: source, query: query}, nil
+}
+
+// Validate runs a chart that is being edited, which takes the editor role.
+func (s *ChartService) Validate(ctx context.Context, req ValidateChartReq) (ChartResult, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return ChartResult{}, err
+	}
+
+	return s.validate(ctx, req)
+}
+
+func (s *ChartService) validate(ctx context.Context, req ValidateChartReq) (ChartResult, error) {
+	prepared, err := s.prepare(ctx, req)
+	if err != nil {
+		return ChartResult{}, err
 	}
 
-	conn := s.db
-	if source.Type == model.POSTGRES {
-		conn, err = pgxpool.Connect(ctx, source.Config.DatabaseURI)
+	conn, release, err := s.sources.Connect(ctx, prepared.source)
+	if err != nil {
+		return ChartResult{}, err
+	}
+	defer release()
+
+	groups, values, err := s.query(ctx, conn, prepared, req.ChartID)
+	if err != nil {
+		return ChartResult{}, err
+	}
+
+	return s.render(prepared, req.Name, groups, values)
+}
+
+// cached returns the result of the prepared query if the cache holds one
+// younger than maxAge, and records the hit in the query log.
+func (s *ChartService) cached(ctx context.Context, prepared preparedQuery, chartID int, maxAge time.Duration) ([][]string, [][]float64, bool) {
+	groups, values, hit := s.cache.Get(prepared.source.ID, prepared.query, maxAge)
+	if !hit {
+		return nil, nil, false
+	}
+
+	entry := model.QueryLog{
+		DatasetID: prepared.dataset.ID,
+		SourceID:  prepared.source.ID,
+		SQL:       prepared.query,
+		Rows:      rowCount(groups, values),
+		CacheHit:  true,
+	}
+
+	if chartID > 0 {
+		entry.ChartID = &chartID
+	}
+
+	s.queries.Record(ctx, entry)
+	return groups, values, true
+}
+
+// query runs the prepared query on the source pool and records it in the
+// query log, unless a guardrail rejected it before it ran. Results are kept
+// in the query cache for dashboards.
+func (s *ChartService) query(ctx context.Context, conn *pgxpool.Pool, prepared preparedQuery, chartID int) ([][]string, [][]float64, error) {
+	config, query := prepared.config, prepared.query
+
+	var groups [][]string
+	var values [][]float64
+	var started time.Time
+
+	err := s.sources.readOnly(ctx, conn, prepared.source.Config.Guardrails, func(conn querier) error {
+		if guardrails := prepared.source.Config.Guardrails; guardrails != nil && guardrails.NeedsPlan() {
+			plan, err := explain(ctx, conn, query)
+			if err != nil {
+				return err
+			}
+
+			if violations := guardrails.Check(plan); len(violations) > 0 {
+				return fmt.Errorf("%w: %s", ErrGuardrail, strings.Join(violations, "; "))
+			}
+		}
+
+		var err error
+		started = time.Now()
+		groups, values, err = s.perform(ctx, conn, query, len(config.Dimensions), len(config.Metrics))
+		return err
+	})
+	if errors.Is(err, ErrGuardrail) {
+		return nil, nil, err
+	}
+
+	entry := model.QueryLog{
+		DatasetID: prepared.dataset.ID,
+		SourceID:  prepared.source.ID,
+		SQL:       query,
+		Duration:  time.Since(started),
+		Rows:      rowCount(groups, values),
+	}
+
+	if chartID > 0 {
+		entry.ChartID = &chartID
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	s.queries.Record(ctx, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.cache.Put(prepared.source.ID, query, groups, values)
+	return groups, values, nil
+}
+
+// render turns the query result into chart options.
+func (s *ChartService) render(prepared preparedQuery, name string, groups [][]string, values [][]float64) (ChartResult, error) {
+	var result ChartResult
+	var err error
+
+	var fields model.ChartFields
+	groups, values, fields, result.Truncated = s.shape(prepared, groups, values)
+
+	result.Options, err = prepared.chart.Render(name, fields, groups, values)
+	return result, err
+}
+
+// tabulate turns the query result into labelled rows.
+func (s *ChartService) tabulate(prepared preparedQuery, name string, groups [][]string, values [][]float64) model.ChartTable {
+	table := model.ChartTable{Name: name}
+
+	var fields model.ChartFields
+	table.Groups, table.Values, fields, table.Truncated = s.shape(prepared, groups, values)
+
+	for _, field := range fields.Dimensions {
+		table.Dimensions = append(table.Dimensions, field.Label)
+	}
+
+	for _, field := range fields.Metrics {
+		table.Metrics = append(table.Metrics, field.Label)
+	}
+
+	return table
+}
+
+// shape caps and gap-fills the query result and labels its fields. The outer
+// slices are copied, so the same result can be shaped for several charts.
+func (s *ChartService) shape(prepared preparedQuery, groups [][]string, values [][]float64) ([][]string, [][]float64, model.ChartFields, bool) {
+	config := prepared.config
+
+	groups, values, truncated := truncate(slices.Clone(groups), slices.Clone(values), s.maxRows)
+
+	// the filled periods count against the cap as well
+	if config.GapFill != "" {
+		_, precision := utils.ParseColumn(config.Dimensions[0])
+		groups, values = utils.FillGaps(groups, values, precision, config.GapFill)
+
+		var filled bool
+		groups, values, filled = truncate(groups, values, s.maxRows)
+		truncated = truncated || filled
+	}
+
+	fields := prepared.dataset.Config.ChartFields(config.Dimensions, config.Metrics)
+	for _, t := range config.Transforms {
+		idx := slices.Index(config.Metrics, t.Metric)
+		fields.Metrics[idx] = t.Apply(fields.Metrics[idx])
+	}
+
+	return groups, values, fields, truncated
+}
+
+// Table runs a stored chart like RunChart, but returns its data as labelled
+// rows, e.g. for reports. Recently cached results are reused.
+func (s *ChartService) Table(ctx context.Context, chart model.Chart, filters []string) (model.ChartTable, error) {
+	prepared, err := s.prepare(ctx, chartReq(chart, filters))
+	if err != nil {
+		return model.ChartTable{}, err
+	}
+
+	return s.table(ctx, prepared, chart.ID, chart.Name)
+}
+
+func (s *ChartService) table(ctx context.Context, prepared preparedQuery, chartID int, name string) (model.ChartTable, error) {
+	groups, values, hit := s.cached(ctx, prepared, chartID, s.cache.ttl)
+	if !hit {
+		conn, release, err := s.sources.Connect(ctx, prepared.source)
 		if err != nil {
-			return result, fmt.Errorf("failed to connect to database: %w", err)
+			return model.ChartTable{}, err
+		}
+		defer release()
+
+		if groups, values, err = s.query(ctx, conn, prepared, chartID); err != nil {
+			return model.ChartTable{}, err
 		}
-		defer conn.Close()
 	}
 
-	table := fmt.Sprintf("%s.%s", dataset.Config.Schema, dataset.Config.Table)
-	query := utils.BuildSQLQuery(table, req.Dimensions, req.Metrics, req.Filters, dataset.Config.Columns)
+	return s.tabulate(prepared, name, groups, values), nil
+}
 
-	fmt.Println(fmt.Sprintf("%v", query))
+// Explain compiles the chart query and returns its estimated plan without
+// running it, along with any guardrails of the source the plan would violate.
+func (s *ChartService) Explain(ctx context.Context, req ValidateChartReq) (model.QueryPlan, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return model.QueryPlan{}, err
+	}
 
-	groups, values, err := s.perform(ctx, conn, query, len(req.Dimensions), len(req.Metrics))
+	prepared, err := s.prepare(ctx, req)
 	if err != nil {
-		return result, err
+		return model.QueryPlan{}, err
+	}
+
+	var plan model.QueryPlan
+	err = s.sources.ReadOnly(ctx, prepared.source, func(conn querier) error {
+		plan, err = explain(ctx, conn, prepared.query)
+		return err
+	})
+	if err != nil {
+		return plan, err
+	}
+
+	if guardrails := prepared.source.Config.Guardrails; guardrails != nil {
+		plan.Violations = guardrails.Check(plan)
 	}
 
-	return chart.Render(req.Name, groups, values)
+	return plan, nil
 }
 
-func (s *ChartService) perform(ctx context.Context, conn *pgxpool.Pool, query string, dimensions int, metrics int) ([][]string, [][]float64, error) {
+// validateDrillPath checks the levels a dimension drills through, e.g.
+// region, country and city. Date dimensions drill by precision without one.
+func validateDrillPath(path []string, dataset model.DatasetConfig) error {
+	if len(path) == 1 {
+		return errors.New("drill path requires at least two levels")
+	}
+
+	names := utils.ColumnNames(dataset.Columns)
+	for idx, level := range path {
+		if slices.Index(path, level) != idx {
+			return fmt.Errorf("duplicate drill path level: %s", level)
+		}
+
+		column, precision := utils.ParseColumn(level)
+		if !slices.Contains(names, column) {
+			return fmt.Errorf("unknown drill path column: %s", column)
+		}
+
+		if precision != "" && !slices.Contains(model.SupportedPrecisions, precision) {
+			return fmt.Errorf("unsupported drill path precision: %s", precision)
+		}
+	}
+
+	return nil
+}
+
+// validateRuledFields limits charts on datasets with row rules to columns
+// and saved metrics. Any other expression is raw SQL, and a subquery in it
+// reads the table around the WHERE clause the rules are injected into.
+func validateRuledFields(config model.ChartConfig, dataset model.DatasetConfig) error {
+	names := utils.ColumnNames(dataset.Columns)
+
+	for _, dimension := range config.Dimensions {
+		column, precision := utils.ParseColumn(dimension)
+		if !slices.Contains(names, column) {
+			return fmt.Errorf("dimension is not a column of the dataset: %s", dimension)
+		}
+
+		if precision != "" && !slices.Contains(model.SupportedPrecisions, precision) {
+			return fmt.Errorf("unsupported dimension precision: %s", precision)
+		}
+	}
+
+	for _, metric := range config.Metrics {
+		if _, saved := dataset.SavedMetric(metric); !saved && !dataset.IsColumnMetric(metric) {
+			return fmt.Errorf("metric is not a column aggregation or saved metric: %s", metric)
+		}
+	}
+
+	// filter values on numeric columns go into the query as they are
+	for _, filter := range utils.ParseFilters(config.Filters) {
+		column, precision := utils.ParseColumn(filter.Column)
+		idx := slices.Index(names, column)
+		if idx == -1 {
+			return fmt.Errorf("filter is not on a column of the dataset: %s", filter.Column)
+		}
+
+		if precision != "" {
+			if !slices.Contains(model.SupportedPrecisions, precision) {
+				return fmt.Errorf("unsupported filter precision: %s", precision)
+			}
+			continue
+		}
+
+		if _, dataType := utils.ParseColumn(dataset.Columns[idx]); utils.IsColumnNumeric(dataType) {
+			for _, value := range filter.Values {
+				if !utils.IsNumber(value) {
+					return fmt.Errorf("invalid number for filter %s: %s", filter.Column, value)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateTransforms(config model.ChartConfig) error {
+	seen := make(map[string]bool)
+
+	for _, t := range config.Transforms {
+		if !slices.Contains(config.Metrics, t.Metric) {
+			return fmt.Errorf("transform metric is not a chart metric: %s", t.Metric)
+		}
+
+		if seen[t.Metric] {
+			return fmt.Errorf("metric has more than one transform: %s", t.Metric)
+		}
+		seen[t.Metric] = true
+
+		if !slices.Contains(model.SupportedTransforms, t.Type) {
+			return fmt.Errorf("unsupported transform: %s", t.Type)
+		}
+
+		if len(config.Dimensions) == 0 {
+			return errors.New("transforms require at least one dimension")
+		}
+
+		if t.Type == "moving_average" && t.Window < 2 {
+			return fmt.Errorf("moving average requires a window of at least 2: %d", t.Window)
+		}
+
+		if t.Type != "difference" && t.Type != "percent_change" {
+			continue
+		}
+
+		if t.Compare != "" && !slices.Contains(model.SupportedCompares, t.Compare) {
+			return fmt.Errorf("unsupported transform comparison: %s", t.Compare)
+		}
+
+		_, precision := utils.ParseColumn(config.Dimensions[0])
+		if t.Compare == "last_year" && precision == "" {
+			return errors.New("comparing to last year requires the first dimension to be a date with precision")
+		}
+
+		if precision != "" && config.TopN > 0 {
+			return errors.New("period comparisons cannot be combined with top N")
+		}
+	}
+
+	return nil
+}
+
+func transforms(list []model.Transform, metrics []string) []utils.Transform {
+	result := make([]utils.Transform, len(list))
+	for idx, t := range list {
+		result[idx] = utils.Transform{
+			Metric:  slices.Index(metrics, t.Metric),
+			Type:    t.Type,
+			Window:  t.Window,
+			Compare: t.Compare,
+		}
+	}
+
+	return result
+}
+
+func calendar(cal *model.ChartCalendar) (utils.Calendar, error) {
+	result := utils.DefaultCalendar
+	if cal == nil {
+		return result, nil
+	}
+
+	if cal.WeekStart != "" {
+		idx := slices.IndexFunc(weekdays, func(day time.Weekday) bool {
+			return strings.EqualFold(day.String(), cal.WeekStart)
+		})
+		if idx == -1 {
+			return result, fmt.Errorf("unsupported week start: %s", cal.WeekStart)
+		}
+
+		result.WeekStart = weekdays[idx]
+	}
+
+	if cal.FiscalYearStart != 0 {
+		if cal.FiscalYearStart < 1 || cal.FiscalYearStart > 12 {
+			return result, fmt.Errorf("invalid fiscal year start month: %d", cal.FiscalYearStart)
+		}
+
+		result.FiscalYearStart = cal.FiscalYearStart
+	}
+
+	if cal.TimeZone != "" {
+		if _, err := time.LoadLocation(cal.TimeZone); err != nil {
+			return result, fmt.Errorf("unknown time zone: %s", cal.TimeZone)
+		}
+
+		result.TimeZone = cal.TimeZone
+	}
+
+	return result, nil
+}
+
+func conditions(having []model.Having, dataset model.DatasetConfig) []utils.Condition {
+	result := make([]utils.Condition, len(having))
+	for idx, cond := range having {
+		result[idx] = utils.Condition{
+			Expression: dataset.MetricExpression(cond.Metric),
+			Operator:   cond.Operator,
+			Value:      cond.Value,
+		}
+	}
+
+	return result
+}
+
+func sortField(sort *model.ChartSort) string {
+	if sort == nil {
+		return ""
+	}
+
+	return sort.Field
+}
+
+func rowCount(groups [][]string, values [][]float64) int {
+	if len(groups) > 0 {
+		return len(groups[0])
+	}
+
+	if len(values) > 0 {
+		return len(values[0])
+	}
+
+	return 0
+}
+
+func truncate(groups [][]string, values [][]float64, n int) ([][]string, [][]float64, bool) {
+	truncated := false
+
+	for idx := range groups {
+		if len(groups[idx]) > n {
+			groups[idx], truncated = groups[idx][:n], true
+		}
+	}
+
+	for idx := range values {
+		if len(values[idx]) > n {
+			values[idx], truncated = values[idx][:n], true
+		}
+	}
+
+	return groups, values, truncated
+}
+
+func (s *ChartService) perform(ctx context.Context, conn querier, query string, dimensions int, metrics int) ([][]string, [][]float64, error) {
 	groups := make([][]string, dimensions)
 	values := make([][]float64, metrics)
 
@@ -198,7 +878,11 @@ func (s *ChartService) perform(ctx context.Context, conn *pgxpool.Pool, query st
 			}
 
 			if idx-dimensions < metrics {
-				fvalue, _ := utils.ToFloat64(scan)
+				// NULL metrics, e.g. a period without a previous one, render as gaps
+				fvalue := math.NaN()
+				if scan != nil {
+					fvalue, _ = utils.ToFloat64(scan)
+				}
 				values[idx-dimensions] = append(values[idx-dimensions], fvalue)
 			}
 		}
@@ -207,26 +891,42 @@ func (s *ChartService) perform(ctx context.Context, conn *pgxpool.Pool, query st
 	return groups, values, nil
 }
 
-func (s *ChartService) Run(ctx context.Context, id int) (any, error) {
-	var result any
-	var chart model.Chart
+func (s *ChartService) Run(ctx context.Context, id int) (ChartResult, error) {
+	chart, err := s.Get(ctx, id)
+	if err != nil {
+		return ChartResult{}, err
+	}
 
-	query := `SELECT name, type, dataset_id, config FROM charts WHERE id = $1`
-	err := s.db.QueryRow(ctx, query, id).Scan(&chart.Name, &chart.Type, &chart.DatasetID, &chart.Config)
+	return s.RunChart(ctx, chart, nil)
+}
+
+// RunChart renders a stored chart. The extra filters are combined with the
+// filters of the chart, e.g. to apply dashboard filters.
+func (s *ChartService) RunChart(ctx context.Context, chart model.Chart, filters []string) (ChartResult, error) {
+	result, err := s.validate(ctx, chartReq(chart, filters))
 	if err != nil {
-		return result, fmt.Errorf("failed to retrieve chart: %w", err)
+		return result, fmt.Errorf("failed to validate chart: %w", err)
 	}
 
-	if result, err = s.Validate(ctx, ValidateChartReq{
+	return result, nil
+}
+
+func chartReq(chart model.Chart, filters []string) ValidateChartReq {
+	return ValidateChartReq{
+		ChartID:    chart.ID,
 		DatasetID:  chart.DatasetID,
 		Name:       chart.Name,
 		Type:       string(chart.Type),
 		Dimensions: chart.Config.Dimensions,
 		Metrics:    chart.Config.Metrics,
-		Filters:    chart.Config.Filters,
-	}); err != nil {
-		return result, fmt.Errorf("failed to validate chart: %w", err)
+		Filters:    append(slices.Clone(chart.Config.Filters), filters...),
+		Sort:       chart.Config.Sort,
+		Limit:      chart.Config.Limit,
+		TopN:       chart.Config.TopN,
+		Having:     chart.Config.Having,
+		GapFill:    chart.Config.GapFill,
+		Calendar:   chart.Config.Calendar,
+		Transforms: chart.Config.Transforms,
+		DrillPath:  chart.Config.DrillPath,
 	}
-
-	return result, nil
 }
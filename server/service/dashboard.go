@@ -3,21 +3,60 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service/utils"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+const minRefreshInterval = 10 * time.Second
+
+var ErrDashboardNotFound = errors.New("dashboard not found")
+
+// tilesQuery loads the charts of a grid together with their datasets and
+// sources, so running a dashboard reads its metadata in a single pass.
+const tilesQuery = `
+	SELECT c.id, c.name, c.dataset_id, c.type, c.config,
+		d.id, d.name, d.source_id, d.config, d.version,
+		s.id, s.name, s.type, s.config
+	FROM charts c
+	JOIN datasets d ON d.id = c.dataset_id AND d.deleted_at IS NULL
+	JOIN sources s ON s.id = d.source_id AND s.deleted_at IS NULL
+	WHERE c.id = ANY($1) AND c.deleted_at IS NULL
+`
+
 type DashboardService struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	access    *AccessService
+	charts    *ChartService
+	events    *WebhookService
+	perSource int
+	mu        sync.Mutex
+	slots     map[int]chan struct{}
 }
 
-func NewDashboardService(db *pgxpool.Pool) *DashboardService {
-	return &DashboardService{db: db}
+// NewDashboardService creates the dashboard service. When running tiles, at
+// most perSource queries hit the same source at a time.
+func NewDashboardService(db *pgxpool.Pool, access *AccessService, charts *ChartService, events *WebhookService, perSource int) *DashboardService {
+	return &DashboardService{
+		db:        db,
+		access:    access,
+		charts:    charts,
+		events:    events,
+		perSource: perSource,
+		slots:     make(map[int]chan struct{}),
+	}
 }
 
 func (s *DashboardService) All(ctx context.Context) ([]model.Dashboard, error) {
-	rows, err := s.db.Query(ctx, `SELECT id, name, grid FROM dashboards`)
+	query := `SELECT id, name, grid, filters, version, refresh_interval FROM dashboards WHERE deleted_at IS NULL`
+
+	rows, err := s.db.Query(ctx, query)
 	if err != nil {
 		return nil, errors.New("failed to retrieve dashboards")
 	}
@@ -26,46 +65,776 @@ func (s *DashboardService) All(ctx context.Context) ([]model.Dashboard, error) {
 	dashboards := make([]model.Dashboard, 0)
 	for rows.Next() {
 		var dashboard model.Dashboard
-		if err = rows.Scan(&dashboard.ID, &dashboard.Name, &dashboard.Grid); err != nil {
+		var refresh int
+		err = rows.Scan(&dashboard.ID, &dashboard.Name, &dashboard.Grid, &dashboard.Filters, &dashboard.Version, &refresh)
+		if err != nil {
 			return nil, errors.New("failed to scan dashboard row")
 		}
+
+		dashboard.RefreshInterval = time.Duration(refresh) * time.Second
 		dashboards = append(dashboards, dashboard)
 	}
 
-	return dashboards, nil
+	return visible(ctx, s.access, dashboards, func(dashboard model.Dashboard) []object {
+		return []object{{model.DASHBOARD, dashboard.ID}}
+	})
 }
 
 func (s *DashboardService) Get(ctx context.Context, id int) (model.Dashboard, error) {
-	query := `SELECT id, name, grid FROM dashboards WHERE id = $1`
+	query := `
+		SELECT id, name, grid, filters, version, refresh_interval, created_by, updated_by
+		FROM dashboards
+		WHERE id = $1 AND deleted_at IS NULL
+	`
 
 	var dashboard model.Dashboard
-	err := s.db.QueryRow(ctx, query, id).Scan(&dashboard.ID, &dashboard.Name, &dashboard.Grid)
+	var refresh int
+	err := s.db.QueryRow(ctx, query, id).
+		Scan(&dashboard.ID, &dashboard.Name, &dashboard.Grid, &dashboard.Filters, &dashboard.Version, &refresh,
+			&dashboard.CreatedBy, &dashboard.UpdatedBy)
 	if err != nil {
-		return dashboard, errors.New("dashboard not found")
+		return dashboard, ErrDashboardNotFound
+	}
+
+	if err = s.access.check(ctx, ErrDashboardNotFound, object{model.DASHBOARD, id}); err != nil {
+		return dashboard, err
 	}
 
+	dashboard.RefreshInterval = time.Duration(refresh) * time.Second
 	return dashboard, nil
 }
 
 type CreateDashboardReq struct {
-	Name string
-	Grid []map[string]any
+	Name            string
+	Grid            []map[string]any
+	Filters         []model.DashboardFilter
+	RefreshInterval time.Duration
 }
 
 func (s *DashboardService) Create(ctx context.Context, req CreateDashboardReq) (int, error) {
-	query := `INSERT INTO dashboards (name, grid) VALUES ($1, $2) RETURNING id;`
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO dashboards (name, grid, filters, refresh_interval, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING id;
+	`
+
+	if err := validateDashboardFilters(req.Filters); err != nil {
+		return 0, err
+	}
+
+	if err := validateRefreshInterval(req.RefreshInterval); err != nil {
+		return 0, err
+	}
 
 	var id int
-	err := s.db.QueryRow(ctx, query, req.Name, req.Grid).Scan(&id)
+	refresh := int(req.RefreshInterval / time.Second)
+	err := s.db.QueryRow(ctx, query, req.Name, req.Grid, req.Filters, refresh, actor(ctx)).Scan(&id)
 	if err != nil {
 		return 0, errors.New("failed to insert dashboard")
 	}
 
+	s.events.entityCreated(ctx, model.DASHBOARD, id, req.Name)
 	return id, nil
 }
 
-func (s *DashboardService) Delete(ctx context.Context, id int) error {
-	query := `DELETE FROM dashboards WHERE id = $1;`
-	_, err := s.db.Exec(ctx, query, id)
-	return err
+type UpdateDashboardReq struct {
+	ID              int
+	Version         int
+	Name            string
+	Grid            []map[string]any
+	Filters         []model.DashboardFilter
+	RefreshInterval time.Duration
+}
+
+// Update replaces the name, grid, filters and refresh interval of the
+// dashboard, given the version the caller last read, and returns the new
+// version.
+func (s *DashboardService) Update(ctx context.Context, req UpdateDashboardReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	if err := s.access.check(ctx, ErrDashboardNotFound, object{model.DASHBOARD, req.ID}); err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE dashboards
+		SET name = $3, grid = $4, filters = $5, refresh_interval = $6, version = version + 1, updated_by = $7
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING version;
+	`
+
+	if err := validateDashboardFilters(req.Filters); err != nil {
+		return 0, err
+	}
+
+	if err := validateRefreshInterval(req.RefreshInterval); err != nil {
+		return 0, err
+	}
+
+	var version int
+	refresh := int(req.RefreshInterval / time.Second)
+	err := s.db.QueryRow(ctx, query, req.ID, req.Version, req.Name, req.Grid, req.Filters, refresh, actor(ctx)).
+		Scan(&version)
+	if err == nil {
+		s.events.entityUpdated(ctx, model.DASHBOARD, req.ID, req.Name, version)
+		return version, nil
+	}
+
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, errors.New("failed to update dashboard")
+	}
+
+	if _, err = s.Get(ctx, req.ID); err != nil {
+		return 0, ErrDashboardNotFound
+	}
+
+	return 0, ErrVersionConflict
+}
+
+// Delete moves the dashboard to the trash, or removes it for good with any
+// other mode, as nothing depends on a dashboard.
+func (s *DashboardService) Delete(ctx context.Context, id int, mode model.DeleteMode) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if err := s.access.check(ctx, pgx.ErrNoRows, object{model.DASHBOARD, id}); err != nil {
+		return err
+	}
+
+	deps, err := deleteEntity(ctx, s.db, model.DASHBOARD, id, mode, nil)
+	if err != nil {
+		return err
+	}
+
+	s.events.entityDeleted(ctx, model.DASHBOARD, id, mode, deps)
+	return nil
+}
+
+func validateRefreshInterval(interval time.Duration) error {
+	if interval != 0 && interval < minRefreshInterval {
+		return fmt.Errorf("refresh interval must be at least %s", minRefreshInterval)
+	}
+
+	return nil
+}
+
+func validateDashboardFilters(filters []model.DashboardFilter) error {
+	names := make(map[string]bool, len(filters))
+
+	for _, filter := range filters {
+		if filter.Name == "" || filter.Column == "" {
+			return errors.New("dashboard filter requires a name and a column")
+		}
+
+		if names[filter.Name] {
+			return fmt.Errorf("duplicate dashboard filter: %s", filter.Name)
+		}
+		names[filter.Name] = true
+
+		if !slices.Contains(model.SupportedDashboardFilters, filter.Type) {
+			return fmt.Errorf("unsupported dashboard filter type: %s", filter.Type)
+		}
+	}
+
+	return nil
+}
+
+// Data runs every tile of the dashboard with the active filter values, keyed
+// by filter name. A failing tile reports its error without failing the rest.
+func (s *DashboardService) Data(ctx context.Context, id int, active map[string]model.FilterValue) ([]model.DashboardTile, error) {
+	return s.data(ctx, id, active, nil)
+}
+
+// data runs the tiles like Data. Tiles a locked filter can't be applied to
+// fail rather than run unfiltered.
+func (s *DashboardService) data(ctx context.Context, id int, active map[string]model.FilterValue, locked map[string]bool) ([]model.DashboardTile, error) {
+	dashboard, err := s.load(ctx, id, active)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles, err := s.prepareTiles(ctx, dashboard, active, locked)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.collect(ctx, tiles), nil
+}
+
+// Report runs every tile of the dashboard, without filters, and returns their
+// data as labelled rows. It fails when none of the tiles could run, so that
+// scheduled deliveries are retried rather than sent empty.
+func (s *DashboardService) Report(ctx context.Context, id int) (model.Report, error) {
+	dashboard, err := s.Get(ctx, id)
+	if err != nil {
+		return model.Report{}, err
+	}
+
+	tiles, err := s.prepareTiles(ctx, dashboard, nil, nil)
+	if err != nil {
+		return model.Report{}, err
+	}
+
+	snapshot := model.Report{Title: dashboard.Name, GeneratedAt: time.Now(), Tables: make([]model.ChartTable, len(tiles))}
+
+	failed := 0
+	for idx, tile := range tiles {
+		table, err := model.ChartTable{}, tile.err
+		if err == nil {
+			var prepared preparedQuery
+			if prepared, err = s.charts.compile(ctx, tile.req(), tile.dataset, tile.source); err == nil {
+				table, err = s.charts.table(ctx, prepared, tile.chart.ID, tile.chart.Name)
+			}
+		}
+
+		if err != nil {
+			table, failed = model.ChartTable{Name: tile.chart.Name, Error: err.Error()}, failed+1
+		}
+
+		snapshot.Tables[idx] = table
+	}
+
+	if failed > 0 && failed == len(tiles) {
+		return snapshot, fmt.Errorf("none of the %d dashboard tiles could run", failed)
+	}
+
+	return snapshot, nil
+}
+
+// DashboardRun is a dashboard with the metadata of all its tiles loaded.
+type DashboardRun struct {
+	service *DashboardService
+	tiles   []dashboardTile
+}
+
+// Prepare loads the dashboard and everything its tiles need to run, failing
+// only when the dashboard or the active filters are invalid.
+func (s *DashboardService) Prepare(ctx context.Context, id int, active map[string]model.FilterValue) (*DashboardRun, error) {
+	dashboard, err := s.load(ctx, id, active)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles, err := s.prepareTiles(ctx, dashboard, active, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DashboardRun{service: s, tiles: tiles}, nil
+}
+
+// Stream runs the tiles and emits each one as soon as it finishes, so slow
+// tiles don't hold back fast ones. emit is never called concurrently.
+func (r *DashboardRun) Stream(ctx context.Context, emit func(model.DashboardTile)) {
+	r.service.runTiles(ctx, r.tiles, r.service.charts.cache.ttl, func(_ int, tile model.DashboardTile) {
+		emit(tile)
+	})
+}
+
+// Select applies clicks on dashboard tiles. Every other tile whose dataset
+// has the clicked column is filtered to the clicked value. With drill set, the
+// clicked tile itself moves one level down the drill path of the dimension, or
+// to the next finer precision for dates. Only the affected tiles are returned.
+func (s *DashboardService) Select(ctx context.Context, id int, active map[string]model.FilterValue, selections []model.Selection, drill bool) ([]model.DashboardTile, error) {
+	dashboard, err := s.load(ctx, id, active)
+	if err != nil {
+		return nil, err
+	}
+
+	charts := gridCharts(dashboard.Grid)
+	for _, selection := range selections {
+		if !slices.Contains(charts, selection.ChartID) {
+			return nil, fmt.Errorf("chart %d is not on the dashboard", selection.ChartID)
+		}
+	}
+
+	tiles, err := s.prepareTiles(ctx, dashboard, active, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// a clicked date bucket is read with the calendar of the chart it was
+	// clicked on, whichever tile it filters
+	calendars := make(map[int]utils.Calendar)
+	for _, tile := range tiles {
+		if cal, err := calendar(tile.chart.Config.Calendar); err == nil {
+			calendars[tile.chart.ID] = cal
+		}
+	}
+
+	affected := make([]dashboardTile, 0, len(tiles))
+	for _, tile := range tiles {
+		if tile.err != nil {
+			affected = append(affected, tile)
+			continue
+		}
+
+		selected := false
+		for _, selection := range selections {
+			if selection.ChartID == tile.chart.ID {
+				if !drill {
+					continue
+				}
+
+				config, ok := drillDown(tile.chart.Config, selection.Dimension)
+				if !ok {
+					continue
+				}
+
+				tile.chart.Config = config
+			}
+
+			cal, found := calendars[selection.ChartID]
+			if !found {
+				cal = utils.DefaultCalendar
+			}
+
+			conditions, ok, err := selectionConditions(selection, cal, tile.dataset)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				tile.conditions = append(tile.conditions, conditions...)
+				selected = true
+			}
+		}
+
+		if selected {
+			affected = append(affected, tile)
+		}
+	}
+
+	return s.collect(ctx, affected), nil
+}
+
+// load returns the dashboard after checking the active filters against it.
+func (s *DashboardService) load(ctx context.Context, id int, active map[string]model.FilterValue) (model.Dashboard, error) {
+	dashboard, err := s.Get(ctx, id)
+	if err != nil {
+		return dashboard, err
+	}
+
+	for name := range active {
+		if !slices.ContainsFunc(dashboard.Filters, func(f model.DashboardFilter) bool { return f.Name == name }) {
+			return dashboard, fmt.Errorf("unknown dashboard filter: %s", name)
+		}
+	}
+
+	return dashboard, nil
+}
+
+// dashboardTile is a grid tile prepared to run: its chart, the filters added
+// to the query of the chart, or the error that keeps it from running.
+type dashboardTile struct {
+	chart      model.Chart
+	dataset    model.Dataset
+	source     model.Source
+	conditions []utils.Filter
+	applied    []string
+	err        error
+	// hidden is set on tiles the user isn't granted access to
+	hidden bool
+}
+
+// req is the request running the chart of the tile with its conditions.
+func (tile dashboardTile) req() ValidateChartReq {
+	req := chartReq(tile.chart, nil)
+	req.Conditions = tile.conditions
+	return req
+}
+
+// prepareTiles loads the tiles of the grid, in grid order, and compiles the
+// active filters for each of them, failing tiles the locked ones don't apply
+// to.
+func (s *DashboardService) prepareTiles(ctx context.Context, dashboard model.Dashboard, active map[string]model.FilterValue, locked map[string]bool) ([]dashboardTile, error) {
+	ids := gridCharts(dashboard.Grid)
+
+	rows, err := s.db.Query(ctx, tilesQuery, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve dashboard charts: %w", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[int]dashboardTile, len(ids))
+	for rows.Next() {
+		var tile dashboardTile
+		chart, dataset, source := &tile.chart, &tile.dataset, &tile.source
+
+		err = rows.Scan(
+			&chart.ID, &chart.Name, &chart.DatasetID, &chart.Type, &chart.Config,
+			&dataset.ID, &dataset.Name, &dataset.SourceID, &dataset.Config, &dataset.Version,
+			&source.ID, &source.Name, &source.Type, &source.Config,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dashboard chart row: %w", err)
+		}
+
+		loaded[chart.ID] = tile
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve dashboard charts: %w", err)
+	}
+
+	// tiles the viewer can't see fail like missing charts, without running
+	objects := make([]object, 0, 3*len(loaded))
+	for _, tile := range loaded {
+		objects = append(objects, chartObjects(tile.chart, tile.source.ID)...)
+	}
+
+	hidden, err := s.access.hidden(ctx, objects...)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := make([]dashboardTile, len(ids))
+	for idx, id := range ids {
+		tile, found := loaded[id]
+		if !found {
+			tiles[idx] = dashboardTile{chart: model.Chart{ID: id}, err: ErrChartNotFound}
+			continue
+		}
+
+		if slices.ContainsFunc(chartObjects(tile.chart, tile.source.ID), func(o object) bool { return hidden[o] }) {
+			tiles[idx] = dashboardTile{chart: model.Chart{ID: id}, err: ErrChartNotFound, hidden: true}
+			continue
+		}
+
+		tile.conditions, tile.applied, tile.err = filterConditions(dashboard.Filters, active, locked, tile.dataset)
+		tiles[idx] = tile
+	}
+
+	return tiles, nil
+}
+
+// checkTiles fails unless the user sees every tile of the dashboard. Shares
+// and scheduled deliveries run without a user, so only someone who sees all
+// of the dashboard may hand it out.
+func (s *DashboardService) checkTiles(ctx context.Context, dashboard model.Dashboard) error {
+	tiles, err := s.prepareTiles(ctx, dashboard, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, tile := range tiles {
+		if tile.hidden {
+			return fmt.Errorf("%w: the dashboard shows charts you have no access to", ErrForbidden)
+		}
+	}
+
+	return nil
+}
+
+// collect runs the tiles and returns them in the order they were given.
+func (s *DashboardService) collect(ctx context.Context, tiles []dashboardTile) []model.DashboardTile {
+	results := make([]model.DashboardTile, len(tiles))
+	s.runTiles(ctx, tiles, s.charts.cache.ttl, func(idx int, tile model.DashboardTile) {
+		results[idx] = tile
+	})
+
+	return results
+}
+
+// runTiles runs the tiles concurrently and emits each one, with its index, as
+// soon as it is rendered. Tiles with the same query on the same source share
+// a single execution, results cached less than maxAge ago are reused, and
+// every source gets a single pool for the whole run.
+func (s *DashboardService) runTiles(ctx context.Context, tiles []dashboardTile, maxAge time.Duration, emit func(int, model.DashboardTile)) {
+	var mu sync.Mutex
+	send := func(idx int, result ChartResult, err error) {
+		tile := model.DashboardTile{
+			ChartID:    tiles[idx].chart.ID,
+			Dimensions: tiles[idx].chart.Config.Dimensions,
+			Applied:    tiles[idx].applied,
+		}
+
+		if err != nil {
+			tile.Error = err.Error()
+		} else {
+			tile.Options, tile.Truncated = result.Options, result.Truncated
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		emit(idx, tile)
+	}
+
+	prepared := make([]preparedQuery, len(tiles))
+	shared := make(map[string][]int)
+	bySource := make(map[int][]string)
+	hits := make(map[string]cachedResult)
+
+	// renders every tile sharing the query from its result
+	renderAll := func(key string, groups [][]string, values [][]float64, err error) {
+		for _, idx := range shared[key] {
+			if err != nil {
+				send(idx, ChartResult{}, fmt.Errorf("failed to validate chart: %w", err))
+				continue
+			}
+
+			result, err := s.charts.render(prepared[idx], tiles[idx].chart.Name, groups, values)
+			if err != nil {
+				err = fmt.Errorf("failed to validate chart: %w", err)
+			}
+			send(idx, result, err)
+		}
+	}
+
+	for idx, tile := range tiles {
+		if tile.err != nil {
+			send(idx, ChartResult{}, tile.err)
+			continue
+		}
+
+		var err error
+		prepared[idx], err = s.charts.compile(ctx, tile.req(), tile.dataset, tile.source)
+		if err != nil {
+			send(idx, ChartResult{}, fmt.Errorf("failed to validate chart: %w", err))
+			continue
+		}
+
+		key := cacheKey(tile.source.ID, prepared[idx].query)
+		if _, found := shared[key]; !found {
+			if groups, values, hit := s.charts.cached(ctx, prepared[idx], tile.chart.ID, maxAge); hit {
+				hits[key] = cachedResult{groups: groups, values: values}
+			} else {
+				bySource[tile.source.ID] = append(bySource[tile.source.ID], key)
+			}
+		}
+		shared[key] = append(shared[key], idx)
+	}
+
+	for key, hit := range hits {
+		renderAll(key, hit.groups, hit.values, nil)
+	}
+
+	var wg sync.WaitGroup
+	for _, keys := range bySource {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			source := tiles[shared[keys[0]][0]].source
+			conn, release, err := s.charts.sources.Connect(ctx, source)
+			if err != nil {
+				for _, key := range keys {
+					for _, idx := range shared[key] {
+						send(idx, ChartResult{}, err)
+					}
+				}
+				return
+			}
+			defer release()
+
+			var queries sync.WaitGroup
+			for _, key := range keys {
+				queries.Add(1)
+				go func() {
+					defer queries.Done()
+
+					first := shared[key][0]
+					groups, values, err := s.execute(ctx, conn, prepared[first], tiles[first].chart.ID)
+					renderAll(key, groups, values, err)
+				}()
+			}
+			queries.Wait()
+		}()
+	}
+	wg.Wait()
+}
+
+// execute runs a tile query once a slot of its source is free.
+func (s *DashboardService) execute(ctx context.Context, conn *pgxpool.Pool, prepared preparedQuery, chartID int) ([][]string, [][]float64, error) {
+	slot := s.slot(prepared.source.ID)
+	select {
+	case slot <- struct{}{}:
+		defer func() { <-slot }()
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	return s.charts.query(ctx, conn, prepared, chartID)
+}
+
+func (s *DashboardService) slot(sourceID int) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, found := s.slots[sourceID]
+	if !found {
+		slot = make(chan struct{}, s.perSource)
+		s.slots[sourceID] = slot
+	}
+
+	return slot
+}
+
+// drillDown replaces the dimension of the chart by the next level of its
+// drill path. It reports false when there is no level to drill into.
+func drillDown(config model.ChartConfig, dimension string) (model.ChartConfig, bool) {
+	idx := slices.Index(config.Dimensions, dimension)
+	if idx == -1 {
+		return config, false
+	}
+
+	next := ""
+	if pos := slices.Index(config.DrillPath, dimension); pos != -1 {
+		if pos+1 < len(config.DrillPath) {
+			next = config.DrillPath[pos+1]
+		}
+	} else if column, precision := utils.ParseColumn(dimension); precision != "" {
+		if finer := model.NextPrecision(precision); finer != "" {
+			next = utils.FormatColumn(column, finer)
+		}
+	}
+
+	if next == "" {
+		return config, false
+	}
+
+	config.Dimensions = slices.Clone(config.Dimensions)
+	config.Dimensions[idx] = next
+
+	if config.Sort != nil && config.Sort.Field == dimension {
+		config.Sort = &model.ChartSort{Field: next, Direction: config.Sort.Direction}
+	}
+
+	return config, true
+}
+
+// selectionConditions compiles a click into chart filters for the dataset. A
+// date bucket becomes a range, per the calendar that built it. It reports
+// false when the dataset lacks the column, or for the bucket collecting the
+// rows outside the top N.
+func selectionConditions(selection model.Selection, cal utils.Calendar, dataset model.Dataset) ([]utils.Filter, bool, error) {
+	column, precision := utils.ParseColumn(selection.Dimension)
+
+	idx := slices.Index(utils.ColumnNames(dataset.Config.Columns), column)
+	if idx == -1 || selection.Value == utils.OthersLabel {
+		return nil, false, nil
+	}
+
+	_, dataType := utils.ParseColumn(dataset.Config.Columns[idx])
+
+	if precision != "" {
+		if !utils.IsColumnDateTime(dataType) {
+			return nil, false, nil
+		}
+
+		from, to, err := utils.PeriodRange(selection.Value, precision, cal)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return []utils.Filter{
+			{Column: column, Operator: ">=", Values: []string{utils.FormatBound(from, dataType, cal)}},
+			{Column: column, Operator: "<", Values: []string{utils.FormatBound(to, dataType, cal)}},
+		}, true, nil
+	}
+
+	if utils.IsColumnNumeric(dataType) && !utils.IsNumber(selection.Value) {
+		return nil, false, fmt.Errorf("invalid number for %s: %s", column, selection.Value)
+	}
+
+	return []utils.Filter{{Column: column, Operator: "=", Values: []string{selection.Value}}}, true, nil
+}
+
+// gridCharts returns the charts referenced by the grid, in grid order.
+func gridCharts(grid []map[string]any) []int {
+	ids := make([]int, 0, len(grid))
+	for _, item := range grid {
+		if id, ok := item["chartId"].(float64); ok && id > 0 {
+			ids = append(ids, int(id))
+		}
+	}
+
+	return ids
+}
+
+// filterConditions compiles the active dashboard filters into chart filters
+// for the dataset. Filters whose column the dataset lacks, or whose column
+// has the wrong type, are skipped, unless they are locked, which fails. It
+// also returns the names of the filters that were applied.
+func filterConditions(filters []model.DashboardFilter, active map[string]model.FilterValue, locked map[string]bool, dataset model.Dataset) ([]utils.Filter, []string, error) {
+	conditions, applied := make([]utils.Filter, 0), make([]string, 0)
+	names := utils.ColumnNames(dataset.Config.Columns)
+
+	for _, filter := range filters {
+		value, found := active[filter.Name]
+		if !found {
+			continue
+		}
+
+		unbound := fmt.Errorf("%w: %s can't be applied to the chart", ErrLockedFilter, filter.Name)
+
+		column := filter.ColumnFor(dataset.ID)
+		idx := slices.Index(names, column)
+		if idx == -1 {
+			if locked[filter.Name] {
+				return nil, nil, unbound
+			}
+
+			continue
+		}
+
+		_, dataType := utils.ParseColumn(dataset.Config.Columns[idx])
+
+		switch filter.Type {
+		case model.DateRangeFilter:
+			if !utils.IsColumnDateTime(dataType) && locked[filter.Name] {
+				return nil, nil, unbound
+			}
+
+			if !utils.IsColumnDateTime(dataType) || (value.From == "" && value.To == "") {
+				continue
+			}
+
+			for _, bound := range []string{value.From, value.To} {
+				if bound != "" && !isDate(bound) {
+					return nil, nil, fmt.Errorf("invalid date for filter %s: %s", filter.Name, bound)
+				}
+			}
+
+			if value.From != "" {
+				conditions = append(conditions, utils.Filter{Column: column, Operator: ">=", Values: []string{value.From}})
+			}
+
+			if value.To != "" {
+				conditions = append(conditions, utils.Filter{Column: column, Operator: "<", Values: []string{value.To}})
+			}
+		case model.ValuesFilter:
+			if len(value.Values) == 0 {
+				continue
+			}
+
+			for _, v := range value.Values {
+				if utils.IsColumnNumeric(dataType) && !utils.IsNumber(v) {
+					return nil, nil, fmt.Errorf("invalid number for filter %s: %s", filter.Name, v)
+				}
+			}
+
+			conditions = append(conditions, utils.Filter{Column: column, Operator: "IN", Values: value.Values})
+		}
+
+		applied = append(applied, filter.Name)
+	}
+
+	return conditions, applied, nil
+}
+
+func isDate(value string) bool {
+	if _, err := time.Parse(time.DateOnly, value); err == nil {
+		return true
+	}
+
+	_, err := time.Parse(time.RFC3339, value)
+	return err == nil
 }
@@ -4,25 +4,65 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service/utils"
+
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+const (
+	previewDefaultSize = 50
+	previewMaxSize     = 500
+	profileTopValues   = 10
+	profileBins        = 10
+	profileSampleRows  = 100_000
+	profileCacheTTL    = 15 * time.Minute
+)
+
+var (
+	ErrDatasetNotFound = errors.New("dataset not found")
+	// ErrVersionConflict is returned when an entity was modified by someone
+	// else since the caller read it.
+	ErrVersionConflict = errors.New("version conflict, the entity was modified concurrently")
+)
+
 type DatasetService struct {
-	db      *pgxpool.Pool
-	sources *SourceService
+	db       *pgxpool.Pool
+	access   *AccessService
+	sources  *SourceService
+	queries  *QueryService
+	events   *WebhookService
+	mu       sync.Mutex
+	profiles map[profileKey]model.DatasetProfile
 }
 
-func NewDatasetService(db *pgxpool.Pool, src *SourceService) *DatasetService {
+// profileKey keys cached profiles by the row rules they were computed under,
+// so users held to different rows don't share them.
+type profileKey struct {
+	dataset int
+	rules   string
+}
+
+func NewDatasetService(db *pgxpool.Pool, access *AccessService, src *SourceService, queries *QueryService, events *WebhookService) *DatasetService {
 	return &DatasetService{
-		db:      db,
-		sources: src,
+		db:       db,
+		access:   access,
+		sources:  src,
+		queries:  queries,
+		events:   events,
+		profiles: make(map[profileKey]model.DatasetProfile),
 	}
 }
 
 func (s *DatasetService) All(ctx context.Context) ([]model.Dataset, error) {
-	rows, err := s.db.Query(ctx, `SELECT id, name, source_id, config FROM datasets`)
+	rows, err := s.db.Query(ctx, `SELECT id, name, source_id, config, version FROM datasets WHERE deleted_at IS NULL`)
 	if err != nil {
 		return nil, errors.New("failed to retrieve datasets")
 	}
@@ -31,25 +71,35 @@ func (s *DatasetService) All(ctx context.Context) ([]model.Dataset, error) {
 	datasets := make([]model.Dataset, 0)
 	for rows.Next() {
 		var dataset model.Dataset
-		if err = rows.Scan(&dataset.ID, &dataset.Name, &dataset.SourceID, &dataset.Config); err != nil {
+		if err = rows.Scan(&dataset.ID, &dataset.Name, &dataset.SourceID, &dataset.Config, &dataset.Version); err != nil {
 			return nil, errors.New("failed to scan dataset row")
 		}
 		datasets = append(datasets, dataset)
 	}
 
-	return datasets, nil
+	return visible(ctx, s.access, datasets, func(dataset model.Dataset) []object {
+		return []object{{model.DATASET, dataset.ID}, {model.SOURCE, dataset.SourceID}}
+	})
 }
 
 func (s *DatasetService) Get(ctx context.Context, id int) (model.Dataset, error) {
-	query := `SELECT id, name, source_id, config FROM datasets WHERE id = $1`
+	query := `
+		SELECT id, name, source_id, config, version, created_by, updated_by
+		FROM datasets
+		WHERE id = $1 AND deleted_at IS NULL
+	`
 
 	var dataset model.Dataset
-	err := s.db.QueryRow(ctx, query, id).Scan(&dataset.ID, &dataset.Name, &dataset.SourceID, &dataset.Config)
+	err := s.db.QueryRow(ctx, query, id).
+		Scan(&dataset.ID, &dataset.Name, &dataset.SourceID, &dataset.Config, &dataset.Version, &dataset.CreatedBy,
+			&dataset.UpdatedBy)
 	if err != nil {
-		return dataset, errors.New("dataset not found")
+		return dataset, ErrDatasetNotFound
 	}
 
-	return dataset, nil
+	// a dataset is as restricted as its source
+	err = s.access.check(ctx, ErrDatasetNotFound, object{model.DATASET, id}, object{model.SOURCE, dataset.SourceID})
+	return dataset, err
 }
 
 type CreateDatasetReq struct {
@@ -57,12 +107,19 @@ type CreateDatasetReq struct {
 	SourceID       int
 	DatabaseSchema string
 	DatabaseTable  string
+	Metadata       map[string]model.ColumnMetadata
+	SavedMetrics   []model.SavedMetric
+	Rules          []model.RowRule
 }
 
 func (s *DatasetService) Create(ctx context.Context, req CreateDatasetReq) (int, error) {
-	_, datasets, err := s.sources.Get(ctx, req.SourceID)
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	source, datasets, err := s.sources.Get(ctx, req.SourceID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get source %s: %w", req.SourceID, err)
+		return 0, fmt.Errorf("failed to get source %d: %w", req.SourceID, err)
 	}
 
 	config := model.DatasetConfig{
@@ -78,23 +135,666 @@ func (s *DatasetService) Create(ctx context.Context, req CreateDatasetReq) (int,
 		}
 	}
 
+	if err = validateMetadata(config.Columns, req.Metadata); err != nil {
+		return 0, err
+	}
+
+	if err = validateSavedMetrics(req.SavedMetrics); err != nil {
+		return 0, err
+	}
+
+	// a new dataset on a table is held to the rules already guarding it
+	config.Rules, err = s.tableRules(ctx, req.SourceID, req.DatabaseSchema, req.DatabaseTable)
+	if err != nil {
+		return 0, err
+	}
+
+	inherited := config.Rules
+	if req.Rules != nil {
+		if err = s.checkRules(ctx, source, config, req.Rules); err != nil {
+			return 0, err
+		}
+
+		config.Rules = req.Rules
+	}
+
+	if err = checkSavedMetrics(ctx, config.Rules, nil, req.SavedMetrics); err != nil {
+		return 0, err
+	}
+
+	config.Metadata = req.Metadata
+	config.SavedMetrics = req.SavedMetrics
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
 	query := `
-		INSERT INTO datasets (name, source_id, config)
-		VALUES ($1, $2, $3)
+		INSERT INTO datasets (name, source_id, config, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $4)
 		RETURNING id;
 	`
 
 	var id int
-	err = s.db.QueryRow(ctx, query, req.Name, req.SourceID, config).Scan(&id)
+	err = tx.QueryRow(ctx, query, req.Name, req.SourceID, config, actor(ctx)).Scan(&id)
 	if err != nil {
 		return 0, errors.New("failed to insert dataset")
 	}
 
+	if !slices.Equal(inherited, config.Rules) {
+		if err = shareRules(ctx, tx, id, req.SourceID, config); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit dataset: %w", err)
+	}
+
+	s.events.entityCreated(ctx, model.DATASET, id, req.Name)
 	return id, nil
 }
 
-func (s *DatasetService) Delete(ctx context.Context, id int) error {
-	query := `DELETE FROM datasets WHERE id = $1;`
-	_, err := s.db.Exec(ctx, query, id)
-	return err
+type UpdateDatasetReq struct {
+	ID           int
+	Version      int
+	Name         string
+	Columns      []string
+	Metadata     map[string]model.ColumnMetadata
+	SavedMetrics []model.SavedMetric
+	// Rules replace the row rules of the table the dataset is on, nil keeps
+	// them.
+	Rules []model.RowRule
+}
+
+// Update replaces the name, columns and metadata of the dataset, given the
+// version the caller last read. Columns are picked by name from the current
+// table definition; leaving them empty selects every column. It returns the
+// new version of the dataset.
+func (s *DatasetService) Update(ctx context.Context, req UpdateDatasetReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	dataset, err := s.Get(ctx, req.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	source, datasets, err := s.sources.Get(ctx, dataset.SourceID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get source %d: %w", dataset.SourceID, err)
+	}
+
+	var available []string
+	for _, ds := range datasets {
+		if ds.Table == dataset.Config.Table && ds.Schema == dataset.Config.Schema {
+			available = ds.Columns
+			break
+		}
+	}
+
+	config := dataset.Config
+	config.Columns = available
+
+	if len(req.Columns) > 0 {
+		names := utils.ColumnNames(available)
+		config.Columns = make([]string, len(req.Columns))
+
+		for idx, column := range req.Columns {
+			pos := slices.Index(names, column)
+			if pos == -1 {
+				return 0, fmt.Errorf("unknown column: %s", column)
+			}
+
+			config.Columns[idx] = available[pos]
+		}
+	}
+
+	if err = validateMetadata(config.Columns, req.Metadata); err != nil {
+		return 0, err
+	}
+
+	if err = validateSavedMetrics(req.SavedMetrics); err != nil {
+		return 0, err
+	}
+
+	if req.Rules != nil {
+		if err = s.checkRules(ctx, source, config, req.Rules); err != nil {
+			return 0, err
+		}
+
+		config.Rules = req.Rules
+	}
+
+	if err = checkSavedMetrics(ctx, config.Rules, dataset.Config.SavedMetrics, req.SavedMetrics); err != nil {
+		return 0, err
+	}
+
+	config.Metadata = req.Metadata
+	config.SavedMetrics = req.SavedMetrics
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	query := `
+		UPDATE datasets
+		SET name = $3, config = $4, version = version + 1, updated_by = $5
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING version;
+	`
+
+	var version int
+	err = tx.QueryRow(ctx, query, req.ID, req.Version, req.Name, config, actor(ctx)).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrVersionConflict
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to update dataset: %w", err)
+	}
+
+	if !slices.Equal(dataset.Config.Rules, config.Rules) {
+		if err = shareRules(ctx, tx, req.ID, dataset.SourceID, config); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit dataset: %w", err)
+	}
+
+	s.mu.Lock()
+	s.forget(req.ID)
+	s.mu.Unlock()
+
+	s.events.entityUpdated(ctx, model.DATASET, req.ID, req.Name, version)
+	return version, nil
+}
+
+func validateMetadata(columns []string, metadata map[string]model.ColumnMetadata) error {
+	names := utils.ColumnNames(columns)
+
+	for column, meta := range metadata {
+		if !slices.Contains(names, column) {
+			return fmt.Errorf("unknown column in metadata: %s", column)
+		}
+
+		if meta.Format != "" && !slices.Contains(model.SupportedFormats, meta.Format) {
+			return fmt.Errorf("unsupported format for column %s: %s", column, meta.Format)
+		}
+
+		if meta.DefaultAggregation != "" && !slices.Contains(model.SupportedAggregations, meta.DefaultAggregation) {
+			return fmt.Errorf("unsupported aggregation for column %s: %s", column, meta.DefaultAggregation)
+		}
+	}
+
+	return nil
+}
+
+func validateSavedMetrics(metrics []model.SavedMetric) error {
+	names := make(map[string]bool, len(metrics))
+
+	for _, metric := range metrics {
+		if metric.Name == "" || metric.Expression == "" {
+			return errors.New("saved metric requires a name and an expression")
+		}
+
+		if names[metric.Name] {
+			return fmt.Errorf("duplicate saved metric: %s", metric.Name)
+		}
+		names[metric.Name] = true
+
+		if metric.Format != "" && !slices.Contains(model.SupportedFormats, metric.Format) {
+			return fmt.Errorf("unsupported format for saved metric %s: %s", metric.Name, metric.Format)
+		}
+	}
+
+	return nil
+}
+
+// checkRules validates the row rules replacing the current ones of config.
+// Changing them takes the admin role, as editors could otherwise lift the
+// rules holding them back. New rules are compiled against the table, so a
+// broken one can't fail every query on the dataset.
+func (s *DatasetService) checkRules(ctx context.Context, source model.Source, config model.DatasetConfig, rules []model.RowRule) error {
+	if slices.Equal(config.Rules, rules) {
+		return nil
+	}
+
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+
+	// rendered without a user, every placeholder is NULL, which fits any
+	// column type
+	config.Rules = rules
+	rulesSQL := utils.BuildRules(rowRules(context.Background(), config))
+	if rulesSQL == "" {
+		return nil
+	}
+
+	query := fmt.Sprintf("EXPLAIN SELECT 1 FROM %s WHERE %s", config.TableName(), rulesSQL)
+	return s.sources.ReadOnly(ctx, source, func(conn querier) error {
+		var plan string
+		if err := conn.QueryRow(ctx, query).Scan(&plan); err != nil {
+			return fmt.Errorf("invalid row rules: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// checkSavedMetrics requires the admin role to change the saved metrics of a
+// dataset with row rules. Metrics are raw SQL, and a subquery in one reads
+// the table around the WHERE clause the rules are injected into.
+func checkSavedMetrics(ctx context.Context, rules []model.RowRule, current, metrics []model.SavedMetric) error {
+	if len(rules) == 0 || slices.Equal(current, metrics) {
+		return nil
+	}
+
+	return authorize(ctx, model.ADMIN)
+}
+
+// tableRules returns the row rules guarding the table, as found on any of
+// its datasets. Trashed datasets count, so deleting the dataset carrying the
+// rules doesn't lift them.
+func (s *DatasetService) tableRules(ctx context.Context, sourceID int, schema, table string) ([]model.RowRule, error) {
+	query := `
+		SELECT config->'Rules'
+		FROM datasets
+		WHERE source_id = $1 AND config->>'Schema' = $2 AND config->>'Table' = $3
+			AND config->'Rules' NOT IN ('null'::jsonb, '[]'::jsonb)
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+
+	var rules []model.RowRule
+	err := s.db.QueryRow(ctx, query, sourceID, schema, table).Scan(&rules)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve row rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// shareRules puts the row rules of the dataset on every other dataset on the
+// same table, trashed ones included, as the rules guard the table rather
+// than one view of it. Their versions move on, so edits based on the old
+// rules conflict instead of restoring them.
+func shareRules(ctx context.Context, tx pgx.Tx, id int, sourceID int, config model.DatasetConfig) error {
+	rules := config.Rules
+	if rules == nil {
+		rules = []model.RowRule{}
+	}
+
+	query := `
+		UPDATE datasets
+		SET config = jsonb_set(config, '{Rules}', $5), version = version + 1
+		WHERE source_id = $1 AND config->>'Schema' = $2 AND config->>'Table' = $3 AND id <> $4;
+	`
+
+	if _, err := tx.Exec(ctx, query, sourceID, config.Schema, config.Table, id, rules); err != nil {
+		return fmt.Errorf("failed to share row rules: %w", err)
+	}
+
+	return nil
+}
+
+// Dependents lists the charts built on the dataset and the dashboards
+// showing them.
+func (s *DatasetService) Dependents(ctx context.Context, id int) (model.Dependents, error) {
+	return findDependents(ctx, s.db, model.DATASET, id, false)
+}
+
+func (s *DatasetService) Delete(ctx context.Context, id int, mode model.DeleteMode) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if err := s.access.check(ctx, pgx.ErrNoRows, object{model.DATASET, id}); err != nil {
+		return err
+	}
+
+	deps, err := deleteEntity(ctx, s.db, model.DATASET, id, mode, nil)
+
+	s.mu.Lock()
+	s.forget(id)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	s.events.entityDeleted(ctx, model.DATASET, id, mode, deps)
+	return nil
+}
+
+// forget drops the cached profiles of the dataset under every rule set. The
+// caller holds the lock.
+func (s *DatasetService) forget(id int) {
+	maps.DeleteFunc(s.profiles, func(key profileKey, _ model.DatasetProfile) bool {
+		return key.dataset == id
+	})
+}
+
+func (s *DatasetService) source(ctx context.Context, id int) (model.Dataset, model.Source, error) {
+	dataset, err := s.Get(ctx, id)
+	if err != nil {
+		return dataset, model.Source{}, err
+	}
+
+	source, _, err := s.sources.Get(ctx, dataset.SourceID)
+	if err != nil {
+		return dataset, source, fmt.Errorf("failed to retrieve source: %w", err)
+	}
+
+	return dataset, source, nil
+}
+
+func (s *DatasetService) Preview(ctx context.Context, id int, page int, size int) (model.DatasetPreview, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return model.DatasetPreview{}, err
+	}
+
+	if page < 1 {
+		page = 1
+	}
+
+	if size < 1 {
+		size = previewDefaultSize
+	}
+
+	size = min(size, previewMaxSize)
+	preview := model.DatasetPreview{Page: page, Size: size, Rows: make([][]any, 0, size)}
+
+	dataset, source, err := s.source(ctx, id)
+	if err != nil {
+		return preview, err
+	}
+
+	selectSQL := "*"
+	if names := utils.ColumnNames(dataset.Config.Columns); len(names) > 0 {
+		selectSQL = strings.Join(names, ",")
+	}
+
+	whereSQL := "1=1"
+	if rulesSQL := utils.BuildRules(rowRules(ctx, dataset.Config)); rulesSQL != "" {
+		whereSQL = rulesSQL
+	}
+
+	// fetch one extra row to find out whether there is a next page
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %d OFFSET %d",
+		selectSQL, dataset.Config.TableName(), whereSQL, previewOrder(dataset.Config.Columns), size+1, (page-1)*size)
+
+	started := time.Now()
+	err = s.sources.ReadOnly(ctx, source, func(conn querier) error {
+		return scanPreview(ctx, conn, query, &preview)
+	})
+
+	entry := model.QueryLog{
+		DatasetID: dataset.ID,
+		SourceID:  dataset.SourceID,
+		SQL:       query,
+		Duration:  time.Since(started),
+		Rows:      len(preview.Rows),
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	s.queries.Record(ctx, entry)
+	return preview, err
+}
+
+// previewOrder sorts the preview by every column, so pages don't overlap or
+// skip rows. Rows tied on every column look the same, so their order doesn't
+// matter. Without columns the table is sorted by the physical row location.
+func previewOrder(columns []string) string {
+	if len(columns) == 0 {
+		return "ctid"
+	}
+
+	order := make([]string, len(columns))
+	for idx, column := range columns {
+		name, dataType := utils.ParseColumn(column)
+		order[idx] = name
+		if !utils.IsColumnOrderable(dataType) {
+			order[idx] = name + "::text"
+		}
+	}
+
+	return strings.Join(order, ",")
+}
+
+func scanPreview(ctx context.Context, conn querier, query string, preview *model.DatasetPreview) error {
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to preview dataset: %w", err)
+	}
+	defer rows.Close()
+
+	for _, field := range rows.FieldDescriptions() {
+		preview.Columns = append(preview.Columns, string(field.Name))
+	}
+
+	for rows.Next() {
+		scans, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if len(preview.Rows) == preview.Size {
+			preview.HasMore = true
+			break
+		}
+
+		row := make([]any, len(scans))
+		for idx, scan := range scans {
+			row[idx] = utils.ToValue(scan)
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+
+	return rows.Err()
+}
+
+func (s *DatasetService) Profile(ctx context.Context, id int) (model.DatasetProfile, error) {
+	profile := model.DatasetProfile{DatasetID: id, ComputedAt: time.Now()}
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return profile, err
+	}
+
+	// resolved ahead of the cache, so cached profiles are only handed to
+	// users who can see the dataset
+	dataset, source, err := s.source(ctx, id)
+	if err != nil {
+		return profile, err
+	}
+
+	rules := utils.BuildRules(rowRules(ctx, dataset.Config))
+	key := profileKey{dataset: id, rules: rules}
+
+	s.mu.Lock()
+	cached, found := s.profiles[key]
+	s.mu.Unlock()
+
+	if found && time.Since(cached.ComputedAt) < profileCacheTTL {
+		return cached, nil
+	}
+
+	err = s.sources.ReadOnly(ctx, source, func(conn querier) error {
+		return profileDataset(ctx, conn, dataset, rules, &profile)
+	})
+	if err != nil {
+		return profile, err
+	}
+
+	s.mu.Lock()
+	s.profiles[key] = profile
+	s.mu.Unlock()
+
+	return profile, nil
+}
+
+func profileDataset(ctx context.Context, conn querier, dataset model.Dataset, rules string, profile *model.DatasetProfile) error {
+	// pg_class only holds an estimate, which is all we need to decide on sampling
+	var estimate float64
+	query := `SELECT COALESCE(MAX(reltuples), 0) FROM pg_class WHERE oid = to_regclass($1)`
+	if err := conn.QueryRow(ctx, query, dataset.Config.TableName()).Scan(&estimate); err != nil {
+		return fmt.Errorf("failed to estimate dataset size: %w", err)
+	}
+
+	relation := dataset.Config.TableName()
+	if estimate > profileSampleRows {
+		percent := 100 * profileSampleRows / estimate
+		relation = fmt.Sprintf("%s TABLESAMPLE SYSTEM (%f)", relation, percent)
+		profile.Sampled = true
+	}
+
+	// the sample is drawn before the row rules, which the estimate knows
+	// nothing of
+	if rules != "" {
+		relation = fmt.Sprintf("(SELECT * FROM %s WHERE %s) AS ruled", relation, rules)
+	} else if profile.Sampled {
+		relation = fmt.Sprintf("(SELECT * FROM %s) AS sample", relation)
+	}
+
+	for _, col := range dataset.Config.Columns {
+		column, dataType := utils.ParseColumn(col)
+
+		stats, rows, err := profileColumn(ctx, conn, relation, column, dataType)
+		if err != nil {
+			return err
+		}
+
+		profile.Rows = rows
+		profile.Columns = append(profile.Columns, stats)
+	}
+
+	return nil
+}
+
+func profileColumn(ctx context.Context, conn querier, relation, column, dataType string) (model.ColumnProfile, int64, error) {
+	stats := model.ColumnProfile{Name: column, Type: dataType}
+
+	// numeric and date columns are bucketed by their value, resp. epoch
+	bucketExpr := "NULL::float8"
+	if utils.IsColumnNumeric(dataType) {
+		bucketExpr = fmt.Sprintf("%s::float8", column)
+	} else if utils.IsColumnDateTime(dataType) {
+		bucketExpr = fmt.Sprintf("EXTRACT(EPOCH FROM %s)::float8", column)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT COUNT(*), COUNT(%[1]s), COUNT(DISTINCT %[1]s), MIN(%[1]s)::text, MAX(%[1]s)::text, MIN(%[2]s), MAX(%[2]s)
+		FROM %[3]s
+	`, column, bucketExpr, relation)
+
+	var total, nonNull int64
+	var lower, upper *float64
+	err := conn.QueryRow(ctx, query).
+		Scan(&total, &nonNull, &stats.Distinct, &stats.Min, &stats.Max, &lower, &upper)
+	if err != nil {
+		return stats, 0, fmt.Errorf("failed to profile column %s: %w", column, err)
+	}
+
+	if total > 0 {
+		stats.NullRatio = float64(total-nonNull) / float64(total)
+	}
+
+	query = fmt.Sprintf(`
+		SELECT %[1]s::text, COUNT(*) FROM %[2]s
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT %[3]d
+	`, column, relation, profileTopValues)
+
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return stats, 0, fmt.Errorf("failed to profile column %s: %w", column, err)
+	}
+
+	for rows.Next() {
+		var item model.ValueCount
+		if err = rows.Scan(&item.Value, &item.Count); err != nil {
+			rows.Close()
+			return stats, 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		stats.TopValues = append(stats.TopValues, item)
+	}
+	rows.Close()
+
+	if lower == nil || upper == nil {
+		return stats, total, nil
+	}
+
+	stats.Histogram, err = histogram(ctx, conn, relation, bucketExpr, *lower, *upper, utils.IsColumnDateTime(dataType))
+	return stats, total, err
+}
+
+func histogram(ctx context.Context, conn querier, relation, expr string, lower, upper float64, isDate bool) ([]model.HistogramBin, error) {
+	bins := profileBins
+	if lower == upper {
+		bins = 1
+	}
+
+	width := (upper - lower) / float64(bins)
+	result := make([]model.HistogramBin, bins)
+	for idx := range result {
+		lo, hi := lower+float64(idx)*width, lower+float64(idx+1)*width
+		if isDate {
+			result[idx] = model.HistogramBin{
+				Lower: time.Unix(int64(lo), 0).UTC(),
+				Upper: time.Unix(int64(hi), 0).UTC(),
+			}
+			continue
+		}
+
+		result[idx] = model.HistogramBin{Lower: lo, Upper: hi}
+	}
+
+	if bins == 1 {
+		err := conn.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(%s) FROM %s", expr, relation)).Scan(&result[0].Count)
+		return result, err
+	}
+
+	// width_bucket puts the maximum into bucket bins+1, LEAST folds it back
+	query := fmt.Sprintf(`
+		SELECT LEAST(width_bucket(%[1]s, %[2]f, %[3]f, %[4]d), %[4]d), COUNT(*)
+		FROM %[5]s WHERE %[1]s IS NOT NULL
+		GROUP BY 1
+	`, expr, lower, upper, bins, relation)
+
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute histogram: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket int
+		var count int64
+		if err = rows.Scan(&bucket, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if bucket >= 1 && bucket <= bins {
+			result[bucket-1].Count += count
+		}
+	}
+
+	return result, rows.Err()
 }
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var ErrHasDependents = errors.New("entity has dependents")
+
+// entityTables maps each kind of entity to the table holding it.
+var entityTables = map[model.EntityKind]string{
+	model.SOURCE:    "sources",
+	model.DATASET:   "datasets",
+	model.CHART:     "charts",
+	model.DASHBOARD: "dashboards",
+}
+
+// dashboardsQuery finds dashboards whose grid references any of the charts.
+const dashboardsQuery = `
+	SELECT d.id, d.name
+	FROM dashboards d
+	WHERE EXISTS (
+		SELECT 1
+		FROM jsonb_array_elements(CASE WHEN jsonb_typeof(d.grid) = 'array' THEN d.grid ELSE '[]' END) AS item
+		WHERE (item->>'chartId')::int = ANY($1)
+	)
+`
+
+// findDependents collects everything downstream of the entity. Soft-deleted
+// dependents are only included when withDeleted is set, which is needed when
+// purging or restoring rows.
+func findDependents(ctx context.Context, conn querier, kind model.EntityKind, id int, withDeleted bool) (model.Dependents, error) {
+	var deps model.Dependents
+	var err error
+
+	if kind == model.DASHBOARD {
+		return deps, nil
+	}
+
+	live := " AND deleted_at IS NULL"
+	if withDeleted {
+		live = ""
+	}
+
+	datasets := []int{id}
+	if kind == model.SOURCE {
+		query := `SELECT id, name FROM datasets WHERE source_id = $1` + live + ` ORDER BY id`
+		if deps.Datasets, err = entityRefs(ctx, conn, query, id); err != nil {
+			return deps, err
+		}
+
+		datasets = refIDs(deps.Datasets)
+	}
+
+	charts := []int{id}
+	if kind != model.CHART {
+		query := `SELECT id, name FROM charts WHERE dataset_id = ANY($1)` + live + ` ORDER BY id`
+		if deps.Charts, err = entityRefs(ctx, conn, query, datasets); err != nil {
+			return deps, err
+		}
+
+		charts = refIDs(deps.Charts)
+	}
+
+	deps.Dashboards, err = entityRefs(ctx, conn, dashboardsQuery+live+` ORDER BY id`, charts)
+	return deps, err
+}
+
+func entityRefs(ctx context.Context, conn querier, query string, args ...any) ([]model.EntityRef, error) {
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve dependents: %w", err)
+	}
+	defer rows.Close()
+
+	refs := make([]model.EntityRef, 0)
+	for rows.Next() {
+		var ref model.EntityRef
+		if err = rows.Scan(&ref.ID, &ref.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan dependent row: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+func refIDs(refs []model.EntityRef) []int {
+	ids := make([]int, len(refs))
+	for idx, ref := range refs {
+		ids[idx] = ref.ID
+	}
+
+	return ids
+}
+
+// deleteEntity removes an entity together with everything downstream, in a
+// single transaction:
+//   - REFUSE fails with ErrHasDependents unless nothing depends on the entity,
+//   - CASCADE deletes the dependents and drops their dashboard grid entries,
+//   - SOFT marks the entity and its dependents as deleted, keeping the grids.
+//
+// cleanup runs inside the transaction after a hard delete, e.g. to drop the
+// tables of an imported CSV source. It returns the dependents that went along
+// with the entity.
+func deleteEntity(ctx context.Context, db *pgxpool.Pool, kind model.EntityKind, id int, mode model.DeleteMode, cleanup func(tx pgx.Tx) error) (model.Dependents, error) {
+	var live model.Dependents
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return live, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	live, err = findDependents(ctx, tx, kind, id, false)
+	if err != nil {
+		return live, err
+	}
+
+	if mode == model.REFUSE && !live.Empty() {
+		return live, fmt.Errorf("%w: %s %d is used by %s", ErrHasDependents, kind, id, live)
+	}
+
+	if mode == model.SOFT {
+		err = markDeleted(ctx, tx, kind, id, live)
+	} else {
+		err = purge(ctx, tx, kind, id)
+	}
+
+	if err != nil {
+		return live, err
+	}
+
+	if mode != model.SOFT && cleanup != nil {
+		if err = cleanup(tx); err != nil {
+			return live, err
+		}
+	}
+
+	return live, tx.Commit(ctx)
+}
+
+// markDeleted moves the entity and its dependents to the trash. They all share
+// the same deletion time, which is how a restore finds them again.
+func markDeleted(ctx context.Context, tx pgx.Tx, kind model.EntityKind, id int, deps model.Dependents) error {
+	datasets, charts := refIDs(deps.Datasets), refIDs(deps.Charts)
+
+	switch kind {
+	case model.SOURCE, model.DASHBOARD:
+		query := fmt.Sprintf(`UPDATE %s SET deleted_at = NOW() WHERE id = $1`, entityTables[kind])
+		if _, err := tx.Exec(ctx, query, id); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", kind, err)
+		}
+	case model.DATASET:
+		datasets = append(datasets, id)
+	case model.CHART:
+		charts = append(charts, id)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE datasets SET deleted_at = NOW() WHERE id = ANY($1)`, datasets); err != nil {
+		return fmt.Errorf("failed to delete datasets: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE charts SET deleted_at = NOW() WHERE id = ANY($1)`, charts); err != nil {
+		return fmt.Errorf("failed to delete charts: %w", err)
+	}
+
+	return nil
+}
+
+// purge deletes the entity and all of its dependents for good, soft-deleted
+// ones included, so no foreign key is left dangling. Schedules of the deleted
+// charts and dashboard go along, as do the grants of everything deleted.
+func purge(ctx context.Context, tx pgx.Tx, kind model.EntityKind, id int) error {
+	deps, err := findDependents(ctx, tx, kind, id, true)
+	if err != nil {
+		return err
+	}
+
+	datasets, charts := refIDs(deps.Datasets), refIDs(deps.Charts)
+
+	switch kind {
+	case model.DATASET:
+		datasets = append(datasets, id)
+	case model.CHART:
+		charts = append(charts, id)
+	}
+
+	query := `
+		UPDATE dashboards
+		SET grid = (
+			SELECT COALESCE(jsonb_agg(e.item ORDER BY e.pos), '[]')
+			FROM jsonb_array_elements(grid) WITH ORDINALITY AS e(item, pos)
+			WHERE NOT COALESCE((e.item->>'chartId')::int = ANY($1), false)
+		), version = version + 1
+		WHERE id = ANY($2);
+	`
+	if _, err = tx.Exec(ctx, query, charts, refIDs(deps.Dashboards)); err != nil {
+		return fmt.Errorf("failed to update dashboards: %w", err)
+	}
+
+	dashboard := 0
+	if kind == model.DASHBOARD {
+		dashboard = id
+	}
+
+	query = `DELETE FROM schedules WHERE (kind = $1 AND target_id = ANY($2)) OR (kind = $3 AND target_id = $4)`
+	if _, err = tx.Exec(ctx, query, model.CHART, charts, model.DASHBOARD, dashboard); err != nil {
+		return fmt.Errorf("failed to delete schedules: %w", err)
+	}
+
+	query = `DELETE FROM shares WHERE (kind = $1 AND target_id = ANY($2)) OR (kind = $3 AND target_id = $4)`
+	if _, err = tx.Exec(ctx, query, model.CHART, charts, model.DASHBOARD, dashboard); err != nil {
+		return fmt.Errorf("failed to delete shares: %w", err)
+	}
+
+	query = `
+		DELETE FROM grants
+		WHERE (kind = $1 AND target_id = ANY($2)) OR (kind = $3 AND target_id = ANY($4)) OR (kind = $5 AND target_id = $6)
+	`
+	if _, err = tx.Exec(ctx, query, model.CHART, charts, model.DATASET, datasets, kind, id); err != nil {
+		return fmt.Errorf("failed to delete grants: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM charts WHERE id = ANY($1)`, charts); err != nil {
+		return fmt.Errorf("failed to delete charts: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM datasets WHERE id = ANY($1)`, datasets); err != nil {
+		return fmt.Errorf("failed to delete datasets: %w", err)
+	}
+
+	if kind == model.SOURCE || kind == model.DASHBOARD {
+		query = fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, entityTables[kind])
+		if _, err = tx.Exec(ctx, query, id); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", kind, err)
+		}
+	}
+
+	return nil
+}
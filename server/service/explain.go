@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/amukoski/aaa/model"
+)
+
+var ErrGuardrail = errors.New("query rejected by source guardrails")
+
+// explain asks the planner for the estimated plan of the query. Tables that
+// are read sequentially are collected with their estimated size from pg_class.
+func explain(ctx context.Context, conn querier, query string) (model.QueryPlan, error) {
+	var plan model.QueryPlan
+
+	var raw string
+	if err := conn.QueryRow(ctx, "EXPLAIN (FORMAT JSON, VERBOSE) "+query).Scan(&raw); err != nil {
+		return plan, fmt.Errorf("failed to explain query: %w", err)
+	}
+
+	var root []struct {
+		Plan map[string]any `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(raw), &root); err != nil || len(root) == 0 {
+		return plan, fmt.Errorf("failed to parse query plan: %w", err)
+	}
+
+	top := root[0].Plan
+	plan.Plan = top
+	plan.EstimatedRows, _ = top["Plan Rows"].(float64)
+	plan.EstimatedCost, _ = top["Total Cost"].(float64)
+
+	tables := make([]string, 0)
+	walkPlan(top, func(node map[string]any) {
+		if node["Node Type"] != "Seq Scan" {
+			return
+		}
+
+		relation, _ := node["Relation Name"].(string)
+		if schema, ok := node["Schema"].(string); ok {
+			relation = fmt.Sprintf("%s.%s", schema, relation)
+		}
+
+		tables = append(tables, relation)
+	})
+
+	for _, table := range tables {
+		var rows float64
+		query := `SELECT COALESCE(MAX(reltuples), 0) FROM pg_class WHERE oid = to_regclass($1)`
+		if err := conn.QueryRow(ctx, query, table).Scan(&rows); err != nil {
+			return plan, fmt.Errorf("failed to estimate table size: %w", err)
+		}
+
+		plan.SeqScans = append(plan.SeqScans, model.SeqScan{Table: table, Rows: int64(rows)})
+	}
+
+	return plan, nil
+}
+
+func walkPlan(node map[string]any, visit func(map[string]any)) {
+	visit(node)
+
+	children, _ := node["Plans"].([]any)
+	for _, child := range children {
+		if plan, ok := child.(map[string]any); ok {
+			walkPlan(plan, visit)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/google/uuid"
+)
+
+const (
+	jobQueueSize = 100
+	jobRetention = time.Hour
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobNotDone  = errors.New("job has not finished")
+	ErrQueueFull   = errors.New("job queue is full")
+)
+
+type JobService struct {
+	charts    *ChartService
+	datasets  *DatasetService
+	workers   int
+	perSource int
+	timeout   time.Duration
+	queue     chan *job
+	mu        sync.Mutex
+	jobs      map[string]*job
+	slots     map[int]chan struct{}
+}
+
+type job struct {
+	model.Job
+	ctx    context.Context
+	cancel context.CancelFunc
+	result ChartResult
+}
+
+// NewJobService runs chart queries in the background on a pool of workers.
+// At most perSource jobs query the same source at a time and every job is
+// cancelled once it runs longer than timeout.
+func NewJobService(charts *ChartService, ds *DatasetService, workers int, perSource int, timeout time.Duration) *JobService {
+	return &JobService{
+		charts:    charts,
+		datasets:  ds,
+		workers:   workers,
+		perSource: perSource,
+		timeout:   timeout,
+		queue:     make(chan *job, jobQueueSize),
+		jobs:      make(map[string]*job),
+		slots:     make(map[int]chan struct{}),
+	}
+}
+
+// Start launches the workers, which stop when ctx is done.
+func (s *JobService) Start(ctx context.Context) {
+	for range s.workers {
+		go s.work(ctx)
+	}
+
+	go s.purge(ctx)
+}
+
+func (s *JobService) Submit(ctx context.Context, chartID int) (model.Job, error) {
+	chart, err := s.charts.Get(ctx, chartID)
+	if err != nil {
+		return model.Job{}, err
+	}
+
+	dataset, err := s.datasets.Get(ctx, chart.DatasetID)
+	if err != nil {
+		return model.Job{}, fmt.Errorf("failed to retrieve dataset: %w", err)
+	}
+
+	// jobs outlive the request, so they get their own context, acting as the
+	// same user to keep their row rules
+	jobCtx := context.Background()
+	if user, ok := CurrentUser(ctx); ok {
+		jobCtx = WithUser(jobCtx, user)
+	}
+
+	jobCtx, cancel := context.WithCancel(jobCtx)
+	j := &job{
+		Job: model.Job{
+			ID:       uuid.NewString(),
+			ChartID:  chartID,
+			SourceID: dataset.SourceID,
+			Status:   model.QUEUED,
+			QueuedAt: time.Now(),
+		},
+		ctx:    jobCtx,
+		cancel: cancel,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.queue <- j:
+		s.jobs[j.ID] = j
+		return j.Job, nil
+	default:
+		cancel()
+		return model.Job{}, ErrQueueFull
+	}
+}
+
+func (s *JobService) Get(id string) (model.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, found := s.jobs[id]
+	if !found {
+		return model.Job{}, ErrJobNotFound
+	}
+
+	return j.Job, nil
+}
+
+func (s *JobService) Result(id string) (model.Job, ChartResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, found := s.jobs[id]
+	if !found {
+		return model.Job{}, ChartResult{}, ErrJobNotFound
+	}
+
+	if !j.Done() {
+		return j.Job, ChartResult{}, ErrJobNotDone
+	}
+
+	return j.Job, j.result, nil
+}
+
+// Cancel aborts a queued or running job. Cancelling the job context makes
+// pgx cancel the running statement on the server.
+func (s *JobService) Cancel(id string) (model.Job, error) {
+	s.mu.Lock()
+	j, found := s.jobs[id]
+	s.mu.Unlock()
+
+	if !found {
+		return model.Job{}, ErrJobNotFound
+	}
+
+	j.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j.Status == model.QUEUED {
+		s.finish(j, model.CANCELLED, context.Canceled)
+	}
+
+	return j.Job, nil
+}
+
+func (s *JobService) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-s.queue:
+			s.run(j)
+		}
+	}
+}
+
+func (s *JobService) run(j *job) {
+	defer j.cancel()
+
+	slot := s.slot(j.SourceID)
+	select {
+	case slot <- struct{}{}:
+		defer func() { <-slot }()
+	case <-j.ctx.Done():
+		s.mu.Lock()
+		s.finish(j, model.CANCELLED, j.ctx.Err())
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	if j.Done() {
+		s.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	j.Status, j.StartedAt = model.RUNNING, &now
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(j.ctx, s.timeout)
+	defer cancel()
+
+	result, err := s.charts.Run(ctx, j.ChartID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case errors.Is(j.ctx.Err(), context.Canceled):
+		s.finish(j, model.CANCELLED, context.Canceled)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		s.finish(j, model.FAILED, fmt.Errorf("query exceeded the timeout of %s", s.timeout))
+	case err != nil:
+		s.finish(j, model.FAILED, err)
+	default:
+		j.result = result
+		s.finish(j, model.SUCCEEDED, nil)
+	}
+}
+
+// finish records the final state of a job. Callers must hold the lock.
+func (s *JobService) finish(j *job, status model.JobStatus, err error) {
+	if j.Done() {
+		return
+	}
+
+	now := time.Now()
+	j.Status, j.FinishedAt = status, &now
+	if err != nil {
+		j.Error = err.Error()
+	}
+}
+
+func (s *JobService) slot(sourceID int) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, found := s.slots[sourceID]
+	if !found {
+		slot = make(chan struct{}, s.perSource)
+		s.slots[sourceID] = slot
+	}
+
+	return slot
+}
+
+func (s *JobService) purge(ctx context.Context) {
+	ticker := time.NewTicker(jobRetention / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for id, j := range s.jobs {
+				if j.Done() && time.Since(*j.FinishedAt) > jobRetention {
+					delete(s.jobs, id)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+)
+
+// liveBuffer is how many tile updates a viewer may lag behind before it is
+// dropped.
+const liveBuffer = 32
+
+var ErrRefreshDisabled = errors.New("dashboard has no refresh interval")
+
+// LiveService keeps dashboards up to date for their live viewers. Viewers of
+// the same dashboard with the same filters share a single feed per user, as
+// grants decide which tiles a user gets. The feed re-runs
+// the tiles on the refresh interval of the dashboard and pushes only the tiles
+// whose data changed.
+type LiveService struct {
+	dashboards *DashboardService
+	logger     *log.Logger
+	mu         sync.Mutex
+	feeds      map[string]*feed
+}
+
+type feed struct {
+	key         string
+	dashboardID int
+	active      map[string]model.FilterValue
+	cancel      context.CancelFunc
+	viewers     map[chan model.DashboardTile]struct{}
+	latest      map[int]model.DashboardTile
+	encoded     map[int][]byte
+}
+
+func NewLiveService(dashboards *DashboardService, logger *log.Logger) *LiveService {
+	return &LiveService{dashboards: dashboards, logger: logger, feeds: make(map[string]*feed)}
+}
+
+// Subscribe adds a viewer to the feed of the dashboard with the active filters.
+// The viewer first receives the latest tiles, then every tile that changes.
+// The channel is closed when the dashboard goes away or the viewer falls
+// behind. The returned func must be called once the viewer leaves.
+func (s *LiveService) Subscribe(ctx context.Context, id int, active map[string]model.FilterValue) (<-chan model.DashboardTile, func(), error) {
+	dashboard, err := s.dashboards.load(ctx, id, active)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dashboard.RefreshInterval == 0 {
+		return nil, nil, ErrRefreshDisabled
+	}
+
+	// maps are encoded with sorted keys, so equal filters give equal keys
+	user, signedIn := CurrentUser(ctx)
+	key, err := json.Marshal(struct {
+		ID     int
+		User   int
+		Active map[string]model.FilterValue
+	}{id, user.ID, active})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, found := s.feeds[string(key)]
+	if !found {
+		// the feed outlives the request, but keeps acting as the viewer
+		feedCtx := context.Background()
+		if signedIn {
+			feedCtx = WithUser(feedCtx, user)
+		}
+
+		feedCtx, cancel := context.WithCancel(feedCtx)
+		f = &feed{
+			key:         string(key),
+			dashboardID: id,
+			active:      active,
+			cancel:      cancel,
+			viewers:     make(map[chan model.DashboardTile]struct{}),
+			latest:      make(map[int]model.DashboardTile),
+			encoded:     make(map[int][]byte),
+		}
+		s.feeds[f.key] = f
+
+		go s.refresh(feedCtx, f)
+	}
+
+	viewer := make(chan model.DashboardTile, len(f.latest)+liveBuffer)
+	for _, tile := range f.latest {
+		viewer <- tile
+	}
+	f.viewers[viewer] = struct{}{}
+
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.drop(f, viewer)
+	}
+
+	return viewer, unsubscribe, nil
+}
+
+// refresh re-runs the tiles of the feed until its last viewer leaves. The
+// dashboard is reloaded every time, so grid and interval changes apply on the
+// next refresh. Results the query cache got within the interval, e.g. from
+// another feed, are reused.
+func (s *LiveService) refresh(ctx context.Context, f *feed) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		dashboard, err := s.dashboards.load(ctx, f.dashboardID, f.active)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// deleted, lost one of the active filters or no longer refreshes itself
+		if err != nil || dashboard.RefreshInterval == 0 {
+			s.close(f)
+			return
+		}
+
+		tiles, err := s.dashboards.prepareTiles(ctx, dashboard, f.active, nil)
+		if err != nil {
+			s.logger.Printf("live dashboard %d: %v", f.dashboardID, err)
+		} else {
+			seen := make(map[int]bool, len(tiles))
+			s.dashboards.runTiles(ctx, tiles, dashboard.RefreshInterval, func(_ int, tile model.DashboardTile) {
+				seen[tile.ChartID] = true
+				s.push(f, tile)
+			})
+
+			s.prune(f, seen)
+		}
+
+		timer.Reset(dashboard.RefreshInterval)
+	}
+}
+
+// push sends the tile to the viewers of the feed, unless it is unchanged.
+// Viewers that fell behind are dropped.
+func (s *LiveService) push(f *feed, tile model.DashboardTile) {
+	encoded, err := json.Marshal(tile)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil && bytes.Equal(f.encoded[tile.ChartID], encoded) {
+		return
+	}
+
+	f.latest[tile.ChartID], f.encoded[tile.ChartID] = tile, encoded
+	for viewer := range f.viewers {
+		select {
+		case viewer <- tile:
+		default:
+			s.drop(f, viewer)
+		}
+	}
+}
+
+// prune forgets the tiles that are no longer on the grid, so viewers joining
+// later don't receive them.
+func (s *LiveService) prune(f *feed, seen map[int]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for chartID := range f.latest {
+		if !seen[chartID] {
+			delete(f.latest, chartID)
+			delete(f.encoded, chartID)
+		}
+	}
+}
+
+func (s *LiveService) close(f *feed) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for viewer := range f.viewers {
+		s.drop(f, viewer)
+	}
+}
+
+// drop removes the viewer from the feed and stops the feed once nobody is
+// watching. Callers must hold the lock.
+func (s *LiveService) drop(f *feed, viewer chan model.DashboardTile) {
+	if _, found := f.viewers[viewer]; !found {
+		return
+	}
+
+	delete(f.viewers, viewer)
+	close(viewer)
+
+	if len(f.viewers) == 0 {
+		f.cancel()
+		if s.feeds[f.key] == f {
+			delete(s.feeds, f.key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Attachment is a file sent along with an email.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Mailer delivers emails over SMTP. Without credentials it sends without
+// authenticating, e.g. to a local SMTP sink during development.
+type Mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewMailer(addr string, from string, username string, password string) *Mailer {
+	mailer := &Mailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return mailer
+}
+
+// Send mails the recipients, which may be written with a display name, e.g.
+// "Jane Doe <jane@example.com>".
+func (m *Mailer) Send(to []string, subject string, body string, attachments ...Attachment) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return fmt.Errorf("invalid sender %s: %w", m.from, err)
+	}
+
+	// the SMTP envelope takes bare addresses, the headers the formatted ones
+	recipients, headers := make([]string, len(to)), make([]string, len(to))
+	for idx, recipient := range to {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %s: %w", recipient, err)
+		}
+		recipients[idx], headers[idx] = address.Address, address.String()
+	}
+
+	var msg bytes.Buffer
+	writer := multipart.NewWriter(&msg)
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(headers, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+
+	if _, err = part.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if err = attach(writer, attachment); err != nil {
+			return err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	if err = smtp.SendMail(m.addr, m.auth, from.Address, recipients, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+func attach(writer *multipart.Writer, attachment Attachment) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {attachment.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+	})
+	if err != nil {
+		return err
+	}
+
+	// base64 lines must not exceed 76 characters
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 76 {
+		if _, err = part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+
+	_, err = part.Write([]byte(encoded))
+	return err
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	queryDefaultLimit   = 100
+	queryMaxLimit       = 1000
+	insightsDefaultSize = 10
+)
+
+type QueryService struct {
+	db *pgxpool.Pool
+}
+
+func NewQueryService(db *pgxpool.Pool) *QueryService {
+	return &QueryService{db: db}
+}
+
+// Record appends an executed query to the log. Logging is best effort and
+// never fails the query it describes, so errors are dropped.
+func (s *QueryService) Record(ctx context.Context, entry model.QueryLog) {
+	query := `
+		INSERT INTO queries (chart_id, dataset_id, source_id, sql, duration_ms, row_count, cache_hit, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''));
+	`
+
+	// the request may already be cancelled, which is worth logging as well
+	_, _ = s.db.Exec(context.WithoutCancel(ctx), query,
+		entry.ChartID, entry.DatasetID, entry.SourceID, entry.SQL,
+		float64(entry.Duration.Microseconds())/1000, entry.Rows, entry.CacheHit, entry.Error)
+}
+
+// All lists the logged queries. The log holds the SQL run against every
+// source, so only admins read it.
+func (s *QueryService) All(ctx context.Context, filter model.QueryFilter) ([]model.QueryLog, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return nil, err
+	}
+
+	where, args := buildQueryFilter(filter)
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = queryDefaultLimit
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, chart_id, dataset_id, source_id, sql, duration_ms, row_count, cache_hit, COALESCE(error, ''), created_at
+		FROM queries q WHERE %s
+		ORDER BY created_at DESC
+		LIMIT %d
+	`, where, min(limit, queryMaxLimit))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve queries: %w", err)
+	}
+	defer rows.Close()
+
+	queries := make([]model.QueryLog, 0)
+	for rows.Next() {
+		var entry model.QueryLog
+		var duration float64
+		err = rows.Scan(&entry.ID, &entry.ChartID, &entry.DatasetID, &entry.SourceID, &entry.SQL,
+			&duration, &entry.Rows, &entry.CacheHit, &entry.Error, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan query row: %w", err)
+		}
+
+		entry.Duration = milliseconds(duration)
+		queries = append(queries, entry)
+	}
+
+	return queries, nil
+}
+
+// Insights ranks charts by their average duration and datasets by the total
+// time spent querying them, considering only queries in the filter window.
+func (s *QueryService) Insights(ctx context.Context, filter model.QueryFilter) (model.QueryInsights, error) {
+	var insights model.QueryInsights
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return insights, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = insightsDefaultSize
+	}
+
+	where, args := buildQueryFilter(filter)
+
+	charts, err := s.stats(ctx, "chart_id", "charts", "AVG(q.duration_ms)", where, args, limit)
+	if err != nil {
+		return insights, err
+	}
+
+	datasets, err := s.stats(ctx, "dataset_id", "datasets", "SUM(q.duration_ms)", where, args, limit)
+	if err != nil {
+		return insights, err
+	}
+
+	insights.SlowestCharts = charts
+	insights.ExpensiveDatasets = datasets
+	return insights, nil
+}
+
+func (s *QueryService) stats(ctx context.Context, column, table, rank, where string, args []any, limit int) ([]model.QueryStats, error) {
+	query := fmt.Sprintf(`
+		SELECT q.%[1]s, COALESCE(MAX(t.name), ''), COUNT(*), COUNT(q.error), COUNT(*) FILTER (WHERE q.cache_hit),
+		       AVG(q.duration_ms), PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY q.duration_ms),
+		       MAX(q.duration_ms), SUM(q.duration_ms), COALESCE(AVG(q.row_count), 0)
+		FROM queries q LEFT JOIN %[2]s t ON t.id = q.%[1]s
+		WHERE q.%[1]s IS NOT NULL AND %[3]s
+		GROUP BY q.%[1]s
+		ORDER BY %[4]s DESC
+		LIMIT %[5]d
+	`, column, table, where, rank, min(limit, queryMaxLimit))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate queries: %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]model.QueryStats, 0)
+	for rows.Next() {
+		var stats model.QueryStats
+		var avg, p95, peak, total float64
+		err = rows.Scan(&stats.ID, &stats.Name, &stats.Queries, &stats.Failures, &stats.CacheHits,
+			&avg, &p95, &peak, &total, &stats.AvgRows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan query stats: %w", err)
+		}
+
+		stats.AvgDuration, stats.P95Duration = milliseconds(avg), milliseconds(p95)
+		stats.MaxDuration, stats.TotalDuration = milliseconds(peak), milliseconds(total)
+		result = append(result, stats)
+	}
+
+	return result, nil
+}
+
+func buildQueryFilter(filter model.QueryFilter) (string, []any) {
+	conditions, args := []string{"1=1"}, make([]any, 0)
+
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ChartID > 0 {
+		add("q.chart_id = $%d", filter.ChartID)
+	}
+
+	if filter.DatasetID > 0 {
+		add("q.dataset_id = $%d", filter.DatasetID)
+	}
+
+	if filter.SourceID > 0 {
+		add("q.source_id = $%d", filter.SourceID)
+	}
+
+	if filter.Failed {
+		conditions = append(conditions, "q.error IS NOT NULL")
+	}
+
+	if filter.MinDuration > 0 {
+		add("q.duration_ms >= $%d", float64(filter.MinDuration.Milliseconds()))
+	}
+
+	if !filter.Since.IsZero() {
+		add("q.created_at >= $%d", filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		add("q.created_at < $%d", filter.Until)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+func milliseconds(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -50,14 +50,23 @@ var barTemplate = `
 	  "fontWeight": "bold"
 	}
   },
+  "tooltip": {
+	"trigger": "axis"
+  },
   "legend": {
 	"bottom": 0,
 	"data": {{.LegendJSON}}
   },
   "xAxis": {
+    "name": {{.XNameJSON}},
     "data": {{.XAxisJSON}}
   },
-  "yAxis": {},
+  "yAxis": {
+    "name": {{.ValueNameJSON}},
+    "axisLabel": {
+      "formatter": {{.FormatterJSON}}
+    }
+  },
   "series": {{.SeriesJSON}}
 }
 `
@@ -79,8 +88,8 @@ func (l *BarChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *BarChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{Label: name}
+func (l *BarChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
 	is2D := len(groups) == 1
 	is3D := len(groups) == 2
 
@@ -89,6 +98,7 @@ func (l *BarChart) Render(name string, groups [][]string, values [][]float64) (a
 		req.Series = []Series{
 			{
 				Type: string(model.BAR),
+				Name: req.ValueName,
 				Data: values[0],
 			},
 		}
@@ -74,10 +74,15 @@ var heatmapTemplate = `
   "grid": {
     "height": "70%"
   },
+  "tooltip": {
+    "position": "top"
+  },
   "xAxis": {
+    "name": {{.XNameJSON}},
     "data": {{.XAxisUniqueJSON}}
   },
   "yAxis": {
+    "name": {{.YNameJSON}},
     "data": {{.YAxisUniqueJSON}}
   },
   "visualMap": {
@@ -90,6 +95,7 @@ var heatmapTemplate = `
   "series": [
     {
       "type": "heatmap",
+      "name": {{.ValueNameJSON}},
       "label": {
         "show": true
       },
@@ -120,13 +126,11 @@ func (l *HeatmapChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *HeatmapChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{
-		Label:  name,
-		XAxis:  groups[0],
-		YAxis:  groups[0],
-		Values: values[0],
-	}
+func (l *HeatmapChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
+	req.XAxis = groups[0]
+	req.YAxis = groups[0]
+	req.Values = values[0]
 
 	is3D := len(groups) == 2
 	if is3D {
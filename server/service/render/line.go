@@ -47,14 +47,23 @@ var lineTemplate = `
 	  "fontWeight": "bold"
 	}
   },
+  "tooltip": {
+	"trigger": "axis"
+  },
   "legend": {
 	"bottom": 0,
 	"data": {{.LegendJSON}}
   },
   "xAxis": {
+    "name": {{.XNameJSON}},
     "data": {{.XAxisJSON}}
   },
-  "yAxis": {},
+  "yAxis": {
+    "name": {{.ValueNameJSON}},
+    "axisLabel": {
+      "formatter": {{.FormatterJSON}}
+    }
+  },
   "series": {{.SeriesJSON}}
 }
 `
@@ -76,8 +85,8 @@ func (l *LineChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *LineChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{Label: name}
+func (l *LineChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
 	is2D := len(groups) == 1
 	is3D := len(groups) == 2
 
@@ -86,6 +95,7 @@ func (l *LineChart) Render(name string, groups [][]string, values [][]float64) (
 		req.Series = []Series{
 			{
 				Type: string(model.LINE),
+				Name: req.ValueName,
 				Data: values[0],
 			},
 		}
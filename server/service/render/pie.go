@@ -50,9 +50,13 @@ var pieTemplate = `
 	  "fontWeight": "bold"
 	}
   },
+  "tooltip": {
+    "trigger": "item"
+  },
   "series": [
     {
       "type": "pie",
+      "name": {{.ValueNameJSON}},
 	  "radius": ["40%","70%"],
 	  "avoidLabelOverlap": false,
 	  "itemStyle": {
@@ -89,12 +93,10 @@ func (l *PieChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *PieChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{
-		Label:  name,
-		XAxis:  groups[0],
-		Values: values[0],
-	}
+func (l *PieChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
+	req.XAxis = groups[0]
+	req.Values = values[0]
 
 	var buf bytes.Buffer
 	if err := l.tmpl.Execute(&buf, req); err != nil {
@@ -3,18 +3,25 @@ package render
 import (
 	"encoding/json"
 	"github.com/samber/lo"
+	"math"
 	"slices"
+
+	"github.com/amukoski/aaa/model"
 )
 
 type M map[string]interface{}
 
 type Model struct {
-	Label  string
-	Legend []string
-	XAxis  []string
-	YAxis  []string
-	Values []float64
-	Series []Series
+	Label     string
+	XName     string
+	YName     string
+	ValueName string
+	Formatter string
+	Legend    []string
+	XAxis     []string
+	YAxis     []string
+	Values    []float64
+	Series    []Series
 }
 
 type Series struct {
@@ -23,6 +30,74 @@ type Series struct {
 	Data []float64 `json:"data"`
 }
 
+func (s Series) MarshalJSON() ([]byte, error) {
+	type series Series
+	return json.Marshal(struct {
+		series
+		Data []*float64 `json:"data"`
+	}{series: series(s), Data: nullable(s.Data)})
+}
+
+// nullable maps NaN, which marks a gap filled with null, to a JSON null.
+func nullable(values []float64) []*float64 {
+	result := make([]*float64, len(values))
+	for idx := range values {
+		if !math.IsNaN(values[idx]) {
+			result[idx] = &values[idx]
+		}
+	}
+
+	return result
+}
+
+func finite(values []float64) []float64 {
+	return lo.Filter(values, func(v float64, _ int) bool {
+		return !math.IsNaN(v)
+	})
+}
+
+// NewModel prepares a render model with axis names and value formatting
+// resolved from the chart fields.
+func NewModel(name string, fields model.ChartFields) Model {
+	m := Model{Label: name, Formatter: "{value}"}
+
+	if len(fields.Dimensions) > 0 {
+		m.XName = fields.Dimensions[0].Name()
+		m.YName = m.XName
+	}
+
+	if len(fields.Dimensions) > 1 {
+		m.YName = fields.Dimensions[1].Name()
+	}
+
+	if len(fields.Metrics) > 0 {
+		m.ValueName = fields.Metrics[0].Name()
+		m.Formatter = fields.Metrics[0].Formatter()
+	}
+
+	return m
+}
+
+func (m Model) XNameJSON() string {
+	rsp, _ := json.Marshal(m.XName)
+	return string(rsp)
+}
+
+func (m Model) YNameJSON() string {
+	rsp, _ := json.Marshal(m.YName)
+	return string(rsp)
+}
+
+func (m Model) ValueNameJSON() string {
+	rsp, _ := json.Marshal(m.ValueName)
+	return string(rsp)
+}
+
+func (m Model) FormatterJSON() string {
+	rsp, _ := json.Marshal(m.Formatter)
+	return string(rsp)
+}
+
 func (m Model) LegendJSON() string {
 	rsp, _ := json.Marshal(m.Legend)
 	return string(rsp)
@@ -49,14 +124,15 @@ func (m Model) YAxisUniqueJSON() string {
 }
 
 func (m Model) ValuesJSON() string {
-	rsp, _ := json.Marshal(m.Values)
+	rsp, _ := json.Marshal(nullable(m.Values))
 	return string(rsp)
 }
 
 func (m Model) ValuesJSONMap() string {
+	values := nullable(m.Values)
 	result := make([]map[string]any, len(m.XAxis))
 	for idx := range len(m.XAxis) {
-		result[idx] = map[string]any{"name": m.XAxis[idx], "value": m.Values[idx]}
+		result[idx] = map[string]any{"name": m.XAxis[idx], "value": values[idx]}
 	}
 
 	rsp, _ := json.Marshal(result)
@@ -75,6 +151,10 @@ func (m Model) ValuesTupleJSON() string {
 	result := make([][]float64, 0)
 	for i := range len(m.XAxis) {
 		x, y, z := m.XAxis[i], m.YAxis[i], m.Values[i]
+		if math.IsNaN(z) {
+			continue
+		}
+
 		x1, y1 := slices.Index(xAxis, x), slices.Index(yAxis, y)
 		tuple := []float64{float64(x1), float64(y1), z}
 		result = append(result, tuple)
@@ -85,11 +165,19 @@ func (m Model) ValuesTupleJSON() string {
 }
 
 func (m Model) ValuesMin() float64 {
-	return slices.Min(m.Values)
+	if values := finite(m.Values); len(values) > 0 {
+		return slices.Min(values)
+	}
+
+	return 0
 }
 
 func (m Model) ValuesMax() float64 {
-	return slices.Max(m.Values)
+	if values := finite(m.Values); len(values) > 0 {
+		return slices.Max(values)
+	}
+
+	return 0
 }
 
 func (m Model) LabelString() string {
@@ -132,7 +220,9 @@ func (m Model) LinkValuesJSON() string {
 	result := make([]Record, 0)
 	if !slices.Equal(m.XAxis, m.YAxis) {
 		for idx, y := range m.YAxis {
-			result = append(result, Record{Source: y, Target: m.XAxis[idx], Value: m.Values[idx]})
+			if !math.IsNaN(m.Values[idx]) {
+				result = append(result, Record{Source: y, Target: m.XAxis[idx], Value: m.Values[idx]})
+			}
 		}
 
 		for _, x := range m.XAxis {
@@ -147,7 +237,9 @@ func (m Model) LinkValuesJSON() string {
 		}
 	} else {
 		for idx, x := range m.XAxis {
-			result = append(result, Record{Source: x, Target: "", Value: m.Values[idx]})
+			if !math.IsNaN(m.Values[idx]) {
+				result = append(result, Record{Source: x, Target: "", Value: m.Values[idx]})
+			}
 		}
 	}
 
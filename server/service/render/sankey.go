@@ -103,8 +103,12 @@ var sankeyTemplate = `
 	  "fontWeight": "bold"
 	}
   },
+  "tooltip": {
+    "trigger": "item"
+  },
   "series": {
     "type": "sankey",
+    "name": {{.ValueNameJSON}},
     "draggable": false,
 	"left": "5%",
 	"top": "5%",
@@ -133,13 +137,11 @@ func (l *SankeyChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *SankeyChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{
-		Label:  name,
-		XAxis:  groups[0],
-		YAxis:  groups[0],
-		Values: values[0],
-	}
+func (l *SankeyChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
+	req.XAxis = groups[0]
+	req.YAxis = groups[0]
+	req.Values = values[0]
 
 	is3D := len(groups) == 2
 	if is3D {
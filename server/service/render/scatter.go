@@ -51,14 +51,23 @@ var scatterTemplate = `
 	  "fontWeight": "bold"
 	}
   },
+  "tooltip": {
+	"trigger": "axis"
+  },
   "legend": {
 	"bottom": 0,
 	"data": {{.LegendJSON}}
   },
   "xAxis": {
+    "name": {{.XNameJSON}},
     "data": {{.XAxisJSON}}
   },
-  "yAxis": {},
+  "yAxis": {
+    "name": {{.ValueNameJSON}},
+    "axisLabel": {
+      "formatter": {{.FormatterJSON}}
+    }
+  },
   "series": {{.SeriesJSON}}
 }
 `
@@ -80,8 +89,8 @@ func (l *ScatterChart) Schema() model.ChartSchema {
 	}
 }
 
-func (l *ScatterChart) Render(name string, groups [][]string, values [][]float64) (any, error) {
-	req := Model{Label: name}
+func (l *ScatterChart) Render(name string, fields model.ChartFields, groups [][]string, values [][]float64) (any, error) {
+	req := NewModel(name, fields)
 	is2D := len(groups) == 1
 	is3D := len(groups) == 2
 
@@ -90,6 +99,7 @@ func (l *ScatterChart) Render(name string, groups [][]string, values [][]float64
 		req.Series = []Series{
 			{
 				Type: string(model.SCATTER),
+				Name: req.ValueName,
 				Data: values[0],
 			},
 		}
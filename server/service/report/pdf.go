@@ -0,0 +1,132 @@
+package report
+
+import (
+	"bytes"
+	"image/color"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const (
+	pdfMargin      = 12.0
+	pdfChartHeight = 90.0
+	pdfRowHeight   = 6.0
+	// pdfMaxRows caps the rows listed below a chart.
+	pdfMaxRows = 100
+)
+
+type pdfCanvas struct {
+	doc       *fpdf.Fpdf
+	translate func(string) string
+}
+
+func (c pdfCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	c.doc.SetFillColor(int(col.R), int(col.G), int(col.B))
+	c.doc.Rect(x, y, w, h, "F")
+}
+
+func (c pdfCanvas) text(x, y float64, s string, col color.RGBA) {
+	c.doc.SetTextColor(int(col.R), int(col.G), int(col.B))
+	c.doc.Text(x, y, c.translate(s))
+}
+
+func (c pdfCanvas) textWidth(s string) float64 {
+	return c.doc.GetStringWidth(c.translate(s))
+}
+
+func (c pdfCanvas) lineHeight() float64 {
+	_, size := c.doc.GetFontSize()
+	return size * 1.3
+}
+
+// PDF renders the report as an A4 landscape document, with a page per table
+// holding its chart and rows.
+func PDF(report model.Report) ([]byte, error) {
+	doc := fpdf.New("L", "mm", "A4", "")
+	doc.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	doc.SetAutoPageBreak(true, pdfMargin)
+	doc.SetTitle(report.Title, true)
+
+	// the core fonts only cover cp1252
+	cv := pdfCanvas{doc: doc, translate: doc.UnicodeTranslatorFromDescriptor("")}
+	width, _ := doc.GetPageSize()
+	width -= 2 * pdfMargin
+
+	if len(report.Tables) == 0 {
+		doc.AddPage()
+		header(cv, report)
+	}
+
+	for _, table := range report.Tables {
+		doc.AddPage()
+		header(cv, report)
+
+		doc.SetFont("Helvetica", "B", 13)
+		cv.text(pdfMargin, doc.GetY(), table.Name, black)
+		doc.SetY(doc.GetY() + 4)
+
+		doc.SetFont("Helvetica", "", 8)
+		if table.Error != "" {
+			cv.text(pdfMargin, doc.GetY()+4, "Failed to run: "+table.Error, palette[3])
+			continue
+		}
+
+		drawChart(cv, table, pdfMargin, doc.GetY(), width, pdfChartHeight)
+		doc.SetY(doc.GetY() + pdfChartHeight + 4)
+		rowsTable(cv, table, width)
+	}
+
+	var buf bytes.Buffer
+	err := doc.Output(&buf)
+	return buf.Bytes(), err
+}
+
+func header(cv pdfCanvas, report model.Report) {
+	cv.doc.SetFont("Helvetica", "B", 16)
+	cv.text(pdfMargin, pdfMargin+6, report.Title, black)
+
+	cv.doc.SetFont("Helvetica", "", 8)
+	cv.text(pdfMargin, pdfMargin+11, report.GeneratedAt.Format("2006-01-02 15:04 MST"), black)
+	cv.doc.SetY(pdfMargin + 20)
+}
+
+func rowsTable(cv pdfCanvas, table model.ChartTable, width float64) {
+	doc := cv.doc
+	columns := append(append([]string{}, table.Dimensions...), table.Metrics...)
+	if len(columns) == 0 {
+		return
+	}
+
+	cell := width / float64(len(columns))
+
+	doc.SetFont("Helvetica", "B", 8)
+	doc.SetFillColor(0xee, 0xee, 0xee)
+	doc.SetTextColor(int(black.R), int(black.G), int(black.B))
+	for idx, column := range columns {
+		align := "L"
+		if idx >= len(table.Dimensions) {
+			align = "R"
+		}
+		doc.CellFormat(cell, pdfRowHeight, cv.translate(column), "B", 0, align, true, 0, "")
+	}
+	doc.Ln(-1)
+
+	doc.SetFont("Helvetica", "", 8)
+	rows := rowCount(table)
+	for row := range min(rows, pdfMaxRows) {
+		for _, group := range table.Groups {
+			doc.CellFormat(cell, pdfRowHeight, cv.translate(group[row]), "", 0, "L", false, 0, "")
+		}
+
+		for _, series := range table.Values {
+			doc.CellFormat(cell, pdfRowHeight, formatValue(series[row]), "", 0, "R", false, 0, "")
+		}
+		doc.Ln(-1)
+	}
+
+	if rows > pdfMaxRows || table.Truncated {
+		doc.CellFormat(width, pdfRowHeight, "Rows omitted.", "", 1, "L", false, 0, "")
+	}
+}
@@ -0,0 +1,78 @@
+package report
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"github.com/amukoski/aaa/model"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	pngWidth       = 1200
+	pngMargin      = 24
+	pngHeader      = 60
+	pngPanelHeight = 420
+)
+
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func (c pngCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	r := image.Rect(int(x), int(y), int(x+w+0.5), int(y+h+0.5))
+	draw.Draw(c.img, r, image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+func (c pngCanvas) text(x, y float64, s string, col color.RGBA) {
+	d := font.Drawer{
+		Dst:  c.img,
+		Src:  image.NewUniform(col),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(int(x), int(y)),
+	}
+	d.DrawString(s)
+}
+
+func (c pngCanvas) textWidth(s string) float64 {
+	return float64(font.MeasureString(basicfont.Face7x13, s).Ceil())
+}
+
+func (c pngCanvas) lineHeight() float64 {
+	return 16
+}
+
+// PNG renders the report as a single image with the charts stacked below
+// each other.
+func PNG(report model.Report) ([]byte, error) {
+	height := pngHeader + pngPanelHeight*max(len(report.Tables), 1)
+	img := image.NewRGBA(image.Rect(0, 0, pngWidth, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	cv := pngCanvas{img: img}
+	cv.text(pngMargin, pngMargin+4, report.Title, black)
+	cv.text(pngMargin, pngMargin+22, report.GeneratedAt.Format("2006-01-02 15:04 MST"), black)
+
+	for idx, table := range report.Tables {
+		y := float64(pngHeader + idx*pngPanelHeight)
+		cv.rect(pngMargin, y, pngWidth-2*pngMargin, 1, grey)
+		cv.text(pngMargin, y+24, table.Name, black)
+
+		if table.Error != "" {
+			cv.text(pngMargin, y+48, "Failed to run: "+table.Error, palette[3])
+			continue
+		}
+
+		drawChart(cv, table, pngMargin, y+36, pngWidth-2*pngMargin, pngPanelHeight-48)
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,169 @@
+// Package report renders dashboard and chart snapshots to PDF and PNG for
+// delivery outside the browser. Every table is drawn as a bar chart of its
+// metrics, whatever the type of the chart it comes from.
+package report
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/amukoski/aaa/model"
+)
+
+// maxBars caps the rows drawn in a chart; tables list more.
+const maxBars = 30
+
+// palette follows the default ECharts series colors, so reports match what
+// users see in the browser.
+var palette = []color.RGBA{
+	{0x54, 0x70, 0xc6, 0xff},
+	{0x91, 0xcc, 0x75, 0xff},
+	{0xfa, 0xc8, 0x58, 0xff},
+	{0xee, 0x66, 0x66, 0xff},
+	{0x73, 0xc0, 0xde, 0xff},
+	{0x3b, 0xa2, 0x72, 0xff},
+	{0xfc, 0x84, 0x52, 0xff},
+	{0x9a, 0x60, 0xb4, 0xff},
+}
+
+var (
+	black = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	grey  = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+)
+
+// canvas is what a chart is drawn on. Coordinates grow right and down, in
+// the units of the output, and text is positioned by its baseline.
+type canvas interface {
+	rect(x, y, w, h float64, c color.RGBA)
+	text(x, y float64, s string, c color.RGBA)
+	textWidth(s string) float64
+	lineHeight() float64
+}
+
+// drawChart draws the table as grouped bars, one color per metric, with a
+// legend above and the row labels below.
+func drawChart(cv canvas, table model.ChartTable, x, y, w, h float64) {
+	lh := cv.lineHeight()
+
+	// legend
+	lx := x
+	for idx, metric := range table.Metrics {
+		cv.rect(lx, y, lh*0.8, lh*0.8, palette[idx%len(palette)])
+		cv.text(lx+lh, y+lh*0.8, metric, black)
+		lx += lh*2 + cv.textWidth(metric)
+	}
+
+	rows := rowCount(table)
+	if rows == 0 {
+		cv.text(x, y+lh*3, "No data", black)
+		return
+	}
+	rows = min(rows, maxBars)
+
+	lower, upper := bounds(table.Values, rows)
+	top, bottom := y+lh*2, y+h-lh*1.5
+	scale := (bottom - top) / (upper - lower)
+	baseline := bottom + lower*scale
+
+	// axis labels left of the plot
+	labelWidth := max(cv.textWidth(formatValue(upper)), cv.textWidth(formatValue(lower))) + lh/2
+	plotX, plotW := x+labelWidth, w-labelWidth
+	if plotW <= 0 {
+		return
+	}
+
+	cv.text(x, top+lh/2, formatValue(upper), black)
+	cv.text(x, bottom, formatValue(lower), black)
+	cv.rect(plotX, baseline, plotW, math.Max(lh/16, 0.2), grey)
+
+	slot := plotW / float64(rows)
+	bar := slot * 0.8 / float64(max(len(table.Values), 1))
+
+	// only label every step-th row when the labels don't fit
+	step := 1
+	for widest := widestLabel(cv, table, rows); widest*1.1 > slot*float64(step); step++ {
+	}
+
+	for row := range rows {
+		sx := plotX + slot*float64(row) + slot*0.1
+		for idx, series := range table.Values {
+			v := series[row]
+			if math.IsNaN(v) {
+				continue
+			}
+
+			bx, bh := sx+bar*float64(idx), v*scale
+			if bh >= 0 {
+				cv.rect(bx, baseline-bh, bar, bh, palette[idx%len(palette)])
+			} else {
+				cv.rect(bx, baseline, bar, -bh, palette[idx%len(palette)])
+			}
+		}
+
+		if row%step == 0 {
+			cv.text(plotX+slot*float64(row), bottom+lh*1.2, rowLabel(table, row), black)
+		}
+	}
+}
+
+func rowCount(table model.ChartTable) int {
+	if len(table.Groups) > 0 {
+		return len(table.Groups[0])
+	}
+
+	if len(table.Values) > 0 {
+		return len(table.Values[0])
+	}
+
+	return 0
+}
+
+// rowLabel joins the group values of the row, e.g. "2024-01-01 / Europe".
+func rowLabel(table model.ChartTable, row int) string {
+	parts := make([]string, len(table.Groups))
+	for idx, group := range table.Groups {
+		parts[idx] = group[row]
+	}
+
+	return strings.Join(parts, " / ")
+}
+
+func widestLabel(cv canvas, table model.ChartTable, rows int) float64 {
+	widest := 0.0
+	for row := range rows {
+		widest = math.Max(widest, cv.textWidth(rowLabel(table, row)))
+	}
+
+	return widest
+}
+
+// bounds returns the value range of the first rows, always including zero.
+func bounds(values [][]float64, rows int) (float64, float64) {
+	lower, upper := 0.0, 0.0
+	for _, series := range values {
+		for _, v := range series[:rows] {
+			if !math.IsNaN(v) {
+				lower, upper = math.Min(lower, v), math.Max(upper, v)
+			}
+		}
+	}
+
+	if lower == upper {
+		upper = lower + 1
+	}
+
+	return lower, upper
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "-"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return fmt.Sprintf("%.0f", v)
+	default:
+		return fmt.Sprintf("%.2f", v)
+	}
+}
@@ -0,0 +1,287 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	ErrChartNotFound    = errors.New("chart not found")
+	ErrRevisionNotFound = errors.New("chart revision not found")
+)
+
+type UpdateChartReq struct {
+	ID         int
+	DatasetID  int
+	Name       string
+	Type       string
+	Dimensions []string
+	Metrics    []string
+	Filters    []string
+	Sort       *model.ChartSort
+	Limit      int
+	TopN       int
+	Having     []model.Having
+	GapFill    string
+	Calendar   *model.ChartCalendar
+	Transforms []model.Transform
+	DrillPath  []string
+}
+
+// Update replaces the chart in place, so dashboards keep referencing it. The
+// state it replaces is kept as a new revision.
+func (s *ChartService) Update(ctx context.Context, req UpdateChartReq) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	if _, err := s.Get(ctx, req.ID); err != nil {
+		return ErrChartNotFound
+	}
+
+	chart := model.Chart{
+		ID:        req.ID,
+		DatasetID: req.DatasetID,
+		Name:      req.Name,
+		Type:      model.ChartType(req.Type),
+		Config: model.ChartConfig{
+			Dimensions: req.Dimensions,
+			Metrics:    req.Metrics,
+			Filters:    req.Filters,
+			Sort:       req.Sort,
+			Limit:      req.Limit,
+			TopN:       req.TopN,
+			Having:     req.Having,
+			GapFill:    req.GapFill,
+			Calendar:   req.Calendar,
+			Transforms: req.Transforms,
+			DrillPath:  req.DrillPath,
+		},
+	}
+
+	return s.update(ctx, chart)
+}
+
+// Revert restores the chart to one of its revisions. The current state is
+// kept as a revision as well, so a revert can itself be reverted.
+func (s *ChartService) Revert(ctx context.Context, id int, version int) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	revision, err := s.Revision(ctx, id, version)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, revision.Chart)
+}
+
+func (s *ChartService) update(ctx context.Context, chart model.Chart) error {
+	if _, found := s.registry[chart.Type]; !found {
+		return fmt.Errorf("unknown chart type: %s", chart.Type)
+	}
+
+	dataset, err := s.datasets.Get(ctx, chart.DatasetID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve dataset: %w", err)
+	}
+
+	if err = validateConfig(chart.Config, dataset.Config); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// the row lock serializes concurrent updates, so versions stay gapless
+	query := `SELECT id FROM charts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+	err = tx.QueryRow(ctx, query, chart.ID).Scan(&chart.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrChartNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to retrieve chart: %w", err)
+	}
+
+	query = `
+		INSERT INTO chart_revisions (chart_id, version, dataset_id, name, type, config, author_id, created_at)
+		SELECT c.id, COALESCE(MAX(r.version), 0) + 1, c.dataset_id, c.name, c.type, c.config, c.updated_by, c.updated_at
+		FROM charts c
+		LEFT JOIN chart_revisions r ON r.chart_id = c.id
+		WHERE c.id = $1
+		GROUP BY c.id;
+	`
+	if _, err = tx.Exec(ctx, query, chart.ID); err != nil {
+		return fmt.Errorf("failed to save chart revision: %w", err)
+	}
+
+	query = `
+		UPDATE charts
+		SET dataset_id = $2, name = $3, type = $4, config = $5, updated_by = $6, updated_at = NOW()
+		WHERE id = $1;
+	`
+	_, err = tx.Exec(ctx, query, chart.ID, chart.DatasetID, chart.Name, chart.Type, chart.Config, actor(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to update chart: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	s.events.entityChanged(ctx, model.CHART, chart.ID, chart.Name)
+	return nil
+}
+
+// Revisions lists the prior states of the chart, newest first.
+func (s *ChartService) Revisions(ctx context.Context, id int) ([]model.ChartRevision, error) {
+	query := `
+		SELECT version, dataset_id, name, type, config, author_id, created_at
+		FROM chart_revisions
+		WHERE chart_id = $1
+		ORDER BY version DESC;
+	`
+
+	// the history of a chart is as restricted as the chart itself
+	if _, err := s.Get(ctx, id); errors.Is(err, ErrChartNotFound) {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chart revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := make([]model.ChartRevision, 0)
+	for rows.Next() {
+		revision := model.ChartRevision{ChartID: id}
+		err = rows.Scan(&revision.Version, &revision.Chart.DatasetID, &revision.Chart.Name,
+			&revision.Chart.Type, &revision.Chart.Config, &revision.AuthorID, &revision.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan chart revision row: %w", err)
+		}
+
+		revision.Chart.ID = id
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// Revision returns a single revision of the chart. Version 0 stands for the
+// current state of the chart.
+func (s *ChartService) Revision(ctx context.Context, id int, version int) (model.ChartRevision, error) {
+	revision := model.ChartRevision{ChartID: id, Version: version}
+
+	if version == 0 {
+		chart, err := s.Get(ctx, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return revision, ErrChartNotFound
+		}
+
+		if err != nil {
+			return revision, err
+		}
+
+		revision.Chart, revision.AuthorID, revision.CreatedAt = chart, chart.UpdatedBy, chart.UpdatedAt
+		return revision, nil
+	}
+
+	query := `
+		SELECT dataset_id, name, type, config, author_id, created_at
+		FROM chart_revisions
+		WHERE chart_id = $1 AND version = $2;
+	`
+
+	if _, err := s.Get(ctx, id); errors.Is(err, ErrChartNotFound) {
+		return revision, err
+	}
+
+	err := s.db.QueryRow(ctx, query, id, version).Scan(&revision.Chart.DatasetID, &revision.Chart.Name,
+		&revision.Chart.Type, &revision.Chart.Config, &revision.AuthorID, &revision.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return revision, ErrRevisionNotFound
+	}
+
+	if err != nil {
+		return revision, fmt.Errorf("failed to retrieve chart revision: %w", err)
+	}
+
+	revision.Chart.ID = id
+	return revision, nil
+}
+
+// Diff lists the fields that changed between two versions of the chart. The
+// fields are named after their JSON keys, e.g. "name" or "dimensions".
+func (s *ChartService) Diff(ctx context.Context, id int, from int, to int) ([]model.ChartChange, error) {
+	before, err := s.Revision(ctx, id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := s.Revision(ctx, id, to)
+	if err != nil {
+		return nil, err
+	}
+
+	beforeFields, err := chartFields(before.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	afterFields, err := chartFields(after.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	union := maps.Clone(beforeFields)
+	maps.Copy(union, afterFields)
+
+	changes := make([]model.ChartChange, 0)
+	for _, key := range slices.Sorted(maps.Keys(union)) {
+		if !reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+			changes = append(changes, model.ChartChange{
+				Field:  key,
+				Before: beforeFields[key],
+				After:  afterFields[key],
+			})
+		}
+	}
+
+	return changes, nil
+}
+
+// chartFields flattens the chart and its config into JSON values by key, so
+// nested settings such as the sort compare as a whole.
+func chartFields(chart model.Chart) (map[string]any, error) {
+	raw, err := json.Marshal(chart.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chart config: %w", err)
+	}
+
+	fields := make(map[string]any)
+	if err = json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("failed to decode chart config: %w", err)
+	}
+
+	fields["datasetId"] = float64(chart.DatasetID)
+	fields["name"] = chart.Name
+	fields["type"] = string(chart.Type)
+
+	return fields, nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service/utils"
+)
+
+// builtinAttributes are filled in from the user themselves, so they can't be
+// set as attributes.
+var builtinAttributes = []string{"id", "email"}
+
+// rowRules renders the row rules of the dataset for the user the context
+// acts as. Admins see every row. Unlike grants, rules also hold without a
+// user, as for scheduled reports, alerts and share links, where placeholders
+// have nothing to fill them and so match no rows.
+func rowRules(ctx context.Context, config model.DatasetConfig) []string {
+	user, ok := CurrentUser(ctx)
+	if (ok && user.Role == model.ADMIN) || len(config.Rules) == 0 {
+		return nil
+	}
+
+	attributes := make(map[string][]string, len(user.Attributes)+len(builtinAttributes))
+	maps.Copy(attributes, user.Attributes)
+	if ok {
+		attributes["id"] = []string{strconv.Itoa(user.ID)}
+		attributes["email"] = []string{user.Email}
+	}
+
+	rules := make([]string, len(config.Rules))
+	for idx, rule := range config.Rules {
+		rules[idx] = utils.RenderRule(rule.Expression, attributes)
+	}
+
+	return rules
+}
+
+func validateRules(rules []model.RowRule) error {
+	names := make(map[string]bool, len(rules))
+
+	for _, rule := range rules {
+		if rule.Name == "" || rule.Expression == "" {
+			return errors.New("row rule requires a name and an expression")
+		}
+
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate row rule: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := utils.ValidateRule(rule.Expression); err != nil {
+			return fmt.Errorf("invalid row rule %s: %w", rule.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,544 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/amukoski/aaa/model"
+	"github.com/amukoski/aaa/service/report"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	scheduleTick     = 30 * time.Second
+	deliveryAttempts = 5
+	deliveryBackoff  = time.Minute
+	maxBackoff       = time.Hour
+	// deliveryLease keeps other instances away from a delivery being attempted.
+	deliveryLease = 10 * time.Minute
+	deliveryBatch = 10
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+)
+
+const scheduleColumns = `id, name, kind, target_id, cron, timezone, format, recipients, enabled, next_run_at`
+
+// ScheduleService emails dashboards and charts on cron schedules. Runs that
+// come due are queued as deliveries in the metadata DB, which are attempted
+// until sent, backing off between failures, and kept as the history of the
+// schedule.
+type ScheduleService struct {
+	db         *pgxpool.Pool
+	charts     *ChartService
+	dashboards *DashboardService
+	mailer     *Mailer
+	logger     *log.Logger
+}
+
+func NewScheduleService(db *pgxpool.Pool, charts *ChartService, dashboards *DashboardService, mailer *Mailer, logger *log.Logger) *ScheduleService {
+	return &ScheduleService{db: db, charts: charts, dashboards: dashboards, mailer: mailer, logger: logger}
+}
+
+// Start runs the scheduler until ctx is done.
+func (s *ScheduleService) Start(ctx context.Context) {
+	go s.loop(ctx)
+}
+
+func (s *ScheduleService) All(ctx context.Context) ([]model.Schedule, error) {
+	rows, err := s.db.Query(ctx, `SELECT `+scheduleColumns+` FROM schedules ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := make([]model.Schedule, 0)
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule row: %w", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *ScheduleService) Get(ctx context.Context, id int) (model.Schedule, error) {
+	schedule, err := scanSchedule(s.db.QueryRow(ctx, `SELECT `+scheduleColumns+` FROM schedules WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return schedule, ErrScheduleNotFound
+	}
+
+	if err != nil {
+		return schedule, fmt.Errorf("failed to retrieve schedule: %w", err)
+	}
+
+	return schedule, nil
+}
+
+func scanSchedule(row pgx.Row) (model.Schedule, error) {
+	var schedule model.Schedule
+	err := row.Scan(&schedule.ID, &schedule.Name, &schedule.Kind, &schedule.TargetID, &schedule.Cron,
+		&schedule.Timezone, &schedule.Format, &schedule.Recipients, &schedule.Enabled, &schedule.NextRunAt)
+
+	return schedule, err
+}
+
+type ScheduleReq struct {
+	ID         int
+	Name       string
+	Kind       model.EntityKind
+	TargetID   int
+	Cron       string
+	Timezone   string
+	Format     model.ReportFormat
+	Recipients []string
+	Enabled    bool
+}
+
+func (s *ScheduleService) Create(ctx context.Context, req ScheduleReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	next, err := s.validate(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO schedules (name, kind, target_id, cron, timezone, format, recipients, enabled, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id;
+	`
+
+	var id int
+	err = s.db.QueryRow(ctx, query, req.Name, req.Kind, req.TargetID, req.Cron, req.Timezone, req.Format,
+		req.Recipients, req.Enabled, next).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert schedule: %w", err)
+	}
+
+	return id, nil
+}
+
+// Update replaces the schedule. The next run is computed again, so runs
+// missed while the schedule was disabled are not caught up.
+func (s *ScheduleService) Update(ctx context.Context, req ScheduleReq) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	next, err := s.validate(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE schedules
+		SET name = $2, kind = $3, target_id = $4, cron = $5, timezone = $6, format = $7, recipients = $8,
+			enabled = $9, next_run_at = $10
+		WHERE id = $1;
+	`
+
+	tag, err := s.db.Exec(ctx, query, req.ID, req.Name, req.Kind, req.TargetID, req.Cron, req.Timezone,
+		req.Format, req.Recipients, req.Enabled, next)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrScheduleNotFound
+	}
+
+	return nil
+}
+
+// Delete removes the schedule along with its delivery history.
+func (s *ScheduleService) Delete(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM schedules WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrScheduleNotFound
+	}
+
+	return nil
+}
+
+// validate checks the schedule and returns its next run.
+func (s *ScheduleService) validate(ctx context.Context, req ScheduleReq) (time.Time, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return time.Time{}, fmt.Errorf("%w: name is required", ErrInvalidSchedule)
+	}
+
+	if !slices.Contains(model.SupportedReportFormats, req.Format) {
+		return time.Time{}, fmt.Errorf("%w: unknown format %s", ErrInvalidSchedule, req.Format)
+	}
+
+	if len(req.Recipients) == 0 {
+		return time.Time{}, fmt.Errorf("%w: at least one recipient is required", ErrInvalidSchedule)
+	}
+
+	for _, recipient := range req.Recipients {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid recipient %s", ErrInvalidSchedule, recipient)
+		}
+	}
+
+	switch req.Kind {
+	case model.CHART:
+		if _, err := s.charts.Get(ctx, req.TargetID); err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s %d not found", ErrInvalidSchedule, req.Kind, req.TargetID)
+		}
+	case model.DASHBOARD:
+		dashboard, err := s.dashboards.Get(ctx, req.TargetID)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s %d not found", ErrInvalidSchedule, req.Kind, req.TargetID)
+		}
+
+		// deliveries run without a user, so they may not reveal hidden tiles
+		if err = s.dashboards.checkTiles(ctx, dashboard); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		return time.Time{}, fmt.Errorf("%w: only dashboards and charts can be scheduled", ErrInvalidSchedule)
+	}
+
+	next, err := nextRun(req.Cron, req.Timezone, time.Now())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidSchedule, err)
+	}
+
+	return next, nil
+}
+
+// nextRun returns when the cron expression fires next after the given time,
+// evaluated in the time zone, e.g. "0 8 * * 1" in Europe/Amsterdam.
+func nextRun(expr string, timezone string, after time.Time) (time.Time, error) {
+	if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+		return time.Time{}, errors.New("time zone must be set separately from the cron expression")
+	}
+
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unknown time zone: %s", timezone)
+	}
+
+	next := schedule.Next(after.In(loc))
+	if next.IsZero() {
+		return time.Time{}, errors.New("cron expression never fires")
+	}
+
+	return next, nil
+}
+
+// RunNow queues a delivery of the schedule right away, outside its cron.
+func (s *ScheduleService) RunNow(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO deliveries (schedule_id, scheduled_for, status) VALUES ($1, NOW(), $2)`
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(ctx, query, id, model.PENDING); err != nil {
+		return fmt.Errorf("failed to queue delivery: %w", err)
+	}
+
+	return nil
+}
+
+// Deliveries returns the delivery history of the schedule, most recent
+// first.
+func (s *ScheduleService) Deliveries(ctx context.Context, id int, limit int) ([]model.Delivery, error) {
+	query := `
+		SELECT id, schedule_id, scheduled_for, status, attempts, COALESCE(error, ''), delivered_at, created_at
+		FROM deliveries
+		WHERE schedule_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, query, id, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]model.Delivery, 0)
+	for rows.Next() {
+		var d model.Delivery
+		err = rows.Scan(&d.ID, &d.ScheduleID, &d.ScheduledFor, &d.Status, &d.Attempts, &d.Error, &d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery row: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (s *ScheduleService) loop(ctx context.Context) {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+
+	for {
+		if err := s.enqueueDue(ctx); err != nil {
+			s.logger.Printf("scheduler: %v", err)
+		}
+
+		if err := s.deliverDue(ctx); err != nil {
+			s.logger.Printf("scheduler: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueDue queues a delivery for every schedule whose run came due and
+// moves it to its next run. Runs missed while the server was down collapse
+// into a single delivery.
+func (s *ScheduleService) enqueueDue(ctx context.Context) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	query := `
+		SELECT id, cron, timezone, next_run_at
+		FROM schedules
+		WHERE enabled AND next_run_at <= NOW()
+		FOR UPDATE SKIP LOCKED
+	`
+
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve due schedules: %w", err)
+	}
+
+	type due struct {
+		id       int
+		cron     string
+		timezone string
+		runAt    time.Time
+	}
+
+	schedules := make([]due, 0)
+	for rows.Next() {
+		var d due
+		if err = rows.Scan(&d.id, &d.cron, &d.timezone, &d.runAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan schedule row: %w", err)
+		}
+		schedules = append(schedules, d)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to retrieve due schedules: %w", err)
+	}
+
+	for _, d := range schedules {
+		query = `INSERT INTO deliveries (schedule_id, scheduled_for, status) VALUES ($1, $2, $3)`
+		if _, err = tx.Exec(ctx, query, d.id, d.runAt, model.PENDING); err != nil {
+			return fmt.Errorf("failed to queue delivery: %w", err)
+		}
+
+		// a schedule that no longer parses stops instead of firing every tick
+		var next *time.Time
+		if at, err := nextRun(d.cron, d.timezone, time.Now()); err == nil {
+			next = &at
+		}
+
+		if _, err = tx.Exec(ctx, `UPDATE schedules SET next_run_at = $2 WHERE id = $1`, d.id, next); err != nil {
+			return fmt.Errorf("failed to update schedule: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// deliverDue attempts the deliveries that are due. Each claimed delivery is
+// leased, so a crashed attempt is picked up again once the lease runs out.
+func (s *ScheduleService) deliverDue(ctx context.Context) error {
+	query := `
+		UPDATE deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $1)
+		FROM schedules s
+		WHERE s.id = d.schedule_id AND d.id IN (
+			SELECT id
+			FROM deliveries
+			WHERE status IN ($3, $4) AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.attempts, s.id, s.name, s.kind, s.target_id, s.timezone, s.format, s.recipients
+	`
+
+	rows, err := s.db.Query(ctx, query, deliveryLease.Seconds(), deliveryBatch, model.PENDING, model.RETRYING)
+	if err != nil {
+		return fmt.Errorf("failed to claim deliveries: %w", err)
+	}
+
+	type claimed struct {
+		id       int
+		attempts int
+		schedule model.Schedule
+	}
+
+	deliveries := make([]claimed, 0)
+	for rows.Next() {
+		var c claimed
+		err = rows.Scan(&c.id, &c.attempts, &c.schedule.ID, &c.schedule.Name, &c.schedule.Kind,
+			&c.schedule.TargetID, &c.schedule.Timezone, &c.schedule.Format, &c.schedule.Recipients)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan delivery row: %w", err)
+		}
+		deliveries = append(deliveries, c)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to claim deliveries: %w", err)
+	}
+
+	for _, c := range deliveries {
+		if err = s.deliver(ctx, c.schedule); err == nil {
+			query = `UPDATE deliveries SET status = $2, error = NULL, delivered_at = NOW() WHERE id = $1`
+			_, err = s.db.Exec(ctx, query, c.id, model.SENT)
+		} else {
+			s.logger.Printf("schedule %d, delivery %d, attempt %d: %v", c.schedule.ID, c.id, c.attempts, err)
+
+			status := model.RETRYING
+			if c.attempts >= deliveryAttempts {
+				status = model.UNDELIVERED
+			}
+
+			query = `
+				UPDATE deliveries
+				SET status = $2, error = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+				WHERE id = $1
+			`
+			_, err = s.db.Exec(ctx, query, c.id, status, err.Error(), backoff(c.attempts).Seconds())
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to update delivery: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// backoff doubles the wait after every failed attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	wait := deliveryBackoff
+	for range attempts - 1 {
+		if wait *= 2; wait >= maxBackoff {
+			return maxBackoff
+		}
+	}
+
+	return wait
+}
+
+// deliver renders the target of the schedule and emails it.
+func (s *ScheduleService) deliver(ctx context.Context, schedule model.Schedule) error {
+	snapshot, err := s.snapshot(ctx, schedule)
+	if err != nil {
+		return err
+	}
+
+	if loc, err := time.LoadLocation(schedule.Timezone); err == nil {
+		snapshot.GeneratedAt = snapshot.GeneratedAt.In(loc)
+	}
+
+	attachment := Attachment{Name: fileName(snapshot.Title) + "." + string(schedule.Format)}
+	switch schedule.Format {
+	case model.PNG:
+		attachment.ContentType = "image/png"
+		attachment.Data, err = report.PNG(snapshot)
+	default:
+		attachment.ContentType = "application/pdf"
+		attachment.Data, err = report.PDF(snapshot)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+
+	subject := fmt.Sprintf("%s: %s", schedule.Name, snapshot.Title)
+	body := fmt.Sprintf("%s as of %s is attached.\r\n", snapshot.Title, snapshot.GeneratedAt.Format("2006-01-02 15:04 MST"))
+
+	return s.mailer.Send(schedule.Recipients, subject, body, attachment)
+}
+
+func (s *ScheduleService) snapshot(ctx context.Context, schedule model.Schedule) (model.Report, error) {
+	if schedule.Kind == model.DASHBOARD {
+		return s.dashboards.Report(ctx, schedule.TargetID)
+	}
+
+	chart, err := s.charts.Get(ctx, schedule.TargetID)
+	if err != nil {
+		return model.Report{}, err
+	}
+
+	table, err := s.charts.Table(ctx, chart, nil)
+	if err != nil {
+		return model.Report{}, err
+	}
+
+	return model.Report{Title: chart.Name, GeneratedAt: time.Now(), Tables: []model.ChartTable{table}}, nil
+}
+
+// fileName turns a title into a safe attachment name, e.g. "Sales-Q1".
+func fileName(title string) string {
+	words := strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) == 0 {
+		return "report"
+	}
+
+	return strings.Join(words, "-")
+}
@@ -0,0 +1,423 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	ErrShareNotFound     = errors.New("share not found")
+	ErrInvalidShare      = errors.New("invalid share")
+	ErrInvalidShareToken = errors.New("invalid share token")
+	ErrShareExpired      = errors.New("share expired")
+	ErrShareRevoked      = errors.New("share revoked")
+	ErrLockedFilter      = errors.New("filter is locked by the share")
+)
+
+const shareColumns = `id, name, kind, target_id, locked, expires_at, revoked_at, created_at`
+
+// ShareService hands out tokens for read-only access to dashboards and charts
+// without an account, e.g. for partners or embedding in other sites. Tokens
+// carry the share ID signed with the server secret, so they can't be guessed,
+// while revocation and expiry are looked up in the metadata DB.
+type ShareService struct {
+	db         *pgxpool.Pool
+	dashboards *DashboardService
+	charts     *ChartService
+	secret     []byte
+}
+
+func NewShareService(db *pgxpool.Pool, dashboards *DashboardService, charts *ChartService, secret []byte) *ShareService {
+	return &ShareService{db: db, dashboards: dashboards, charts: charts, secret: secret}
+}
+
+// All lists the shares of the dashboards and charts the user sees, revoked
+// ones included. The token of a share grants its target to anyone, so the
+// shares of targets hidden from the user are left out.
+func (s *ShareService) All(ctx context.Context) ([]model.Share, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT `+shareColumns+` FROM shares ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve shares: %w", err)
+	}
+	defer rows.Close()
+
+	shares := make([]model.Share, 0)
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan share row: %w", err)
+		}
+		shares = append(shares, share)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visible := make([]model.Share, 0, len(shares))
+	for _, share := range shares {
+		err = s.checkTarget(ctx, share)
+		if errors.Is(err, ErrShareNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		visible = append(visible, share)
+	}
+
+	return visible, nil
+}
+
+// Get returns the share, unless its target is hidden from the user.
+func (s *ShareService) Get(ctx context.Context, id int) (model.Share, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return model.Share{}, err
+	}
+
+	share, err := s.get(ctx, id)
+	if err != nil {
+		return share, err
+	}
+
+	return share, s.checkTarget(ctx, share)
+}
+
+func (s *ShareService) get(ctx context.Context, id int) (model.Share, error) {
+	share, err := scanShare(s.db.QueryRow(ctx, `SELECT `+shareColumns+` FROM shares WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return share, ErrShareNotFound
+	}
+
+	if err != nil {
+		return share, fmt.Errorf("failed to retrieve share: %w", err)
+	}
+
+	return share, nil
+}
+
+// checkTarget fails with ErrShareNotFound unless the user sees the target of
+// the share, all of the tiles of a shared dashboard included, as Create
+// requires. Admins see the shares of trashed targets as well.
+func (s *ShareService) checkTarget(ctx context.Context, share model.Share) error {
+	if user, ok := CurrentUser(ctx); !ok || user.Role == model.ADMIN {
+		return nil
+	}
+
+	switch share.Kind {
+	case model.DASHBOARD:
+		dashboard, err := s.dashboards.Get(ctx, share.TargetID)
+		if errors.Is(err, ErrDashboardNotFound) {
+			return ErrShareNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = s.dashboards.checkTiles(ctx, dashboard); errors.Is(err, ErrForbidden) {
+			return ErrShareNotFound
+		}
+
+		return err
+	case model.CHART:
+		_, err := s.charts.Get(ctx, share.TargetID)
+		if errors.Is(err, ErrChartNotFound) || errors.Is(err, pgx.ErrNoRows) {
+			return ErrShareNotFound
+		}
+
+		return err
+	}
+
+	return ErrShareNotFound
+}
+
+func scanShare(row pgx.Row) (model.Share, error) {
+	var share model.Share
+	err := row.Scan(&share.ID, &share.Name, &share.Kind, &share.TargetID, &share.Locked, &share.ExpiresAt,
+		&share.RevokedAt, &share.CreatedAt)
+
+	return share, err
+}
+
+type ShareReq struct {
+	Name      string
+	Kind      model.EntityKind
+	TargetID  int
+	Locked    map[string]model.FilterValue
+	ExpiresAt *time.Time
+}
+
+// Create shares the dashboard or chart. Shares can't be changed afterwards,
+// only revoked, so a token always grants what it did when handed out.
+func (s *ShareService) Create(ctx context.Context, req ShareReq) (int, error) {
+	if err := authorize(ctx, model.EDITOR); err != nil {
+		return 0, err
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		return 0, fmt.Errorf("%w: name is required", ErrInvalidShare)
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return 0, fmt.Errorf("%w: expiry must be in the future", ErrInvalidShare)
+	}
+
+	switch req.Kind {
+	case model.DASHBOARD:
+		dashboard, err := s.dashboards.Get(ctx, req.TargetID)
+		if err != nil {
+			return 0, fmt.Errorf("%w: dashboard %d not found", ErrInvalidShare, req.TargetID)
+		}
+
+		if err = s.dashboards.checkTiles(ctx, dashboard); err != nil {
+			return 0, err
+		}
+
+		if err = validateLocked(dashboard.Filters, req.Locked); err != nil {
+			return 0, err
+		}
+	case model.CHART:
+		if _, err := s.charts.Get(ctx, req.TargetID); err != nil {
+			return 0, fmt.Errorf("%w: chart %d not found", ErrInvalidShare, req.TargetID)
+		}
+
+		if len(req.Locked) > 0 {
+			return 0, fmt.Errorf("%w: charts have no filters to lock", ErrInvalidShare)
+		}
+	default:
+		return 0, fmt.Errorf("%w: only dashboards and charts can be shared", ErrInvalidShare)
+	}
+
+	if req.Locked == nil {
+		req.Locked = map[string]model.FilterValue{}
+	}
+
+	query := `
+		INSERT INTO shares (name, kind, target_id, locked, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id;
+	`
+
+	var id int
+	err := s.db.QueryRow(ctx, query, req.Name, req.Kind, req.TargetID, req.Locked, req.ExpiresAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert share: %w", err)
+	}
+
+	return id, nil
+}
+
+// validateLocked checks the locked values against the filters of the
+// dashboard.
+func validateLocked(filters []model.DashboardFilter, locked map[string]model.FilterValue) error {
+	for name, value := range locked {
+		idx := slices.IndexFunc(filters, func(f model.DashboardFilter) bool { return f.Name == name })
+		if idx == -1 {
+			return fmt.Errorf("%w: unknown dashboard filter %s", ErrInvalidShare, name)
+		}
+
+		switch filters[idx].Type {
+		case model.ValuesFilter:
+			if len(value.Values) == 0 || value.From != "" || value.To != "" {
+				return fmt.Errorf("%w: locked filter %s needs values", ErrInvalidShare, name)
+			}
+		case model.DateRangeFilter:
+			if (value.From == "" && value.To == "") || len(value.Values) > 0 {
+				return fmt.Errorf("%w: locked filter %s needs a date range", ErrInvalidShare, name)
+			}
+
+			for _, bound := range []string{value.From, value.To} {
+				if bound != "" && !isDate(bound) {
+					return fmt.Errorf("%w: invalid date for filter %s: %s", ErrInvalidShare, name, bound)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Revoke invalidates the tokens of the share for good. Like creating one, it
+// takes seeing the target.
+func (s *ShareService) Revoke(ctx context.Context, id int) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, `UPDATE shares SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrShareNotFound
+	}
+
+	return nil
+}
+
+// shareClaims is the signed part of a share token.
+type shareClaims struct {
+	ShareID int   `json:"sid"`
+	Expires int64 `json:"exp,omitempty"`
+}
+
+// Token returns the token of the share, "<claims>.<signature>" with both
+// parts base64url encoded. The same share always yields the same token.
+func (s *ShareService) Token(share model.Share) string {
+	claims := shareClaims{ShareID: share.ID}
+	if share.ExpiresAt != nil {
+		claims.Expires = share.ExpiresAt.Unix()
+	}
+
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + s.sign(encoded)
+}
+
+func (s *ShareService) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Resolve returns the share a token grants, as long as it is still valid.
+func (s *ShareService) Resolve(ctx context.Context, token string) (model.Share, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return model.Share{}, ErrInvalidShareToken
+	}
+
+	var claims shareClaims
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return model.Share{}, ErrInvalidShareToken
+	}
+
+	if claims.Expires > 0 && time.Now().Unix() >= claims.Expires {
+		return model.Share{}, ErrShareExpired
+	}
+
+	share, err := s.get(ctx, claims.ShareID)
+	if errors.Is(err, ErrShareNotFound) {
+		return share, ErrInvalidShareToken
+	}
+
+	if err != nil {
+		return share, err
+	}
+
+	if share.RevokedAt != nil {
+		return share, ErrShareRevoked
+	}
+
+	if share.ExpiresAt != nil && !time.Now().Before(*share.ExpiresAt) {
+		return share, ErrShareExpired
+	}
+
+	return share, nil
+}
+
+// Dashboard returns the shared dashboard.
+func (s *ShareService) Dashboard(ctx context.Context, share model.Share) (model.Dashboard, error) {
+	if share.Kind != model.DASHBOARD {
+		return model.Dashboard{}, ErrDashboardNotFound
+	}
+
+	return s.dashboards.Get(ctx, share.TargetID)
+}
+
+// DashboardData runs the tiles of the shared dashboard with the requested
+// filter values, held to the locked ones.
+func (s *ShareService) DashboardData(ctx context.Context, share model.Share, requested map[string]model.FilterValue) ([]model.DashboardTile, error) {
+	if share.Kind != model.DASHBOARD {
+		return nil, ErrDashboardNotFound
+	}
+
+	active, err := lockFilters(share.Locked, requested)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make(map[string]bool, len(share.Locked))
+	for name := range share.Locked {
+		locked[name] = true
+	}
+
+	// a locked filter removed from the dashboard since fails the run, and one
+	// that doesn't apply to a tile fails the tile, rather than silently
+	// widening what the share shows
+	return s.dashboards.data(ctx, share.TargetID, active, locked)
+}
+
+// lockFilters merges the requested filter values with the locked ones. A
+// locked values filter applies all its values unless narrowed to some of
+// them, a locked date range applies as is.
+func lockFilters(locked map[string]model.FilterValue, requested map[string]model.FilterValue) (map[string]model.FilterValue, error) {
+	active := make(map[string]model.FilterValue, len(requested)+len(locked))
+	for name, value := range requested {
+		active[name] = value
+	}
+
+	for name, lock := range locked {
+		value, found := requested[name]
+
+		if len(lock.Values) > 0 {
+			if found && len(value.Values) > 0 {
+				for _, v := range value.Values {
+					if !slices.Contains(lock.Values, v) {
+						return nil, fmt.Errorf("%w: %s is not allowed for %s", ErrLockedFilter, v, name)
+					}
+				}
+
+				active[name] = model.FilterValue{Values: value.Values}
+				continue
+			}
+		} else if found && (value.From != lock.From || value.To != lock.To || len(value.Values) > 0) {
+			return nil, fmt.Errorf("%w: %s", ErrLockedFilter, name)
+		}
+
+		active[name] = lock
+	}
+
+	return active, nil
+}
+
+// Chart returns the shared chart.
+func (s *ShareService) Chart(ctx context.Context, share model.Share) (model.Chart, error) {
+	if share.Kind != model.CHART {
+		return model.Chart{}, ErrChartNotFound
+	}
+
+	return s.charts.Get(ctx, share.TargetID)
+}
+
+// ChartData renders the shared chart.
+func (s *ShareService) ChartData(ctx context.Context, share model.Share) (ChartResult, error) {
+	if share.Kind != model.CHART {
+		return ChartResult{}, ErrChartNotFound
+	}
+
+	return s.charts.Run(ctx, share.TargetID)
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/amukoski/aaa/service/utils"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -27,16 +29,41 @@ const (
 	tmpUploadDir  = "uploads"
 )
 
+var (
+	ErrQueryTimeout  = errors.New("query exceeded the statement timeout")
+	ErrLockTimeout   = errors.New("query exceeded the lock timeout")
+	ErrQueryCanceled = errors.New("query was cancelled")
+	ErrReadOnly      = errors.New("query attempted to modify a read-only source")
+)
+
+// querier is satisfied by pools and transactions alike.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 type SourceService struct {
-	db *pgxpool.Pool
+	db               *pgxpool.Pool
+	access           *AccessService
+	events           *WebhookService
+	statementTimeout time.Duration
+	lockTimeout      time.Duration
 }
 
-func NewSourceService(db *pgxpool.Pool) *SourceService {
-	return &SourceService{db: db}
+// NewSourceService creates the source service. The timeouts apply to every
+// query against source data unless the source guardrails override them.
+func NewSourceService(db *pgxpool.Pool, access *AccessService, events *WebhookService, statementTimeout time.Duration, lockTimeout time.Duration) *SourceService {
+	return &SourceService{
+		db:               db,
+		access:           access,
+		events:           events,
+		statementTimeout: statementTimeout,
+		lockTimeout:      lockTimeout,
+	}
 }
 
 func (s *SourceService) All(ctx context.Context) ([]model.Source, error) {
-	rows, err := s.db.Query(ctx, `SELECT id, name, type FROM sources`)
+	rows, err := s.db.Query(ctx, `SELECT id, name, type FROM sources WHERE deleted_at IS NULL`)
 	if err != nil {
 		return nil, errors.New("failed to retrieve sources")
 	}
@@ -51,33 +78,137 @@ func (s *SourceService) All(ctx context.Context) ([]model.Source, error) {
 		sources = append(sources, source)
 	}
 
-	return sources, nil
+	return visible(ctx, s.access, sources, func(source model.Source) []object {
+		return []object{{model.SOURCE, source.ID}}
+	})
 }
 
 func (s *SourceService) Get(ctx context.Context, id int) (model.Source, []model.DatasetConfig, error) {
 	source := model.Source{ID: id}
-	err := s.db.QueryRow(ctx, `SELECT id, name, type, config FROM sources WHERE id = $1`, id).
-		Scan(&source.ID, &source.Name, &source.Type, &source.Config)
+	query := `SELECT id, name, type, config, created_by, updated_by FROM sources WHERE id = $1 AND deleted_at IS NULL`
+	err := s.db.QueryRow(ctx, query, id).
+		Scan(&source.ID, &source.Name, &source.Type, &source.Config, &source.CreatedBy, &source.UpdatedBy)
+	if err == nil {
+		err = s.access.check(ctx, pgx.ErrNoRows, object{model.SOURCE, id})
+	}
 
 	return source, source.Config.Datasets, err
 }
 
+// Connect returns a pool for querying the data behind the source. CSV sources
+// are imported into the metadata database, so their pool is shared and the
+// returned release func is a no-op.
+func (s *SourceService) Connect(ctx context.Context, source model.Source) (*pgxpool.Pool, func(), error) {
+	if source.Type != model.POSTGRES {
+		return s.db, func() {}, nil
+	}
+
+	conn, err := pgxpool.Connect(ctx, source.Config.DatabaseURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return conn, conn.Close, nil
+}
+
+// ReadOnly runs fn inside a read-only transaction on the source data, with
+// the statement and lock timeouts of the source applied. Aborted queries are
+// reported as ErrQueryTimeout, ErrLockTimeout, ErrQueryCanceled or ErrReadOnly.
+func (s *SourceService) ReadOnly(ctx context.Context, source model.Source, fn func(conn querier) error) error {
+	conn, release, err := s.Connect(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return s.readOnly(ctx, conn, source.Config.Guardrails, fn)
+}
+
+func (s *SourceService) readOnly(ctx context.Context, conn *pgxpool.Pool, guardrails *model.Guardrails, fn func(conn querier) error) error {
+	statementTimeout, lockTimeout := s.statementTimeout, s.lockTimeout
+
+	// background jobs run under their own, longer deadline
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > statementTimeout {
+		statementTimeout = time.Until(deadline)
+	}
+
+	if guardrails != nil && guardrails.StatementTimeout > 0 {
+		statementTimeout = guardrails.StatementTimeout
+	}
+
+	if guardrails != nil && guardrails.LockTimeout > 0 {
+		lockTimeout = guardrails.LockTimeout
+	}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return classify(ctx, err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	settings := fmt.Sprintf("SET LOCAL statement_timeout = %d; SET LOCAL lock_timeout = %d;",
+		statementTimeout.Milliseconds(), lockTimeout.Milliseconds())
+	if _, err = tx.Exec(ctx, settings); err != nil {
+		return classify(ctx, err)
+	}
+
+	return classify(ctx, fn(tx))
+}
+
+func classify(ctx context.Context, err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		if ctx.Err() != nil && err != nil {
+			return fmt.Errorf("%w: %v", ErrQueryCanceled, err)
+		}
+
+		return err
+	}
+
+	switch pgErr.Code {
+	case "57014": // query_canceled
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", ErrQueryCanceled, err)
+		}
+
+		return fmt.Errorf("%w: %v", ErrQueryTimeout, err)
+	case "55P03": // lock_not_available
+		return fmt.Errorf("%w: %v", ErrLockTimeout, err)
+	case "25006": // read_only_sql_transaction
+		return fmt.Errorf("%w: %v", ErrReadOnly, err)
+	}
+
+	return err
+}
+
 type CreateSourceReq struct {
-	Name     string
-	Type     string
-	Resource string
+	Name       string
+	Type       string
+	Resource   string
+	Guardrails *model.Guardrails
 }
 
+const insertSourceQuery = `
+	INSERT INTO sources (name, type, config, created_by, updated_by)
+	VALUES ($1, $2, $3, $4, $4)
+	RETURNING id;
+`
+
+// Create adds the source and discovers its tables. A CSV source is imported
+// into the metadata database, and the outcome of the import is emitted as an
+// event either way.
 func (s *SourceService) Create(ctx context.Context, req CreateSourceReq) (int, error) {
-	insertQuery := `
-		INSERT INTO sources (name, type, config)
-		VALUES ($1, $2, $3)
-		RETURNING id;
-	`
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return 0, err
+	}
+
+	if err := validateGuardrails(req.Guardrails); err != nil {
+		return 0, err
+	}
 
 	if req.Type == string(model.POSTGRES) {
-		config, id := model.SourceConfig{DatabaseURI: req.Resource}, 0
-		err := s.db.QueryRow(ctx, insertQuery, req.Name, req.Type, config).Scan(&id)
+		config, id := model.SourceConfig{DatabaseURI: req.Resource, Guardrails: req.Guardrails}, 0
+		err := s.db.QueryRow(ctx, insertSourceQuery, req.Name, req.Type, config, actor(ctx)).Scan(&id)
 		if err != nil {
 			return 0, err
 		}
@@ -93,115 +224,187 @@ func (s *SourceService) Create(ctx context.Context, req CreateSourceReq) (int, e
 		}
 
 		config.Datasets = dsconfigs
-		_, err = s.db.Exec(ctx, `UPDATE sources SET config = $1 WHERE id = $2;`, config, id)
+		if _, err = s.db.Exec(ctx, `UPDATE sources SET config = $1 WHERE id = $2;`, config, id); err != nil {
+			return id, err
+		}
 
-		return id, err
+		s.events.entityCreated(ctx, model.SOURCE, id, req.Name)
+		return id, nil
 	}
 
 	if req.Type == string(model.CSV) {
-		tx, err := s.db.Begin(ctx)
+		id, tables, err := s.importCSV(ctx, req)
 		if err != nil {
+			s.events.Emit(ctx, model.ImportFailed, importPayload{SourceID: id, Name: req.Name, Error: err.Error()})
 			return 0, err
 		}
 
-		datasets, err := s.DiscoverCSV(ctx, req.Resource)
+		s.events.entityCreated(ctx, model.SOURCE, id, req.Name)
+		s.events.Emit(ctx, model.ImportCompleted, importPayload{SourceID: id, Name: req.Name, Tables: tables})
+		return id, nil
+	}
+
+	return 0, errors.New("unsupported source type")
+}
+
+// importCSV creates a CSV source and copies its uploaded files into a table
+// each, returning how many rows every table received.
+func (s *SourceService) importCSV(ctx context.Context, req CreateSourceReq) (int, []importedTable, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	datasets, err := s.DiscoverCSV(ctx, req.Resource)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return 0, nil, err
+	}
+
+	config, id, dsconfigs := model.SourceConfig{Guardrails: req.Guardrails}, 0, make([]model.DatasetConfig, 0, len(datasets))
+	tables := make([]importedTable, 0, len(datasets))
+	err = tx.QueryRow(ctx, insertSourceQuery, req.Name, req.Type, config, actor(ctx)).Scan(&id)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return 0, nil, err
+	}
+
+	for _, ds := range datasets {
+		table := fmt.Sprintf("sources_%d_%s", id, ds.Config.Table)
+		columns := strings.ReplaceAll(strings.Join(ds.Config.Columns, ","), utils.ColumnSeparator, " ")
+		createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %q (%s);", table, columns)
+
+		if _, err = tx.Exec(ctx, createTableQuery); err != nil {
+			_ = tx.Rollback(ctx)
+			return 0, nil, err
+		}
+
+		filePath := filepath.Join(os.TempDir(), tmpUploadDir, req.Resource, ds.Config.Table)
+		copySQL := fmt.Sprintf("COPY %q (%s) FROM STDIN WITH (FORMAT csv, HEADER true);",
+			table, strings.Join(utils.ColumnNames(ds.Config.Columns), ","))
+
+		file, err := os.Open(filePath)
 		if err != nil {
-			return 0, err
+			_ = tx.Rollback(ctx)
+			return 0, nil, err
 		}
 
-		config, id, dsconfigs := model.SourceConfig{}, 0, make([]model.DatasetConfig, 0, len(datasets))
-		err = s.db.QueryRow(ctx, insertQuery, req.Name, req.Type, config).Scan(&id)
+		tag, err := tx.Conn().PgConn().CopyFrom(ctx, file, copySQL)
+		_ = file.Close()
+
 		if err != nil {
 			_ = tx.Rollback(ctx)
-			return id, err
+			return 0, nil, fmt.Errorf("failed to import csv: %v", err)
 		}
 
-		for _, ds := range datasets {
-			table := fmt.Sprintf("sources_%d_%s", id, ds.Config.Table)
-			columns := strings.ReplaceAll(strings.Join(ds.Config.Columns, ","), utils.ColumnSeparator, " ")
-			createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %q (%s);", table, columns)
+		dsconfigs = append(dsconfigs, model.DatasetConfig{
+			Schema:  defaultSchema,
+			Table:   table,
+			Columns: ds.Config.Columns,
+		})
+		tables = append(tables, importedTable{Table: table, Rows: tag.RowsAffected()})
+	}
 
-			if _, err = s.db.Exec(ctx, createTableQuery); err != nil {
-				_ = tx.Rollback(ctx)
-				return 0, err
-			}
+	config.Datasets = dsconfigs
+	if _, err = tx.Exec(ctx, `UPDATE sources SET config = $1 WHERE id = $2;`, config, id); err != nil {
+		_ = tx.Rollback(ctx)
+		return 0, nil, err
+	}
 
-			filePath := filepath.Join(os.TempDir(), tmpUploadDir, req.Resource, ds.Config.Table)
-			copySQL := fmt.Sprintf("COPY %q (%s) FROM STDIN WITH (FORMAT csv, HEADER true);",
-				table, strings.Join(utils.ColumnNames(ds.Config.Columns), ","))
+	if err = tx.Commit(ctx); err != nil {
+		return 0, nil, err
+	}
 
-			file, err := os.Open(filePath)
-			if err != nil {
-				_ = tx.Rollback(ctx)
-				return 0, err
-			}
+	return id, tables, nil
+}
 
-			_, err = tx.Conn().PgConn().CopyFrom(ctx, file, copySQL)
-			_ = file.Close()
+func validateGuardrails(guardrails *model.Guardrails) error {
+	if guardrails == nil {
+		return nil
+	}
 
-			if err != nil {
-				_ = tx.Rollback(ctx)
-				return 0, fmt.Errorf("failed to import csv: %v", err)
-			}
+	if guardrails.MaxCost < 0 || guardrails.MaxSeqScanRows < 0 || guardrails.StatementTimeout < 0 || guardrails.LockTimeout < 0 {
+		return errors.New("guardrail limits must not be negative")
+	}
 
-			dsconfigs = append(dsconfigs, model.DatasetConfig{
-				Schema:  defaultSchema,
-				Table:   table,
-				Columns: ds.Config.Columns,
-			})
-		}
+	return nil
+}
 
-		config.Datasets = dsconfigs
-		if _, err = s.db.Exec(ctx, `UPDATE sources SET config = $1 WHERE id = $2;`, config, id); err != nil {
-			_ = tx.Rollback(ctx)
-			return 0, err
-		}
+// UpdateGuardrails replaces the guardrails of the source, nil removes them.
+func (s *SourceService) UpdateGuardrails(ctx context.Context, id int, guardrails *model.Guardrails) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
 
-		if err = tx.Commit(ctx); err != nil {
-			return 0, err
-		}
+	if err := validateGuardrails(guardrails); err != nil {
+		return err
+	}
 
-		return id, nil
+	source, _, err := s.Get(ctx, id)
+	if err != nil {
+		return err
 	}
 
-	return 0, errors.New("unsupported source type")
+	source.Config.Guardrails = guardrails
+	query := `UPDATE sources SET config = $1, updated_by = $3 WHERE id = $2;`
+	if _, err = s.db.Exec(ctx, query, source.Config, id, actor(ctx)); err != nil {
+		return err
+	}
+
+	s.events.entityChanged(ctx, model.SOURCE, id, source.Name)
+	return nil
 }
 
-func (s *SourceService) Delete(ctx context.Context, id int) error {
-	tx, err := s.db.Begin(ctx)
-	if err != nil {
+// Dependents lists the datasets, charts and dashboards built on the source.
+func (s *SourceService) Dependents(ctx context.Context, id int) (model.Dependents, error) {
+	return findDependents(ctx, s.db, model.SOURCE, id, false)
+}
+
+// Delete removes the source and, depending on the mode, its dependents. The
+// tables of an imported CSV source are dropped in the same transaction, unless
+// the source only moves to the trash.
+func (s *SourceService) Delete(ctx context.Context, id int, mode model.DeleteMode) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
 		return err
 	}
 
-	source, datasets, err := s.Get(ctx, id)
+	source, _, err := s.Get(ctx, id)
 	if err != nil {
-		_ = tx.Rollback(ctx)
 		return err
 	}
 
-	if _, err = s.db.Exec(ctx, `DELETE FROM sources WHERE id = $1;`, id); err != nil {
-		_ = tx.Rollback(ctx)
+	deps, err := deleteEntity(ctx, s.db, model.SOURCE, id, mode, func(tx pgx.Tx) error {
+		return dropTables(ctx, tx, source)
+	})
+	if err != nil {
 		return err
 	}
 
-	if source.Type == model.CSV {
-		tables := make([]string, len(datasets))
-		for idx, ds := range datasets {
-			tables[idx] = ds.Table
-		}
+	s.events.entityDeleted(ctx, model.SOURCE, id, mode, deps)
+	return nil
+}
 
-		dropQuery := fmt.Sprintf("DROP TABLE IF EXISTS %s", strings.Join(tables, ","))
-		if _, err = s.db.Exec(ctx, dropQuery); err != nil {
-			_ = tx.Rollback(ctx)
-			return err
-		}
+// dropTables drops the tables a CSV source was imported into.
+func dropTables(ctx context.Context, tx pgx.Tx, source model.Source) error {
+	if source.Type != model.CSV || len(source.Config.Datasets) == 0 {
+		return nil
 	}
 
-	return nil
+	tables := make([]string, len(source.Config.Datasets))
+	for idx, ds := range source.Config.Datasets {
+		tables[idx] = pgx.Identifier{ds.Schema, ds.Table}.Sanitize()
+	}
+
+	_, err := tx.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", strings.Join(tables, ",")))
+	return err
 }
 
 func (s *SourceService) DiscoverDB(ctx context.Context, uri string) ([]model.Dataset, error) {
 	datasets := make([]model.Dataset, 0)
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return datasets, err
+	}
+
 	schemas := map[string][]model.DatasetConfig{}
 
 	conn, err := pgxpool.Connect(ctx, uri)
@@ -217,38 +420,45 @@ func (s *SourceService) DiscoverDB(ctx context.Context, uri string) ([]model.Dat
 		ORDER BY table_schema, table_name, ordinal_position;
 	`
 
-	rows, err := conn.Query(ctx, query)
-	if err != nil {
-		return datasets, errors.New("failed to query schemas, tables, and columns")
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var schema, table, columnName, dataType string
-		if err := rows.Scan(&schema, &table, &columnName, &dataType); err != nil {
-			return datasets, errors.New("failed to scan row")
+	err = s.readOnly(ctx, conn, nil, func(conn querier) error {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return errors.New("failed to query schemas, tables, and columns")
 		}
+		defer rows.Close()
 
-		found := false
-		for idx, info := range schemas[schema] {
-			if info.Table == table {
-				schemas[schema][idx].Columns = append(
-					schemas[schema][idx].Columns,
-					utils.FormatColumn(columnName, dataType),
-				)
-				found = true
-				break
+		for rows.Next() {
+			var schema, table, columnName, dataType string
+			if err := rows.Scan(&schema, &table, &columnName, &dataType); err != nil {
+				return errors.New("failed to scan row")
 			}
-		}
 
-		if !found {
-			schemas[schema] = append(schemas[schema],
-				model.DatasetConfig{
-					Schema:  schema,
-					Table:   table,
-					Columns: []string{utils.FormatColumn(columnName, dataType)},
-				})
+			found := false
+			for idx, info := range schemas[schema] {
+				if info.Table == table {
+					schemas[schema][idx].Columns = append(
+						schemas[schema][idx].Columns,
+						utils.FormatColumn(columnName, dataType),
+					)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				schemas[schema] = append(schemas[schema],
+					model.DatasetConfig{
+						Schema:  schema,
+						Table:   table,
+						Columns: []string{utils.FormatColumn(columnName, dataType)},
+					})
+			}
 		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return datasets, err
 	}
 
 	for configs := range maps.Values(schemas) {
@@ -262,6 +472,10 @@ func (s *SourceService) DiscoverDB(ctx context.Context, uri string) ([]model.Dat
 
 func (s *SourceService) DiscoverCSV(ctx context.Context, uploadID string) ([]model.Dataset, error) {
 	datasets := make([]model.Dataset, 0)
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return datasets, err
+	}
+
 	uploadDir := filepath.Join(os.TempDir(), tmpUploadDir, uploadID)
 	entries, err := os.ReadDir(uploadDir)
 	if err != nil {
@@ -308,6 +522,10 @@ func (s *SourceService) DiscoverCSV(ctx context.Context, uploadID string) ([]mod
 }
 
 func (s *SourceService) Upload(ctx context.Context, files []*multipart.FileHeader) ([]model.Dataset, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return nil, err
+	}
+
 	uploadID := uuid.NewString()
 	uploadDir := filepath.Join(os.TempDir(), tmpUploadDir, uploadID)
 	datasets := make([]model.Dataset, 0, len(files))
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	ErrNotInTrash    = errors.New("entity is not in the trash")
+	ErrParentDeleted = errors.New("entity depends on a deleted entity, restore that one first")
+)
+
+// trashQuery lists soft-deleted entities of every kind.
+const trashQuery = `
+	SELECT 'source', id, name, deleted_at FROM sources WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'dataset', id, name, deleted_at FROM datasets WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'chart', id, name, deleted_at FROM charts WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'dashboard', id, name, deleted_at FROM dashboards WHERE deleted_at IS NOT NULL
+`
+
+// parentQueries tell whether the entity an entity is built on is deleted.
+var parentQueries = map[model.EntityKind]string{
+	model.DATASET: `SELECT s.deleted_at IS NOT NULL FROM datasets d JOIN sources s ON s.id = d.source_id WHERE d.id = $1`,
+	model.CHART:   `SELECT d.deleted_at IS NOT NULL FROM charts c JOIN datasets d ON d.id = c.dataset_id WHERE c.id = $1`,
+}
+
+// TrashService lists and restores soft-deleted entities, and purges them
+// once they have been in the trash for longer than the retention.
+type TrashService struct {
+	db        *pgxpool.Pool
+	events    *WebhookService
+	retention time.Duration
+	logger    *log.Logger
+}
+
+func NewTrashService(db *pgxpool.Pool, events *WebhookService, retention time.Duration, logger *log.Logger) *TrashService {
+	return &TrashService{db: db, events: events, retention: retention, logger: logger}
+}
+
+func (s *TrashService) Start(ctx context.Context) {
+	go s.purgeExpired(ctx)
+}
+
+// All lists the trash, most recently deleted first.
+func (s *TrashService) All(ctx context.Context) ([]model.TrashItem, error) {
+	rows, err := s.db.Query(ctx, trashQuery+` ORDER BY 4 DESC, 1, 2`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve trash: %w", err)
+	}
+	defer rows.Close()
+
+	items := make([]model.TrashItem, 0)
+	for rows.Next() {
+		var item model.TrashItem
+		if err = rows.Scan(&item.Kind, &item.ID, &item.Name, &item.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan trash row: %w", err)
+		}
+
+		item.PurgeAt = item.DeletedAt.Add(s.retention)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// Restore takes the entity out of the trash, together with the dependents
+// that were deleted along with it.
+func (s *TrashService) Restore(ctx context.Context, kind model.EntityKind, id int) error {
+	role := model.EDITOR
+	if kind == model.SOURCE {
+		role = model.ADMIN
+	}
+
+	if err := authorize(ctx, role); err != nil {
+		return err
+	}
+
+	table, found := entityTables[kind]
+	if !found {
+		return fmt.Errorf("unknown entity kind: %s", kind)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var deletedAt *time.Time
+	query := fmt.Sprintf(`SELECT deleted_at FROM %s WHERE id = $1 FOR UPDATE`, table)
+	err = tx.QueryRow(ctx, query, id).Scan(&deletedAt)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && deletedAt == nil) {
+		return ErrNotInTrash
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s: %w", kind, err)
+	}
+
+	if query, found := parentQueries[kind]; found {
+		var parentDeleted bool
+		if err = tx.QueryRow(ctx, query, id).Scan(&parentDeleted); err != nil {
+			return fmt.Errorf("failed to retrieve %s: %w", kind, err)
+		}
+
+		if parentDeleted {
+			return ErrParentDeleted
+		}
+	}
+
+	deps, err := findDependents(ctx, tx, kind, id, true)
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`UPDATE %s SET deleted_at = NULL WHERE id = $1`, table)
+	if _, err = tx.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", kind, err)
+	}
+
+	// dependents deleted separately, before or after, stay in the trash
+	query = `UPDATE datasets SET deleted_at = NULL WHERE id = ANY($1) AND deleted_at = $2`
+	if _, err = tx.Exec(ctx, query, refIDs(deps.Datasets), deletedAt); err != nil {
+		return fmt.Errorf("failed to restore datasets: %w", err)
+	}
+
+	query = `UPDATE charts SET deleted_at = NULL WHERE id = ANY($1) AND deleted_at = $2`
+	if _, err = tx.Exec(ctx, query, refIDs(deps.Charts), deletedAt); err != nil {
+		return fmt.Errorf("failed to restore charts: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	s.events.Emit(ctx, model.EntityEvent(kind, model.RESTORED), entityPayload{Kind: kind, ID: id})
+	return nil
+}
+
+// Purge removes a soft-deleted entity and its dependents for good. The tables
+// of a CSV source are only dropped at this point.
+func (s *TrashService) Purge(ctx context.Context, kind model.EntityKind, id int) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	table, found := entityTables[kind]
+	if !found {
+		return fmt.Errorf("unknown entity kind: %s", kind)
+	}
+
+	var deleted bool
+	query := fmt.Sprintf(`SELECT deleted_at IS NOT NULL FROM %s WHERE id = $1`, table)
+	err := s.db.QueryRow(ctx, query, id).Scan(&deleted)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !deleted) {
+		return ErrNotInTrash
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s: %w", kind, err)
+	}
+
+	var cleanup func(tx pgx.Tx) error
+	if kind == model.SOURCE {
+		source := model.Source{ID: id}
+		err = s.db.QueryRow(ctx, `SELECT type, config FROM sources WHERE id = $1`, id).
+			Scan(&source.Type, &source.Config)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve source: %w", err)
+		}
+
+		cleanup = func(tx pgx.Tx) error {
+			return dropTables(ctx, tx, source)
+		}
+	}
+
+	// the entity was reported as deleted when it moved to the trash
+	_, err = deleteEntity(ctx, s.db, kind, id, model.CASCADE, cleanup)
+	return err
+}
+
+// purgeExpired periodically purges the entities whose retention ran out.
+func (s *TrashService) purgeExpired(ctx context.Context) {
+	ticker := time.NewTicker(min(s.retention, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			items, err := s.All(ctx)
+			if err != nil {
+				s.logger.Printf("trash purge: %v", err)
+				continue
+			}
+
+			for _, item := range items {
+				if time.Now().Before(item.PurgeAt) {
+					continue
+				}
+
+				// purging a source or dataset takes its dependents along
+				if err = s.Purge(ctx, item.Kind, item.ID); err != nil && !errors.Is(err, ErrNotInTrash) {
+					s.logger.Printf("trash purge of %s %d: %v", item.Kind, item.ID, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// apiKeyPrefix marks API keys, so they are easy to tell from session
+	// tokens and to spot in leaked text.
+	apiKeyPrefix    = "aaa_"
+	apiKeyPrefixLen = len(apiKeyPrefix) + 8
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidUser        = errors.New("invalid user")
+	ErrEmailTaken         = errors.New("email already in use")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrUnauthenticated    = errors.New("not signed in")
+	ErrAPIKeyNotFound     = errors.New("api key not found")
+)
+
+// attributePattern matches the names of user attributes, which row rules
+// refer to as {{user.<name>}}.
+var attributePattern = regexp.MustCompile(`^\w+$`)
+
+// dummyHash is compared against when signing in with an unknown email, so
+// the response time doesn't tell which emails have an account.
+var dummyHash = []byte("$2a$10$lcxFJQdmg13c2KoleDIvIu6G/uh3cP94AGSsjmnEYLJ4NlVXlSGVu")
+
+type userKey struct{}
+
+// UserKey is the context key of the signed in user. The api stores the user
+// under it in the fiber request, whose context resolves it for the services.
+var UserKey = userKey{}
+
+// WithUser returns a context acting as the user, e.g. for work done on their
+// behalf outside of a request.
+func WithUser(ctx context.Context, user model.User) context.Context {
+	return context.WithValue(ctx, UserKey, user)
+}
+
+// CurrentUser returns the user the context acts as, if any.
+func CurrentUser(ctx context.Context) (model.User, bool) {
+	user, ok := ctx.Value(UserKey).(model.User)
+	return user, ok
+}
+
+// actor returns the ID of the user the context acts as, nil for background
+// work, to record who created or updated an entity.
+func actor(ctx context.Context) *int {
+	if user, ok := CurrentUser(ctx); ok {
+		return &user.ID
+	}
+
+	return nil
+}
+
+// UserService manages user accounts and how they sign in: password login
+// starts a session, while API keys let scripts act as their user. Session
+// tokens and API keys are random, only their hashes are stored.
+type UserService struct {
+	db         *pgxpool.Pool
+	sessionTTL time.Duration
+}
+
+func NewUserService(db *pgxpool.Pool, sessionTTL time.Duration) *UserService {
+	return &UserService{db: db, sessionTTL: sessionTTL}
+}
+
+// All lists every user, which takes the admin role.
+func (s *UserService) All(ctx context.Context) ([]model.User, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT id, email, name, role, attributes, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]model.User, 0)
+	for rows.Next() {
+		var user model.User
+		if err = rows.Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.Attributes, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user row: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Get returns the user. Anyone but admins can only get themselves.
+func (s *UserService) Get(ctx context.Context, id int) (model.User, error) {
+	var user model.User
+	if current, ok := CurrentUser(ctx); ok && current.ID != id {
+		if err := authorize(ctx, model.ADMIN); err != nil {
+			return user, err
+		}
+	}
+
+	err := s.db.QueryRow(ctx, `SELECT id, email, name, role, attributes, created_at FROM users WHERE id = $1`, id).
+		Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.Attributes, &user.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+
+	if err != nil {
+		return user, fmt.Errorf("failed to retrieve user: %w", err)
+	}
+
+	return user, nil
+}
+
+type UserReq struct {
+	Email    string
+	Name     string
+	Password string
+	Role     model.Role
+}
+
+// Create adds a user, a viewer unless given another role.
+func (s *UserService) Create(ctx context.Context, req UserReq) (int, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO users (email, name, password_hash, role) VALUES ($1, $2, $3, $4) RETURNING id`
+	return s.insert(ctx, query, req)
+}
+
+// Bootstrap creates the first user as an admin, so a fresh install can be
+// signed into. It does nothing once there are users, and reports whether it
+// created one.
+func (s *UserService) Bootstrap(ctx context.Context, req UserReq) (bool, error) {
+	query := `
+		INSERT INTO users (email, name, password_hash, role)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM users)
+		RETURNING id;
+	`
+
+	req.Role = model.ADMIN
+
+	_, err := s.insert(ctx, query, req)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *UserService) insert(ctx context.Context, query string, req UserReq) (int, error) {
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		return 0, fmt.Errorf("%w: name is required", ErrInvalidUser)
+	}
+
+	if req.Role == "" {
+		req.Role = model.VIEWER
+	}
+
+	if !slices.Contains(model.SupportedRoles, req.Role) {
+		return 0, fmt.Errorf("%w: unsupported role %s", ErrInvalidUser, req.Role)
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = s.db.QueryRow(ctx, query, email, req.Name, hash, req.Role).Scan(&id)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+		return 0, ErrEmailTaken
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert user: %w", err)
+	}
+
+	return id, nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return "", fmt.Errorf("%w: invalid email %q", ErrInvalidUser, email)
+	}
+
+	return email, nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("%w: password must have at least %d characters", ErrInvalidUser, minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUser, err)
+	}
+
+	return hash, err
+}
+
+// SetPassword replaces the password of the user and signs them out
+// everywhere. API keys keep working.
+func (s *UserService) SetPassword(ctx context.Context, id int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, `UPDATE users SET password_hash = $2 WHERE id = $1`, id, hash)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// SetRole changes the role of the user, effective on their next request.
+func (s *UserService) SetRole(ctx context.Context, id int, role model.Role) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	if !slices.Contains(model.SupportedRoles, role) {
+		return fmt.Errorf("%w: unsupported role %s", ErrInvalidUser, role)
+	}
+
+	tag, err := s.db.Exec(ctx, `UPDATE users SET role = $2 WHERE id = $1`, id, role)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// SetAttributes replaces the attributes of the user, which fill in the row
+// rules of datasets from their next request on.
+func (s *UserService) SetAttributes(ctx context.Context, id int, attributes map[string][]string) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	for name := range attributes {
+		if !attributePattern.MatchString(name) {
+			return fmt.Errorf("%w: invalid attribute name %q", ErrInvalidUser, name)
+		}
+
+		if slices.Contains(builtinAttributes, name) {
+			return fmt.Errorf("%w: attribute %s is built in", ErrInvalidUser, name)
+		}
+	}
+
+	if attributes == nil {
+		attributes = map[string][]string{}
+	}
+
+	tag, err := s.db.Exec(ctx, `UPDATE users SET attributes = $2 WHERE id = $1`, id, attributes)
+	if err != nil {
+		return fmt.Errorf("failed to update attributes: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// Delete removes the user along with their sessions and API keys. Entities
+// they created or updated are kept.
+func (s *UserService) Delete(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// Login checks the password of the user and starts a session, returning its
+// token and when it expires.
+func (s *UserService) Login(ctx context.Context, email string, password string) (string, time.Time, error) {
+	var id int
+	var hash []byte
+	query := `SELECT id, password_hash FROM users WHERE email = $1`
+	err := s.db.QueryRow(ctx, query, strings.ToLower(strings.TrimSpace(email))).Scan(&id, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", time.Time{}, ErrInvalidCredentials
+	}
+
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to retrieve user: %w", err)
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", time.Time{}, ErrInvalidCredentials
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// expired sessions of the user are cleaned up as they sign in again
+	if _, err = s.db.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1 AND expires_at <= NOW()`, id); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+
+	expires := time.Now().Add(s.sessionTTL)
+	query = `INSERT INTO sessions (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`
+	if _, err = s.db.Exec(ctx, query, hashToken(token), id, expires); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to insert session: %w", err)
+	}
+
+	return token, expires, nil
+}
+
+// Logout ends the session of the token.
+func (s *UserService) Logout(ctx context.Context, token string) error {
+	if _, err := s.db.Exec(ctx, `DELETE FROM sessions WHERE token_hash = $1`, hashToken(token)); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	return nil
+}
+
+// Session returns the user signed in with the session token.
+func (s *UserService) Session(ctx context.Context, token string) (model.User, error) {
+	query := `
+		SELECT u.id, u.email, u.name, u.role, u.attributes, u.created_at
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > NOW();
+	`
+
+	var user model.User
+	err := s.db.QueryRow(ctx, query, hashToken(token)).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.Attributes, &user.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, ErrUnauthenticated
+	}
+
+	if err != nil {
+		return user, fmt.Errorf("failed to retrieve session: %w", err)
+	}
+
+	return user, nil
+}
+
+// APIKeys lists the API keys of the user.
+func (s *UserService) APIKeys(ctx context.Context, userID int) ([]model.APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, last_used_at, expires_at, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id;
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make([]model.APIKey, 0)
+	for rows.Next() {
+		var key model.APIKey
+		err = rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.LastUsedAt, &key.ExpiresAt, &key.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key row: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// CreateAPIKey issues a key for the user. The key itself is only returned
+// here, it can't be read back afterwards.
+func (s *UserService) CreateAPIKey(ctx context.Context, userID int, name string, expiresAt *time.Time) (model.APIKey, string, error) {
+	key := model.APIKey{UserID: userID, Name: name, ExpiresAt: expiresAt}
+	if strings.TrimSpace(name) == "" {
+		return key, "", fmt.Errorf("%w: api key name is required", ErrInvalidUser)
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return key, "", fmt.Errorf("%w: api key expiry must be in the future", ErrInvalidUser)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return key, "", err
+	}
+
+	secret := apiKeyPrefix + token
+	key.Prefix = secret[:apiKeyPrefixLen]
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;
+	`
+	err = s.db.QueryRow(ctx, query, userID, name, key.Prefix, hashToken(secret), expiresAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return key, "", fmt.Errorf("failed to insert api key: %w", err)
+	}
+
+	return key, secret, nil
+}
+
+// RevokeAPIKey deletes one of the keys of the user.
+func (s *UserService) RevokeAPIKey(ctx context.Context, userID int, id int) error {
+	tag, err := s.db.Exec(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete api key: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// APIKey returns the user the API key belongs to, recording its use.
+func (s *UserService) APIKey(ctx context.Context, key string) (model.User, error) {
+	var user model.User
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return user, ErrUnauthenticated
+	}
+
+	query := `
+		UPDATE api_keys k
+		SET last_used_at = NOW()
+		FROM users u
+		WHERE u.id = k.user_id AND k.key_hash = $1 AND (k.expires_at IS NULL OR k.expires_at > NOW())
+		RETURNING u.id, u.email, u.name, u.role, u.attributes, u.created_at;
+	`
+
+	err := s.db.QueryRow(ctx, query, hashToken(key)).Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.Attributes, &user.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, ErrUnauthenticated
+	}
+
+	if err != nil {
+		return user, fmt.Errorf("failed to retrieve api key: %w", err)
+	}
+
+	return user, nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken hashes session tokens and API keys for storage. Unlike passwords
+// they are random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rulePlaceholder matches the user attributes in a row rule, like
+// {{user.regions}}.
+var rulePlaceholder = regexp.MustCompile(`\{\{\s*user\.(\w+)\s*\}\}`)
+
+// listPrefix matches the end of an expression followed by a list, as in
+// Region IN or Region NOT IN.
+var listPrefix = regexp.MustCompile(`(?i)\bIN\s*$`)
+
+// RenderRule replaces the attribute placeholders of a row rule with the
+// values of the user as a parenthesised list of literals, as in
+// Region IN {{user.regions}}. Attributes the user lacks render as (NULL),
+// which matches no rows.
+func RenderRule(expr string, attributes map[string][]string) string {
+	return rulePlaceholder.ReplaceAllStringFunc(expr, func(placeholder string) string {
+		values := attributes[rulePlaceholder.FindStringSubmatch(placeholder)[1]]
+		if len(values) == 0 {
+			return "(NULL)"
+		}
+
+		quoted := make([]string, len(values))
+		for idx, value := range values {
+			quoted[idx] = quote(value)
+		}
+
+		return fmt.Sprintf("(%s)", strings.Join(quoted, ","))
+	})
+}
+
+// ValidateRule checks the placeholders of a row rule. As they render as
+// lists, each has to follow IN, so the rule holds however many values the
+// attribute has.
+func ValidateRule(expr string) error {
+	if strings.Contains(rulePlaceholder.ReplaceAllString(expr, ""), "{{") {
+		return errors.New("malformed placeholder, expected {{user.<attribute>}}")
+	}
+
+	for _, loc := range rulePlaceholder.FindAllStringIndex(expr, -1) {
+		if !listPrefix.MatchString(expr[:loc[0]]) {
+			return fmt.Errorf("placeholder %s must follow IN or NOT IN", expr[loc[0]:loc[1]])
+		}
+	}
+
+	return nil
+}
+
+// BuildRules joins rendered row rules into one condition, or returns an
+// empty string when there are none.
+func BuildRules(rules []string) string {
+	if len(rules) == 0 {
+		return ""
+	}
+
+	conditions := make([]string, len(rules))
+	for idx, rule := range rules {
+		conditions[idx] = fmt.Sprintf("(%s)", rule)
+	}
+
+	return strings.Join(conditions, " AND ")
+}
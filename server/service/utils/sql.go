@@ -3,34 +3,202 @@ package utils
 import (
 	"fmt"
 	"github.com/samber/lo"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 )
 
-func BuildSQLQuery(table string, dimensions []string, metrics []string, filters []string, columns []string) string {
-	dimensionsSQL := buildDimensions(dimensions)
-	metricsSQL := buildMetrics(metrics)
-	selectSQL := buildSelect(dimensionsSQL, metricsSQL)
-	whereSQL := buildWhere(filters, columns)
+// OthersLabel is the group that collects everything outside the top N.
+const OthersLabel = "Others"
 
-	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s GROUP BY %s ORDER BY %s`, selectSQL, table, whereSQL, dimensionsSQL, dimensionsSQL)
+type Query struct {
+	Table      string
+	Dimensions []string
+	Metrics    []string
+	Filters    []string
+	Conditions []Filter
+	Columns    []string
+	SortField  string
+	SortDesc   bool
+	Limit      int
+	TopN       int
+	Having     []Condition
+	Calendar   Calendar
+	Transforms []Transform
+	Rules      []string
 }
 
-func buildWhere(filters []string, columns []string) interface{} {
+// Filter compares a column, optionally with a date precision, against
+// values. Unlike the filters of a chart, which are column/operator/value
+// strings, the values are kept apart, so they may hold any character.
+type Filter struct {
+	Column   string
+	Operator string
+	Values   []string
+}
+
+// Condition compares an aggregate expression against a constant.
+type Condition struct {
+	Expression string
+	Operator   string
+	Value      float64
+}
+
+// BuildSQLQuery compiles the query into a grouped SELECT. Dimensions and
+// metrics are aliased as d0..dN and m0..mN so the outer query can sort and
+// limit on any of them. Row rules are always part of the WHERE clause, the
+// top N subquery included.
+func BuildSQLQuery(q Query) string {
+	dimensions := buildDimensions(q.Dimensions, q.Columns, q.Calendar)
+	whereSQL := buildWhere(append(ParseFilters(q.Filters), q.Conditions...), q.Columns)
+	if rulesSQL := BuildRules(q.Rules); rulesSQL != "" {
+		whereSQL = fmt.Sprintf("(%s) AND (%s)", whereSQL, rulesSQL)
+	}
+
+	if q.TopN > 0 && len(dimensions) > 0 && len(q.Metrics) > 0 {
+		dimensions[0] = buildTopN(q.Table, dimensions[0], q.Metrics[0], whereSQL, q.TopN)
+	}
+
+	selectSQL := buildSelect(aliases(dimensions, "d"), aliases(q.Metrics, "m"))
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s`, selectSQL, q.Table, whereSQL)
+	if len(dimensions) > 0 {
+		query = fmt.Sprintf(`%s GROUP BY %s`, query, ordinals(len(dimensions)))
+	}
+
+	if havingSQL := buildHaving(q.Having); havingSQL != "" {
+		query = fmt.Sprintf(`%s HAVING %s`, query, havingSQL)
+	}
+
+	if len(q.Transforms) > 0 && len(dimensions) > 0 {
+		query = buildTransforms(query, q)
+	}
+
+	query = fmt.Sprintf(`SELECT * FROM (%s) AS q`, query)
+	if orderSQL := buildOrder(q); orderSQL != "" {
+		query = fmt.Sprintf(`%s ORDER BY %s`, query, orderSQL)
+	}
+
+	if q.Limit > 0 {
+		query = fmt.Sprintf(`%s LIMIT %d`, query, q.Limit)
+	}
+
+	return query
+}
+
+// FieldAlias returns the alias of a chart dimension or metric in the
+// compiled query, or an empty string when the field is not part of it.
+func FieldAlias(field string, dimensions []string, metrics []string) string {
+	if idx := slices.Index(dimensions, field); idx != -1 {
+		return fmt.Sprintf("d%d", idx)
+	}
+
+	if idx := slices.Index(metrics, field); idx != -1 {
+		return fmt.Sprintf("m%d", idx)
+	}
+
+	return ""
+}
+
+func buildHaving(conditions []Condition) string {
+	normalized := make([]string, len(conditions))
+	for idx, cond := range conditions {
+		normalized[idx] = fmt.Sprintf("%s %s %s", cond.Expression, cond.Operator, strconv.FormatFloat(cond.Value, 'f', -1, 64))
+	}
+
+	return strings.Join(normalized, " AND ")
+}
+
+func buildTopN(table, dimension, metric, where string, n int) string {
+	top := fmt.Sprintf(`SELECT %s FROM %s WHERE %s GROUP BY 1 ORDER BY %s DESC LIMIT %d`,
+		dimension, table, where, metric, n)
+
+	return fmt.Sprintf(`CASE WHEN %[1]s IN (%[2]s) THEN (%[1]s)::text ELSE '%[3]s' END`, dimension, top, OthersLabel)
+}
+
+func buildOrder(q Query) string {
+	order := make([]string, 0)
+
+	if q.TopN > 0 && len(q.Dimensions) > 0 {
+		order = append(order, fmt.Sprintf("d0 = '%s'", OthersLabel))
+	}
+
+	if alias := FieldAlias(q.SortField, q.Dimensions, q.Metrics); alias != "" {
+		direction := "ASC"
+		if q.SortDesc {
+			direction = "DESC"
+		}
+
+		order = append(order, fmt.Sprintf("%s %s", alias, direction))
+	}
+
+	for idx := range q.Dimensions {
+		order = append(order, fmt.Sprintf("d%d", idx))
+	}
+
+	return strings.Join(order, ",")
+}
+
+func aliases(expressions []string, prefix string) string {
+	normalized := make([]string, len(expressions))
+	for idx, expr := range expressions {
+		normalized[idx] = fmt.Sprintf("%s AS %s%d", expr, prefix, idx)
+	}
+
+	return strings.Join(normalized, ",")
+}
+
+func ordinals(n int) string {
+	positions := make([]string, n)
+	for idx := range positions {
+		positions[idx] = strconv.Itoa(idx + 1)
+	}
+
+	return strings.Join(positions, ",")
+}
+
+// ParseFilters reads chart filters, which are column/operator/value
+// strings. The value of an IN filter is a comma separated list. Malformed
+// filters are dropped.
+func ParseFilters(filters []string) []Filter {
+	parsed := make([]Filter, 0, len(filters))
+
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		values := []string{parts[2]}
+		if parts[1] == "IN" {
+			values = strings.Split(parts[2], ",")
+		}
+
+		parsed = append(parsed, Filter{Column: parts[0], Operator: parts[1], Values: values})
+	}
+
+	return parsed
+}
+
+func buildWhere(filters []Filter, columns []string) string {
 	normalized := make([]string, 0)
 	normalized = append(normalized, "1=1")
 
 	for _, filter := range filters {
-		parts := strings.Split(filter, "/")
-		if len(parts) != 3 {
+		if len(filter.Values) == 0 {
 			continue
 		}
 
-		dimension, operator, value := parts[0], parts[1], parts[2]
+		dimension, operator, value := filter.Column, filter.Operator, filter.Values[0]
 
 		column, precision := ParseColumn(dimension)
 		if precision != "" {
-			query := fmt.Sprintf("EXTRACT(%s FROM %s)::text %s '%s'", precision, column, operator, value)
+			value = quote(value)
+			if operator == "IN" {
+				value = quoteList(filter.Values)
+			}
+
+			query := fmt.Sprintf("EXTRACT(%s FROM %s)::text %s %s", precision, column, operator, value)
 			normalized = append(normalized, query)
 			continue
 		}
@@ -48,16 +216,14 @@ func buildWhere(filters []string, columns []string) interface{} {
 			_, dataType := ParseColumn(columns[idx])
 			if !IsColumnNumeric(dataType) {
 				if operator == "LIKE" {
-					value = fmt.Sprintf("'%%%s%%'", value)
+					value = quote("%" + value + "%")
 				} else if operator == "IN" {
-					splits := strings.Split(value, ",")
-					inop := lo.Map(splits, func(item string, index int) string {
-						return fmt.Sprintf("'%s'", item)
-					})
-					value = fmt.Sprintf("(%s)", strings.Join(inop, ","))
+					value = quoteList(filter.Values)
 				} else {
-					value = fmt.Sprintf("'%s'", value)
+					value = quote(value)
 				}
+			} else if operator == "IN" {
+				value = fmt.Sprintf("(%s)", strings.Join(filter.Values, ","))
 			}
 		}
 
@@ -67,24 +233,52 @@ func buildWhere(filters []string, columns []string) interface{} {
 	return strings.Join(normalized, " AND ")
 }
 
-func buildDimensions(dimensions []string) string {
+// numberPattern matches plain decimal numbers, which go into queries
+// unquoted.
+var numberPattern = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+// IsNumber reports whether the value is a plain, finite decimal number.
+func IsNumber(value string) bool {
+	return numberPattern.MatchString(value)
+}
+
+// quote turns a filter value into a string literal.
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// quoteList turns filter values into a parenthesised list of literals.
+func quoteList(values []string) string {
+	return fmt.Sprintf("(%s)", strings.Join(lo.Map(values, func(item string, _ int) string {
+		return quote(item)
+	}), ","))
+}
+
+func buildDimensions(dimensions []string, columns []string, cal Calendar) []string {
 	normalized := make([]string, len(dimensions))
 
 	for idx, col := range dimensions {
 		column, precision := ParseColumn(col)
 		if precision != "" {
-			normalized[idx] = fmt.Sprintf("DATE_TRUNC('%s', %s)::date::text", precision, column)
+			normalized[idx] = buildTruncate(column, columnType(columns, column), precision, cal)
 			continue
 		}
 
 		normalized[idx] = column
 	}
 
-	return strings.Join(normalized, ",")
+	return normalized
 }
 
-func buildMetrics(metrics []string) string {
-	return strings.Join(metrics, ",")
+func columnType(columns []string, column string) string {
+	for _, col := range columns {
+		name, dataType := ParseColumn(col)
+		if strings.EqualFold(name, column) {
+			return dataType
+		}
+	}
+
+	return ""
 }
 
 func buildSelect(dimensions, metrics string) string {
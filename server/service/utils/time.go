@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Calendar controls how date dimensions are bucketed. WeekStart is the first
+// day of a week bucket, FiscalYearStart the first month (1-12) of quarter and
+// year buckets, and TimeZone the zone timestamptz columns are truncated in.
+type Calendar struct {
+	WeekStart       time.Weekday
+	FiscalYearStart int
+	TimeZone        string
+}
+
+// DefaultCalendar matches the DATE_TRUNC defaults: ISO weeks and calendar years.
+var DefaultCalendar = Calendar{WeekStart: time.Monday, FiscalYearStart: 1}
+
+func buildTruncate(column, dataType, precision string, cal Calendar) string {
+	if cal.TimeZone != "" && dataType == "timestamp with time zone" {
+		column = fmt.Sprintf("(%s AT TIME ZONE '%s')", column, strings.ReplaceAll(cal.TimeZone, "'", "''"))
+	}
+
+	// shift the value so the bucket boundary lands on the DATE_TRUNC boundary,
+	// truncate and shift the result back
+	shift := ""
+	switch precision {
+	case "week":
+		if days := (8 - int(cal.WeekStart)) % 7; days != 0 {
+			shift = fmt.Sprintf("%d days", days)
+		}
+	case "quarter", "year":
+		if cal.FiscalYearStart > 1 {
+			shift = fmt.Sprintf("%d months", 1-cal.FiscalYearStart)
+		}
+	}
+
+	if shift == "" {
+		return fmt.Sprintf("DATE_TRUNC('%s', %s)::date::text", precision, column)
+	}
+
+	return fmt.Sprintf("(DATE_TRUNC('%[1]s', %[2]s + INTERVAL '%[3]s') - INTERVAL '%[3]s')::date::text",
+		precision, column, shift)
+}
+
+// FillGaps inserts the periods missing between the first and last bucket of
+// the leading date dimension, separately for every combination of the other
+// dimensions. Missing metrics are set according to mode: "zero", "previous"
+// (carry the last value forward) or "null", which is represented as NaN.
+// Rows whose leading dimension is not a date are kept at the end.
+func FillGaps(groups [][]string, values [][]float64, precision string, mode string) ([][]string, [][]float64) {
+	if len(groups) == 0 || len(groups[0]) == 0 {
+		return groups, values
+	}
+
+	keys := make([]string, 0)
+	series := make(map[string]map[time.Time]int)
+	rest := make([]int, 0)
+
+	var first, last time.Time
+	for idx, label := range groups[0] {
+		period, err := time.Parse(dateLayout, label)
+		if err != nil {
+			rest = append(rest, idx)
+			continue
+		}
+
+		if first.IsZero() || period.Before(first) {
+			first = period
+		}
+
+		if period.After(last) {
+			last = period
+		}
+
+		key := seriesKey(groups, idx)
+		if _, found := series[key]; !found {
+			keys = append(keys, key)
+			series[key] = make(map[time.Time]int)
+		}
+		series[key][period] = idx
+	}
+
+	if first.IsZero() {
+		return groups, values
+	}
+
+	filledGroups := make([][]string, len(groups))
+	filledValues := make([][]float64, len(values))
+	previous := make(map[string][]float64)
+
+	appendRow := func(idx int) {
+		for g := range groups {
+			filledGroups[g] = append(filledGroups[g], groups[g][idx])
+		}
+
+		for v := range values {
+			filledValues[v] = append(filledValues[v], values[v][idx])
+		}
+	}
+
+	for period := first; !period.After(last); period = nextPeriod(period, precision) {
+		for _, key := range keys {
+			if idx, found := series[key][period]; found {
+				appendRow(idx)
+				previous[key] = make([]float64, len(values))
+				for v := range values {
+					previous[key][v] = values[v][idx]
+				}
+				continue
+			}
+
+			filledGroups[0] = append(filledGroups[0], period.Format(dateLayout))
+			for g, label := range strings.Split(key, "\x00")[1:] {
+				filledGroups[g+1] = append(filledGroups[g+1], label)
+			}
+
+			for v := range values {
+				filledValues[v] = append(filledValues[v], fillValue(mode, previous[key], v))
+			}
+		}
+	}
+
+	for _, idx := range rest {
+		appendRow(idx)
+	}
+
+	return filledGroups, filledValues
+}
+
+func seriesKey(groups [][]string, idx int) string {
+	parts := make([]string, len(groups))
+	for g := 1; g < len(groups); g++ {
+		parts[g] = groups[g][idx]
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+func fillValue(mode string, previous []float64, idx int) float64 {
+	switch mode {
+	case "zero":
+		return 0
+	case "previous":
+		if previous != nil {
+			return previous[idx]
+		}
+	}
+
+	return math.NaN()
+}
+
+// PeriodRange returns the start of the bucket labelled period and the start
+// of the next one, at midnight in the time zone of the calendar that built
+// the bucket. The label must start a bucket of the calendar, e.g. a fiscal
+// year bucket starts in the first month of the fiscal year.
+func PeriodRange(period string, precision string, cal Calendar) (time.Time, time.Time, error) {
+	location, err := time.LoadLocation(cal.TimeZone)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown time zone: %s", cal.TimeZone)
+	}
+
+	start, err := time.ParseInLocation(dateLayout, period, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date bucket: %s", period)
+	}
+
+	fiscal := max(cal.FiscalYearStart, 1)
+	aligned := true
+	switch precision {
+	case "year":
+		aligned = start.Day() == 1 && int(start.Month()) == fiscal
+	case "quarter":
+		aligned = start.Day() == 1 && (int(start.Month())-fiscal+12)%3 == 0
+	case "month":
+		aligned = start.Day() == 1
+	case "week":
+		aligned = start.Weekday() == cal.WeekStart
+	}
+
+	if !aligned {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid %s bucket: %s", precision, period)
+	}
+
+	return start, nextPeriod(start, precision), nil
+}
+
+// FormatBound formats a bound of PeriodRange for filtering a column of the
+// data type. Only timestamptz columns are bucketed in the time zone of the
+// calendar, the others compare against the day.
+func FormatBound(bound time.Time, dataType string, cal Calendar) string {
+	if cal.TimeZone != "" && dataType == "timestamp with time zone" {
+		return bound.Format(time.RFC3339)
+	}
+
+	return bound.Format(dateLayout)
+}
+
+func nextPeriod(period time.Time, precision string) time.Time {
+	switch precision {
+	case "year":
+		return period.AddDate(1, 0, 0)
+	case "quarter":
+		return period.AddDate(0, 3, 0)
+	case "month":
+		return period.AddDate(0, 1, 0)
+	case "week":
+		return period.AddDate(0, 0, 7)
+	default:
+		return period.AddDate(0, 0, 1)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgtype"
 )
@@ -40,6 +41,21 @@ func ToFloat64(value interface{}) (float64, error) {
 	}
 }
 
+// ToValue converts a scanned database value into something that encodes
+// cleanly to JSON, falling back to its string representation.
+func ToValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, time.Time:
+		return v
+	case int, int32, int64, float32, float64, pgtype.Numeric:
+		if f, err := ToFloat64(v); err == nil {
+			return f
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
 func IsColumnNumeric(dataType string) bool {
 	numeric := []string{"integer", "numeric", "decimal", "real", "double precision"}
 	return slices.Contains(numeric, dataType)
@@ -50,6 +66,14 @@ func IsColumnDateTime(dataType string) bool {
 	return slices.Contains(dateTime, dataType)
 }
 
+// IsColumnOrderable reports whether values of the type can be sorted as they
+// are. Types without a btree ordering, or whose ordering depends on the
+// element or user-defined type, aren't.
+func IsColumnOrderable(dataType string) bool {
+	unorderable := []string{"json", "xml", "point", "line", "lseg", "box", "path", "polygon", "circle", "ARRAY", "USER-DEFINED"}
+	return !slices.Contains(unorderable, dataType)
+}
+
 func ParseColumn(column string) (string, string) {
 	parts := strings.SplitN(column, ColumnSeparator, 2)
 	if len(parts) == 2 {
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transform derives a metric from its grouped values with a window function.
+// Metric is the index of the transformed metric in the query.
+type Transform struct {
+	Metric  int
+	Type    string
+	Window  int
+	Compare string
+}
+
+var periodIntervals = map[string]string{
+	"year":    "1 year",
+	"quarter": "3 months",
+	"month":   "1 month",
+	"week":    "1 week",
+	"day":     "1 day",
+}
+
+// buildTransforms wraps the grouped query and replaces every transformed
+// metric with its window expression. The leading dimension orders the
+// window, the remaining ones partition it into series.
+func buildTransforms(grouped string, q Query) string {
+	columns := make([]string, 0, len(q.Dimensions)+len(q.Metrics))
+	for idx := range q.Dimensions {
+		columns = append(columns, fmt.Sprintf("d%d", idx))
+	}
+
+	for idx := range q.Metrics {
+		expr := fmt.Sprintf("m%d", idx)
+		for _, t := range q.Transforms {
+			if t.Metric == idx {
+				expr = buildTransform(t, expr, q.Dimensions)
+			}
+		}
+
+		columns = append(columns, fmt.Sprintf("%s AS m%d", expr, idx))
+	}
+
+	return fmt.Sprintf(`SELECT %s FROM (%s) AS g`, strings.Join(columns, ","), grouped)
+}
+
+func buildTransform(t Transform, metric string, dimensions []string) string {
+	series := make([]string, 0)
+	for idx := 1; idx < len(dimensions); idx++ {
+		series = append(series, fmt.Sprintf("d%d", idx))
+	}
+
+	over := func(partition []string, order string, frame string) string {
+		clauses := make([]string, 0, 3)
+		if len(partition) > 0 {
+			clauses = append(clauses, "PARTITION BY "+strings.Join(partition, ","))
+		}
+
+		if order != "" {
+			clauses = append(clauses, "ORDER BY "+order)
+		}
+
+		if frame != "" {
+			clauses = append(clauses, frame)
+		}
+
+		return fmt.Sprintf("OVER (%s)", strings.Join(clauses, " "))
+	}
+
+	switch t.Type {
+	case "cumulative":
+		return fmt.Sprintf("SUM(%s) %s", metric,
+			over(series, "d0", "ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW"))
+	case "moving_average":
+		return fmt.Sprintf("AVG(%s) %s", metric,
+			over(series, "d0", fmt.Sprintf("ROWS BETWEEN %d PRECEDING AND CURRENT ROW", t.Window-1)))
+	case "percent_of_total":
+		// with series, every x bucket adds up to 100
+		partition := []string{}
+		if len(series) > 0 {
+			partition = []string{"d0"}
+		}
+
+		return fmt.Sprintf("100.0 * %s / NULLIF(SUM(%s) %s, 0)", metric, metric, over(partition, "", ""))
+	case "rank":
+		partition := []string{}
+		if len(series) > 0 {
+			partition = []string{"d0"}
+		}
+
+		return fmt.Sprintf("RANK() %s", over(partition, metric+" DESC", ""))
+	case "difference", "percent_change":
+		previous := buildPrevious(t, metric, series, dimensions, over)
+		if t.Type == "difference" {
+			return fmt.Sprintf("%s - %s", metric, previous)
+		}
+
+		return fmt.Sprintf("100.0 * (%[1]s - %[2]s) / NULLIF(%[2]s, 0)", metric, previous)
+	}
+
+	return metric
+}
+
+// buildPrevious looks up the metric of the period being compared against.
+// Date buckets are matched by interval so missing periods yield NULL instead
+// of comparing against whatever row came before.
+func buildPrevious(t Transform, metric string, series, dimensions []string, over func([]string, string, string) string) string {
+	_, precision := ParseColumn(dimensions[0])
+
+	interval := periodIntervals[precision]
+	if t.Compare == "last_year" {
+		interval = "1 year"
+	}
+
+	if interval == "" {
+		return fmt.Sprintf("LAG(%s) %s", metric, over(series, "d0", ""))
+	}
+
+	frame := fmt.Sprintf("RANGE BETWEEN INTERVAL '%[1]s' PRECEDING AND INTERVAL '%[1]s' PRECEDING", interval)
+	return fmt.Sprintf("FIRST_VALUE(%s) %s", metric, over(series, "d0::date", frame))
+}
@@ -0,0 +1,554 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amukoski/aaa/model"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	webhookTick     = 10 * time.Second
+	webhookAttempts = 8
+	// webhookLease keeps other instances away from a delivery being attempted.
+	webhookLease = 2 * time.Minute
+	webhookBatch = 20
+	// webhookErrorBody caps how much of a failed response is kept.
+	webhookErrorBody = 512
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+	ErrDeliveryNotFound = errors.New("dead-lettered delivery not found")
+)
+
+const webhookColumns = `id, name, url, secret, events, enabled, created_at`
+
+const webhookDeliveryColumns = `
+	id, webhook_id, event_id, event, payload, status, attempts, response_status, COALESCE(error, ''),
+	delivered_at, created_at
+`
+
+// WebhookService tells subscribers about changes to entities. Emitted events
+// are queued as deliveries in the metadata DB, one per matching webhook, and
+// posted in the background, backing off between failures.
+//
+// Events are emitted after the change is committed, so a crash in between
+// loses the event, and deliveries are not ordered: receivers go by the
+// creation time and ID of each event.
+type WebhookService struct {
+	db     *pgxpool.Pool
+	client *http.Client
+	logger *log.Logger
+	wake   chan struct{}
+}
+
+func NewWebhookService(db *pgxpool.Pool, logger *log.Logger) *WebhookService {
+	return &WebhookService{
+		db:     db,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Start runs the delivery loop until ctx is done.
+func (s *WebhookService) Start(ctx context.Context) {
+	go s.loop(ctx)
+}
+
+// event is the payload posted to webhooks.
+type event struct {
+	ID        string          `json:"id"`
+	Type      model.EventType `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      any             `json:"data"`
+}
+
+type entityPayload struct {
+	Kind       model.EntityKind   `json:"kind"`
+	ID         int                `json:"id"`
+	Name       string             `json:"name,omitempty"`
+	Version    int                `json:"version,omitempty"`
+	Mode       model.DeleteMode   `json:"mode,omitempty"`
+	Dependents *dependentsPayload `json:"dependents,omitempty"`
+}
+
+// dependentsPayload lists what was deleted or trashed along with an entity.
+type dependentsPayload struct {
+	Datasets   []int `json:"datasets"`
+	Charts     []int `json:"charts"`
+	Dashboards []int `json:"dashboards"`
+}
+
+type importPayload struct {
+	SourceID int             `json:"sourceId,omitempty"`
+	Name     string          `json:"name"`
+	Tables   []importedTable `json:"tables,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type importedTable struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// Emit queues the event for every enabled webhook subscribed to it. Failing
+// to queue it is logged rather than failing the change it reports.
+func (s *WebhookService) Emit(ctx context.Context, eventType model.EventType, data any) {
+	if err := s.emit(ctx, eventType, data); err != nil {
+		s.logger.Printf("webhooks: failed to emit %s: %v", eventType, err)
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *WebhookService) emit(ctx context.Context, eventType model.EventType, data any) error {
+	rows, err := s.db.Query(ctx, `SELECT id, events FROM webhooks WHERE enabled`)
+	if err != nil {
+		return err
+	}
+
+	subscribers := make([]int, 0)
+	for rows.Next() {
+		var id int
+		var filters []string
+		if err = rows.Scan(&id, &filters); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if len(filters) == 0 || slices.ContainsFunc(filters, eventType.Matches) {
+			subscribers = append(subscribers, id)
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil || len(subscribers) == 0 {
+		return err
+	}
+
+	e := event{ID: uuid.NewString(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload, status)
+		SELECT unnest($1::int[]), $2::text, $3::text, $4::jsonb, $5::text
+	`
+
+	_, err = s.db.Exec(ctx, query, subscribers, e.ID, eventType, payload, model.PENDING)
+	return err
+}
+
+// entityCreated, entityUpdated and entityDeleted emit the lifecycle events of
+// sources, datasets, charts and dashboards. Sources and charts have no
+// version, their updates are emitted by entityChanged.
+func (s *WebhookService) entityCreated(ctx context.Context, kind model.EntityKind, id int, name string) {
+	s.Emit(ctx, model.EntityEvent(kind, model.CREATED), entityPayload{Kind: kind, ID: id, Name: name})
+}
+
+func (s *WebhookService) entityUpdated(ctx context.Context, kind model.EntityKind, id int, name string, version int) {
+	s.Emit(ctx, model.EntityEvent(kind, model.UPDATED), entityPayload{Kind: kind, ID: id, Name: name, Version: version})
+}
+
+func (s *WebhookService) entityChanged(ctx context.Context, kind model.EntityKind, id int, name string) {
+	s.Emit(ctx, model.EntityEvent(kind, model.UPDATED), entityPayload{Kind: kind, ID: id, Name: name})
+}
+
+func (s *WebhookService) entityDeleted(ctx context.Context, kind model.EntityKind, id int, mode model.DeleteMode, deps model.Dependents) {
+	s.Emit(ctx, model.EntityEvent(kind, model.DELETED), entityPayload{
+		Kind: kind,
+		ID:   id,
+		Mode: mode,
+		Dependents: &dependentsPayload{
+			Datasets:   refIDs(deps.Datasets),
+			Charts:     refIDs(deps.Charts),
+			Dashboards: refIDs(deps.Dashboards),
+		},
+	})
+}
+
+func (s *WebhookService) All(ctx context.Context) ([]model.Webhook, error) {
+	rows, err := s.db.Query(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]model.Webhook, 0)
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook row: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (s *WebhookService) Get(ctx context.Context, id int) (model.Webhook, error) {
+	webhook, err := scanWebhook(s.db.QueryRow(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return webhook, ErrWebhookNotFound
+	}
+
+	if err != nil {
+		return webhook, fmt.Errorf("failed to retrieve webhook: %w", err)
+	}
+
+	return webhook, nil
+}
+
+func scanWebhook(row pgx.Row) (model.Webhook, error) {
+	var webhook model.Webhook
+	err := row.Scan(&webhook.ID, &webhook.Name, &webhook.URL, &webhook.Secret, &webhook.Events, &webhook.Enabled,
+		&webhook.CreatedAt)
+
+	return webhook, err
+}
+
+type WebhookReq struct {
+	ID      int
+	Name    string
+	URL     string
+	Events  []string
+	Enabled bool
+}
+
+// Create subscribes the webhook with a newly generated signing secret.
+func (s *WebhookService) Create(ctx context.Context, req WebhookReq) (int, error) {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return 0, err
+	}
+
+	req, err := validateWebhook(req)
+	if err != nil {
+		return 0, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return 0, fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+
+	query := `
+		INSERT INTO webhooks (name, url, secret, events, enabled)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id;
+	`
+
+	var id int
+	err = s.db.QueryRow(ctx, query, req.Name, req.URL, hex.EncodeToString(secret), req.Events, req.Enabled).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert webhook: %w", err)
+	}
+
+	return id, nil
+}
+
+// Update replaces the webhook, keeping its secret. Deliveries already queued
+// go to the new URL.
+func (s *WebhookService) Update(ctx context.Context, req WebhookReq) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	req, err := validateWebhook(req)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE webhooks SET name = $2, url = $3, events = $4, enabled = $5 WHERE id = $1`
+
+	tag, err := s.db.Exec(ctx, query, req.ID, req.Name, req.URL, req.Events, req.Enabled)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// Delete unsubscribes the webhook, dropping its queued deliveries and log.
+func (s *WebhookService) Delete(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+func validateWebhook(req WebhookReq) (WebhookReq, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return req, fmt.Errorf("%w: name is required", ErrInvalidWebhook)
+	}
+
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return req, fmt.Errorf("%w: invalid url %s", ErrInvalidWebhook, req.URL)
+	}
+
+	types := model.SupportedEventTypes()
+	for _, filter := range req.Events {
+		if !slices.ContainsFunc(types, func(t model.EventType) bool { return t.Matches(filter) }) {
+			return req, fmt.Errorf("%w: unknown event %s", ErrInvalidWebhook, filter)
+		}
+	}
+
+	if req.Events == nil {
+		req.Events = []string{}
+	}
+
+	return req, nil
+}
+
+// Deliveries returns the delivery log of the webhook, most recent first.
+func (s *WebhookService) Deliveries(ctx context.Context, id int, limit int) ([]model.WebhookDelivery, error) {
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2`
+	return s.deliveries(ctx, query, id, limit)
+}
+
+// DeadLetters returns the deliveries of every webhook that ran out of
+// attempts, most recent first.
+func (s *WebhookService) DeadLetters(ctx context.Context, limit int) ([]model.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE status = $1 ORDER BY id DESC LIMIT $2`
+	return s.deliveries(ctx, query, model.UNDELIVERED, limit)
+}
+
+func (s *WebhookService) deliveries(ctx context.Context, query string, args ...any) ([]model.WebhookDelivery, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]model.WebhookDelivery, 0)
+	for rows.Next() {
+		var d model.WebhookDelivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.Error, &d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery row: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Redeliver takes a delivery off the dead-letter list and queues it again
+// with a fresh set of attempts.
+func (s *WebhookService) Redeliver(ctx context.Context, id int) error {
+	if err := authorize(ctx, model.ADMIN); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = $3
+	`
+
+	tag, err := s.db.Exec(ctx, query, id, model.PENDING, model.UNDELIVERED)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook delivery: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeliveryNotFound
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *WebhookService) loop(ctx context.Context) {
+	ticker := time.NewTicker(webhookTick)
+	defer ticker.Stop()
+
+	for {
+		if err := s.deliverDue(ctx); err != nil {
+			s.logger.Printf("webhooks: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// deliverDue posts the deliveries that are due, leasing each claimed one so
+// a crashed attempt is picked up again once the lease runs out. Deliveries
+// of disabled webhooks wait until the webhook is enabled again.
+func (s *WebhookService) deliverDue(ctx context.Context) error {
+	query := `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $1)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT dd.id
+			FROM webhook_deliveries dd
+			JOIN webhooks ww ON ww.id = dd.webhook_id AND ww.enabled
+			WHERE dd.status IN ($3, $4) AND dd.next_attempt_at <= NOW()
+			ORDER BY dd.next_attempt_at
+			LIMIT $2
+			FOR UPDATE OF dd SKIP LOCKED
+		)
+		RETURNING d.id, d.attempts, d.event_id, d.event, d.payload, w.url, w.secret
+	`
+
+	rows, err := s.db.Query(ctx, query, webhookLease.Seconds(), webhookBatch, model.PENDING, model.RETRYING)
+	if err != nil {
+		return fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+
+	type claimed struct {
+		id       int
+		attempts int
+		eventID  string
+		event    model.EventType
+		payload  []byte
+		url      string
+		secret   string
+	}
+
+	deliveries := make([]claimed, 0)
+	for rows.Next() {
+		var c claimed
+		if err = rows.Scan(&c.id, &c.attempts, &c.eventID, &c.event, &c.payload, &c.url, &c.secret); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook delivery row: %w", err)
+		}
+		deliveries = append(deliveries, c)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+
+	for _, c := range deliveries {
+		responded, err := s.post(ctx, c.url, c.secret, c.eventID, c.event, c.payload)
+		var code *int
+		if responded != 0 {
+			code = &responded
+		}
+
+		if err == nil {
+			query = `
+				UPDATE webhook_deliveries
+				SET status = $2, response_status = $3, error = NULL, delivered_at = NOW()
+				WHERE id = $1
+			`
+			_, err = s.db.Exec(ctx, query, c.id, model.SENT, code)
+		} else {
+			s.logger.Printf("webhook delivery %d, attempt %d: %v", c.id, c.attempts, err)
+
+			status := model.RETRYING
+			if c.attempts >= webhookAttempts {
+				status = model.UNDELIVERED
+			}
+
+			query = `
+				UPDATE webhook_deliveries
+				SET status = $2, response_status = $3, error = $4, next_attempt_at = NOW() + make_interval(secs => $5)
+				WHERE id = $1
+			`
+			_, err = s.db.Exec(ctx, query, c.id, status, code, err.Error(), backoff(c.attempts).Seconds())
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to update webhook delivery: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// post sends the payload signed with the secret of the webhook and returns
+// the response status, zero when no response came back. The signature covers
+// the timestamp as well, so receivers can reject replayed requests.
+func (s *WebhookService) post(ctx context.Context, target string, secret string, eventID string, eventType model.EventType, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", eventID)
+	req.Header.Set("X-Webhook-Event", string(eventType))
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+sign(secret, timestamp, payload))
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, webhookErrorBody))
+		return rsp.StatusCode, fmt.Errorf("responded with %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return rsp.StatusCode, nil
+}
+
+// sign returns the hex HMAC-SHA256 of "<timestamp>.<payload>".
+func sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}